@@ -0,0 +1,263 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/go-jimu/components/sloghelper"
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/module"
+)
+
+type (
+	AdminConfig struct {
+		Token string `json:"token" yaml:"token" toml:"token"` // bearer token of the admin API, empty disables it
+	}
+
+	// AdminHandler serves the cache admin API below AdminPrefix and hands every other request to Next.
+	// Entries are selected by module path, by version of a module, or by the mask a module is routed to:
+	//
+	//	GET    /-/admin/cache?module=gitlab.com/group/project&version=v1.0.0
+	//	DELETE /-/admin/cache?mask=gitlab.com
+	//
+	// Purging a version leaves the list and latest responses of the module, purge the module to drop them.
+	//
+	// With a Crawler, GET /-/admin/crawl returns its progress and POST /-/admin/crawl starts a crawl.
+	AdminHandler struct {
+		Cache   goproxy.Cacher
+		Fetcher *MixedFetcher
+		Crawler *Crawler
+		// Context of the crawls started by the API, which outlive their request and stop once it is done,
+		// e.g. on SIGTERM. nil means context.Background().
+		Context context.Context
+		Token   string
+		Next    http.Handler
+	}
+
+	// AdminEntry is a cache entry with the module version it belongs to.
+	AdminEntry struct {
+		CacheEntry
+		Module  string `json:"module"`
+		Version string `json:"version,omitempty"` // empty for list and latest responses
+		Source  string `json:"source"`            // where the module is fetched from: "gitlab <mask>" or "upstream"
+	}
+
+	// adminScope selects cache entries, see AdminHandler.
+	adminScope struct {
+		prefix string
+		mask   *GitlabFetcher // nil selects by prefix only
+	}
+
+	adminError struct {
+		status int
+		msg    string
+	}
+)
+
+// AdminPrefix is the path of the admin API, it cannot clash with module paths which do not start with a dash.
+const AdminPrefix = "/-/admin/"
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, AdminPrefix) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gitlab-goproxy admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == AdminPrefix+"crawl" && h.Crawler != nil {
+		h.crawl(w, r)
+		return
+	}
+	if r.URL.Path != AdminPrefix+"cache" {
+		http.NotFound(w, r)
+		return
+	}
+	ca, ok := h.Cache.(CacheAdmin)
+	if !ok {
+		http.Error(w, "the cache cannot be inspected", http.StatusNotImplemented)
+		return
+	}
+
+	var ret any
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		ret, err = h.entries(r.Context(), ca, r.URL.Query())
+	case http.MethodDelete:
+		ret, err = h.purge(r.Context(), ca, r.URL.Query())
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ae *adminError
+	switch {
+	case errors.As(err, &ae):
+		http.Error(w, ae.msg, ae.status)
+		return
+	case err != nil:
+		slog.Error("failed to serve admin request", slog.String("query", r.URL.RawQuery), sloghelper.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(ret)
+}
+
+// crawl reports the progress of the crawler or starts a crawl in the background.
+func (h *AdminHandler) crawl(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if h.Crawler.running.Load() {
+			http.Error(w, ErrCrawlRunning.Error(), http.StatusConflict)
+			return
+		}
+		ctx := h.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		go func() {
+			if _, err := h.Crawler.Run(ctx); err != nil && !errors.Is(err, ErrCrawlRunning) && ctx.Err() == nil {
+				slog.Error("failed to crawl groups", sloghelper.Error(err))
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(h.Crawler.Progress())
+}
+
+func (h *AdminHandler) authorized(r *http.Request) bool {
+	return bearerAuthorized(r, h.Token)
+}
+
+// bearerAuthorized reports whether r carries token, which must not be empty, as bearer token.
+func bearerAuthorized(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// scope parses the module, version and mask query parameters.
+func (h *AdminHandler) scope(q url.Values) (*adminScope, error) {
+	mod, version, mask := q.Get("module"), q.Get("version"), q.Get("mask")
+	switch {
+	case mask != "" && (mod != "" || version != ""):
+		return nil, &adminError{http.StatusBadRequest, "mask cannot be combined with module or version"}
+	case mask != "":
+		for _, gf := range h.Fetcher.masks() {
+			if gf.config.Mask == mask {
+				return &adminScope{mask: gf}, nil
+			}
+		}
+		return nil, &adminError{http.StatusNotFound, "unknown mask " + mask}
+	case mod == "":
+		return nil, &adminError{http.StatusBadRequest, "module or mask is required"}
+	}
+
+	escaped, err := module.EscapePath(mod)
+	if err != nil {
+		return nil, &adminError{http.StatusBadRequest, err.Error()}
+	}
+	if version == "" {
+		return &adminScope{prefix: escaped + "/@"}, nil
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, &adminError{http.StatusBadRequest, err.Error()}
+	}
+	return &adminScope{prefix: escaped + "/@v/" + escapedVersion + "."}, nil
+}
+
+// entries lists the cache entries in the scope of q.
+func (h *AdminHandler) entries(ctx context.Context, ca CacheAdmin, q url.Values) ([]AdminEntry, error) {
+	scope, err := h.scope(q)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ca.Entries(ctx, scope.prefix)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]AdminEntry, 0, len(entries))
+	for _, e := range entries {
+		mod, version, ok := parseCacheName(e.Name)
+		if !ok || (scope.mask != nil && h.Fetcher.Route(mod) != scope.mask) {
+			continue
+		}
+		ret = append(ret, AdminEntry{CacheEntry: e, Module: mod, Version: version, Source: h.source(mod)})
+	}
+	return ret, nil
+}
+
+// purge deletes the cache entries in the scope of q and returns their names.
+func (h *AdminHandler) purge(ctx context.Context, ca CacheAdmin, q url.Values) (map[string][]string, error) {
+	entries, err := h.entries(ctx, ca, q)
+	if err != nil {
+		return nil, err
+	}
+	purged := make([]string, 0, len(entries))
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if seen[e.Name] {
+			continue
+		}
+		seen[e.Name] = true
+		if err = ca.Delete(ctx, e.Name); err != nil {
+			return nil, err
+		}
+		slog.Info("purged cache entry", slog.String("name", e.Name))
+		purged = append(purged, e.Name)
+	}
+	return map[string][]string{"purged": purged}, nil
+}
+
+// source returns where path is fetched from.
+func (h *AdminHandler) source(path string) string {
+	if gf := h.Fetcher.Route(path); gf != nil {
+		return "gitlab " + gf.config.Mask
+	}
+	return "upstream"
+}
+
+// parseCacheName returns the module path and version of the cache names goproxy uses:
+// <path>/@v/list, <path>/@latest and <path>/@v/<version>.{info,mod,zip}, all escaped.
+func parseCacheName(name string) (mod, version string, ok bool) {
+	escaped, after, ok := strings.Cut(name, "/@")
+	if !ok {
+		return "", "", false
+	}
+	mod, err := module.UnescapePath(escaped)
+	if err != nil {
+		return "", "", false
+	}
+	switch after {
+	case "latest", "v/list":
+		return mod, "", true
+	}
+	file, ok := strings.CutPrefix(after, "v/")
+	if ext := path.Ext(file); !ok || (ext != ".info" && ext != ".mod" && ext != ".zip") {
+		return "", "", false
+	}
+	version, err = module.UnescapeVersion(strings.TrimSuffix(file, path.Ext(file)))
+	return mod, version, err == nil
+}
@@ -0,0 +1,134 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ctx := context.Background()
+	fetcher, _ := newFixtureFetcher(t)
+	cache, err := gitlabgoproxy.NewCache(gitlabgoproxy.Config{})
+	assert.NoError(t, err)
+	for _, name := range []string{
+		"gitlab.com/wongidle/foobar/@v/list",
+		"gitlab.com/wongidle/foobar/@latest",
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.info",
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.mod",
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.zip",
+		"gitlab.com/wongidle/foobar/@v/v0.1.1.info",
+		"gitlab.com/!why!not!hugo/darkman/@v/v1.5.4.info",
+		"github.com/pkg/errors/@v/v0.9.1.info",
+		"sumdb/sum.golang.org/supported",
+	} {
+		assert.NoError(t, cache.Put(ctx, name, strings.NewReader(name)))
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	srv := httptest.NewServer(&gitlabgoproxy.AdminHandler{
+		Cache:   cache,
+		Fetcher: &gitlabgoproxy.MixedFetcher{Masks: []*gitlabgoproxy.GitlabFetcher{fetcher}},
+		Token:   "secret",
+		Next:    next,
+	})
+	defer srv.Close()
+
+	do := func(method string, q url.Values, token string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+gitlabgoproxy.AdminPrefix+"cache?"+q.Encode(), nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	list := func(q url.Values) []gitlabgoproxy.AdminEntry {
+		resp := do(http.MethodGet, q, "secret")
+		assert.EqualValues(t, http.StatusOK, resp.StatusCode, q.Encode())
+		var entries []gitlabgoproxy.AdminEntry
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+		return entries
+	}
+	names := func(entries []gitlabgoproxy.AdminEntry) []string {
+		ret := make([]string, 0, len(entries))
+		for _, e := range entries {
+			ret = append(ret, e.Name)
+		}
+		return ret
+	}
+
+	// a version
+	entries := list(url.Values{"module": {"gitlab.com/wongidle/foobar"}, "version": {"v0.1.0"}})
+	assert.EqualValues(t, []string{
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.info",
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.mod",
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.zip",
+	}, names(entries))
+	assert.EqualValues(t, "gitlab.com/wongidle/foobar", entries[0].Module)
+	assert.EqualValues(t, "v0.1.0", entries[0].Version)
+	assert.EqualValues(t, "memory", entries[0].Tier)
+	assert.EqualValues(t, "gitlab gitlab.com", entries[0].Source)
+	assert.EqualValues(t, len(entries[0].Name), entries[0].Size)
+	assert.False(t, entries[0].LastModified.IsZero())
+
+	// a mask, mixed-case paths are unescaped
+	entries = list(url.Values{"mask": {"gitlab.com"}})
+	assert.Len(t, entries, 7)
+	assert.Contains(t, names(entries), "gitlab.com/!why!not!hugo/darkman/@v/v1.5.4.info")
+	entries = list(url.Values{"module": {"github.com/pkg/errors"}})
+	assert.EqualValues(t, "upstream", entries[0].Source)
+
+	// purge a version, then the rest of the module
+	resp := do(http.MethodDelete, url.Values{"module": {"gitlab.com/wongidle/foobar"}, "version": {"v0.1.0"}}, "secret")
+	assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+	var purged struct{ Purged []string }
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&purged))
+	assert.Len(t, purged.Purged, 3)
+	assert.EqualValues(t, []string{
+		"gitlab.com/wongidle/foobar/@latest",
+		"gitlab.com/wongidle/foobar/@v/list",
+		"gitlab.com/wongidle/foobar/@v/v0.1.1.info",
+	}, names(list(url.Values{"module": {"gitlab.com/wongidle/foobar"}})))
+	resp = do(http.MethodDelete, url.Values{"mask": {"gitlab.com"}}, "secret")
+	assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, list(url.Values{"mask": {"gitlab.com"}}))
+	assert.Len(t, list(url.Values{"module": {"github.com/pkg/errors"}}), 1)
+
+	for _, c := range []struct {
+		method string
+		q      url.Values
+		token  string
+		status int
+	}{
+		{http.MethodGet, url.Values{"mask": {"gitlab.com"}}, "", http.StatusUnauthorized},
+		{http.MethodGet, url.Values{"mask": {"gitlab.com"}}, "wrong", http.StatusUnauthorized},
+		{http.MethodGet, url.Values{}, "secret", http.StatusBadRequest},
+		{http.MethodGet, url.Values{"mask": {"gitlab.com"}, "module": {"gitlab.com/a/b"}}, "secret", http.StatusBadRequest},
+		{http.MethodGet, url.Values{"module": {"Gitlab.com/-a"}}, "secret", http.StatusBadRequest},
+		{http.MethodGet, url.Values{"mask": {"example.com"}}, "secret", http.StatusNotFound},
+		{http.MethodPost, url.Values{"mask": {"gitlab.com"}}, "secret", http.StatusMethodNotAllowed},
+	} {
+		resp := do(c.method, c.q, c.token)
+		assert.EqualValues(t, c.status, resp.StatusCode, c.q.Encode())
+		if c.status == http.StatusUnauthorized {
+			assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+		}
+	}
+
+	// other paths are served by next
+	resp, err = http.Get(srv.URL + "/gitlab.com/wongidle/foobar/@v/list")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, http.StatusTeapot, resp.StatusCode)
+}
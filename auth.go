@@ -0,0 +1,183 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jimu/components/sloghelper"
+	"golang.org/x/mod/module"
+)
+
+type (
+	// ClientAuthConfig makes the clients of masked module paths authenticate with GitLab credentials, see AuthHandler.
+	ClientAuthConfig struct {
+		Enable      bool          `json:"enable" yaml:"enable" toml:"enable"`
+		TTL         time.Duration `json:"ttl" yaml:"ttl" toml:"ttl"`                            // lifetime of an accepted credential, 0 means 5m
+		NegativeTTL time.Duration `json:"negative_ttl" yaml:"negative_ttl" toml:"negative_ttl"` // lifetime of a rejected credential, 0 means 30s
+	}
+
+	// AuthHandler requires credentials on the module and go-get requests routed to a mask and hands every other
+	// request, and the authorized ones, to Next. Clients send HTTP Basic credentials, as the go command does from
+	// .netrc or GOAUTH, or a Bearer token. The password or token is a GitLab personal, project, group or deploy
+	// token; the username only matters for deploy tokens.
+	//
+	// A credential is accepted for a module if it can clone the GitLab project of the module, so a client only
+	// gets the modules it could fetch from GitLab directly. The project is looked up with the credential of the
+	// client rather than the access token of the mask: a project that does not exist and one the client cannot
+	// read are both answered with 401. The answers of GitLab are cached per credential and project for TTL, or
+	// NegativeTTL when rejected; a credential GitLab does not accept at all is rejected for every project. While
+	// GitLab is unavailable, a credential is still accepted for the projects it was last accepted for, past TTL
+	// but for a day at most.
+	AuthHandler struct {
+		Fetcher     *MixedFetcher
+		TTL         time.Duration
+		NegativeTTL time.Duration
+		Next        http.Handler
+
+		once    sync.Once
+		lookups *lookupCache
+		granted *lookupCache // last answers of GitLab, kept past TTL
+	}
+)
+
+const (
+	DefaultAuthTTL         = 5 * time.Minute
+	DefaultAuthNegativeTTL = 30 * time.Second
+
+	authGrantedTTL = 24 * time.Hour
+	authChallenge  = `Basic realm="gitlab-goproxy", charset="UTF-8"`
+)
+
+func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, ok := requestModule(r.URL.Path)
+	if !ok && isGoGet(r) {
+		path, ok = goGetPath(r), true
+	}
+	if !ok {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	gf := h.Fetcher.Route(path)
+	if gf == nil {
+		// modules served by the upstreams are public
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	username, password, ok := clientCredentials(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", authChallenge)
+		http.Error(w, "credentials required for "+path, http.StatusUnauthorized)
+		return
+	}
+	allowed, err := h.authorize(r.Context(), gf, path, username, password)
+	switch {
+	case err != nil:
+		slog.Warn("failed to check client credentials", slog.String("path", path), sloghelper.Error(err))
+		http.Error(w, "cannot check credentials, GitLab is unavailable", http.StatusServiceUnavailable)
+	case !allowed:
+		slog.Info("rejected client credentials", slog.String("path", path), slog.String("username", username))
+		w.Header().Set("WWW-Authenticate", authChallenge)
+		http.Error(w, "invalid credentials for "+path, http.StatusUnauthorized)
+	default:
+		h.Next.ServeHTTP(w, r)
+	}
+}
+
+// authorize reports whether the credentials can read the GitLab project of the module path. Like
+// ExtractSubPath it tries the prefixes of the GitLab path from the shortest, GitLab does not allow a project
+// below another one.
+func (h *AuthHandler) authorize(ctx context.Context, gf *GitlabFetcher, path, username, password string) (bool, error) {
+	h.once.Do(func() {
+		conf := LookupCacheConfig{TTL: h.TTL, NegativeTTL: h.NegativeTTL}
+		if conf.TTL == 0 {
+			conf.TTL = DefaultAuthTTL
+		}
+		if conf.NegativeTTL == 0 {
+			conf.NegativeTTL = DefaultAuthNegativeTTL
+		}
+		h.lookups = newLookupCache(conf)
+		h.granted = newLookupCache(LookupCacheConfig{TTL: authGrantedTTL, NegativeTTL: authGrantedTTL})
+	})
+
+	ps, err := gf.projectPath(path)
+	if err != nil {
+		return false, nil
+	}
+	// the credentials are only kept as a digest
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	credential := webURL(gf.config) + ":" + hex.EncodeToString(sum[:])
+	if ok, found := h.lookups.get(credential); found && !ok {
+		return false, nil
+	}
+	for cursor := 1; cursor < len(ps); cursor++ {
+		repo := strings.Join(ps[:cursor+1], "/")
+		key := credential + ":" + repo
+		ok, err := h.lookups.lookup(key, func() (bool, error) {
+			ok, err := gf.gitlab.CanRead(ctx, repo, username, password)
+			if err == nil {
+				h.granted.store(key, ok)
+			}
+			return ok, err
+		})
+		if errors.Is(err, ErrInvalidCredentials) {
+			h.lookups.store(credential, false)
+			h.granted.invalidate(func(key string) bool { return strings.HasPrefix(key, credential+":") })
+			return false, nil
+		}
+		if isUnavailable(err) && h.wasGranted(credential, ps) {
+			slog.Warn("GitLab is unavailable, accepted client credentials it accepted before",
+				slog.String("path", path), sloghelper.Error(err))
+			return true, nil
+		}
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// wasGranted reports whether GitLab last accepted credential for one of the projects the prefixes of the GitLab
+// path ps can be.
+func (h *AuthHandler) wasGranted(credential string, ps []string) bool {
+	for cursor := 1; cursor < len(ps); cursor++ {
+		if ok, found := h.granted.get(credential + ":" + strings.Join(ps[:cursor+1], "/")); found && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCredentials returns the Basic credentials of r, or the Bearer token as password.
+func clientCredentials(r *http.Request) (username, password string, ok bool) {
+	if username, password, ok = r.BasicAuth(); ok {
+		return username, password, password != ""
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	return "", token, ok && token != ""
+}
+
+// requestModule returns the module path of a goproxy request: list, latest, info, mod or zip.
+func requestModule(p string) (string, bool) {
+	p = strings.TrimPrefix(p, "/")
+	escaped, _, ok := strings.Cut(p, "/@v/")
+	if !ok {
+		escaped, ok = strings.CutSuffix(p, "/@latest")
+	}
+	if !ok {
+		return "", false
+	}
+	path, err := module.UnescapePath(escaped)
+	if err != nil {
+		return "", false
+	}
+	return path, true
+}
@@ -0,0 +1,142 @@
+package gitlabgoproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthHandler(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	fg.RequireToken("service-token")
+	fg.AddToken("alice-token", "read_repository")
+	fg.AddToken("bob-token", "read_repository")
+	fg.AddProject("wongidle/private").Restrict("alice-token", "gitlab+deploy-token-1:deploy-secret")
+	conf := gitlabgoproxy.Config{
+		Masks: []gitlabgoproxy.GitlabFetcherConfig{{Endpoint: fg.Endpoint(), Mask: "gitlab.com", AccessToken: "service-token"}},
+	}
+	fetcher, err := gitlabgoproxy.NewMixedFetcher(conf)
+	assert.NoError(t, err)
+	srv := httptest.NewServer(&gitlabgoproxy.AuthHandler{
+		Fetcher: fetcher,
+		Next: &gitlabgoproxy.GoGetHandler{Fetcher: fetcher, Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})},
+	})
+	defer srv.Close()
+
+	get := func(path string, auth func(*http.Request)) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		assert.NoError(t, err)
+		req.Host = "gitlab.com"
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	basic := func(username, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(username, password) }
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	// masked paths ask for credentials, the rest is open
+	resp := get("/gitlab.com/wongidle/private/@v/list", nil)
+	assert.EqualValues(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), `Basic realm="gitlab-goproxy"`)
+	assert.EqualValues(t, http.StatusTeapot, get("/github.com/pkg/errors/@v/list", nil).StatusCode)
+	assert.EqualValues(t, http.StatusTeapot, get("/gitlab.com/wongidle/private", nil).StatusCode)
+
+	for _, c := range []struct {
+		path   string
+		auth   func(*http.Request)
+		status int
+	}{
+		{"/gitlab.com/wongidle/private/@v/list", basic("alice", "alice-token"), http.StatusTeapot},
+		{"/gitlab.com/wongidle/private/@latest", bearer("alice-token"), http.StatusTeapot},
+		{"/gitlab.com/wongidle/private/@v/list", basic("gitlab+deploy-token-1", "deploy-secret"), http.StatusTeapot},
+		{"/gitlab.com/wongidle/private/@v/list", basic("someone", "deploy-secret"), http.StatusUnauthorized},
+		{"/gitlab.com/wongidle/private/@v/list", basic("bob", "bob-token"), http.StatusUnauthorized},
+		{"/gitlab.com/wongidle/foobar/@v/v0.1.0.info", bearer("bob-token"), http.StatusTeapot},
+		{"/gitlab.com/wongidle/foobar/@v/v0.1.0.info", bearer("unknown-token"), http.StatusUnauthorized},
+		// a missing project looks like one the client cannot read
+		{"/gitlab.com/wongidle/missing/@v/list", bearer("alice-token"), http.StatusUnauthorized},
+		// go-get responses name the project and its default branch
+		{"/wongidle/private/pkg?go-get=1", nil, http.StatusUnauthorized},
+		{"/wongidle/private/pkg?go-get=1", bearer("bob-token"), http.StatusUnauthorized},
+		{"/wongidle/private/pkg?go-get=1", bearer("alice-token"), http.StatusOK},
+	} {
+		assert.EqualValues(t, c.status, get(c.path, c.auth).StatusCode, c.path)
+	}
+
+	// a credential GitLab rejects learns nothing about the projects and is not checked again
+	api, refs := fg.Calls("/api/v4/"), fg.Calls(".git/info/refs")
+	for _, path := range []string{"/gitlab.com/wongidle/private/@v/list", "/gitlab.com/wongidle/missing/@v/list",
+		"/gitlab.com/wongidle/other/pkg/@latest"} {
+		resp := get(path, bearer("forged-token"))
+		assert.EqualValues(t, http.StatusUnauthorized, resp.StatusCode, path)
+	}
+	assert.EqualValues(t, api, fg.Calls("/api/v4/"))
+	assert.EqualValues(t, refs+1, fg.Calls(".git/info/refs"))
+
+	// the answers of GitLab are cached per credential and project
+	calls := fg.Calls(".git/info/refs")
+	assert.EqualValues(t, http.StatusTeapot, get("/gitlab.com/wongidle/private/@v/v0.1.0.zip", bearer("alice-token")).StatusCode)
+	assert.EqualValues(t, http.StatusUnauthorized, get("/gitlab.com/wongidle/private/@v/list", basic("bob", "bob-token")).StatusCode)
+	assert.EqualValues(t, calls, fg.Calls(".git/info/refs"))
+	assert.EqualValues(t, http.StatusTeapot, get("/gitlab.com/wongidle/foobar/@v/list", bearer("alice-token")).StatusCode)
+	assert.EqualValues(t, calls+1, fg.Calls(".git/info/refs"))
+
+	// GitLab being down is not a wrong password
+	fg.Inject(fault{Path: ".git/info/refs", Status: http.StatusBadGateway})
+	assert.EqualValues(t, http.StatusServiceUnavailable, get("/gitlab.com/wongidle/foobar/@v/list", bearer("service-token")).StatusCode)
+}
+
+func TestAuthHandler_Unavailable(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	fg.AddToken("alice-token", "read_repository")
+	fg.AddToken("bob-token", "read_repository")
+	fg.AddProject("wongidle/private").Restrict("alice-token")
+	fetcher, err := gitlabgoproxy.NewMixedFetcher(gitlabgoproxy.Config{
+		Masks: []gitlabgoproxy.GitlabFetcherConfig{{Endpoint: fg.Endpoint(), Mask: "gitlab.com"}},
+	})
+	assert.NoError(t, err)
+	srv := httptest.NewServer(&gitlabgoproxy.AuthHandler{
+		Fetcher:     fetcher,
+		TTL:         time.Millisecond,
+		NegativeTTL: time.Millisecond,
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}),
+	})
+	defer srv.Close()
+	get := func(token string) int {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/gitlab.com/wongidle/private/@v/list", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.EqualValues(t, http.StatusTeapot, get("alice-token"))
+	assert.EqualValues(t, http.StatusUnauthorized, get("bob-token"))
+	time.Sleep(10 * time.Millisecond)
+
+	// past the TTLs, GitLab being down keeps the last positive answer, never a rejection
+	fg.Inject(fault{Path: ".git/info/refs", Status: http.StatusServiceUnavailable})
+	calls := fg.Calls(".git/info/refs")
+	assert.EqualValues(t, http.StatusTeapot, get("alice-token"))
+	assert.EqualValues(t, http.StatusServiceUnavailable, get("bob-token"))
+	assert.EqualValues(t, http.StatusServiceUnavailable, get("carol-token"))
+	assert.EqualValues(t, calls+3, fg.Calls(".git/info/refs"))
+}
@@ -0,0 +1,204 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type (
+	// CircuitBreakerConfig stops calling a GitLab host that keeps failing with network errors or 5xx responses.
+	CircuitBreakerConfig struct {
+		Failures int           `json:"failures" yaml:"failures" toml:"failures"` // consecutive failed calls, retries included, that open the circuit, 0 means 5, negative disables it
+		Cooldown time.Duration `json:"cooldown" yaml:"cooldown" toml:"cooldown"` // time the circuit stays open before a probe request, 0 means 30s
+	}
+
+	// circuitBreaker is shared by the masks of a host. Once open it fails requests immediately until the
+	// cooldown passes, then lets a single probe through: success closes the circuit, failure opens it again.
+	circuitBreaker struct {
+		host string
+
+		mu        sync.Mutex
+		threshold int // negative disables the breaker
+		cooldown  time.Duration
+		failures  int
+		openUntil time.Time
+		probing   bool
+	}
+
+	// breakers holds the circuit breakers of the GitLab hosts of a MixedFetcher.
+	breakers struct {
+		mu    sync.Mutex
+		hosts map[string]*circuitBreaker
+	}
+)
+
+// ErrCircuitOpen is returned without calling GitLab while the circuit breaker of its host is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+func newBreakers() *breakers {
+	return &breakers{hosts: make(map[string]*circuitBreaker)}
+}
+
+// host returns the circuit breaker of host, created with conf unless the host has one. A nil set returns a
+// breaker of its own.
+func (bs *breakers) host(host string, conf CircuitBreakerConfig) *circuitBreaker {
+	if bs == nil {
+		return newCircuitBreaker(host, conf)
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if cb, ok := bs.hosts[host]; ok {
+		return cb
+	}
+	cb := newCircuitBreaker(host, conf)
+	bs.hosts[host] = cb
+	return cb
+}
+
+// configure applies the circuit breaker configuration of masks, the first mask of a host configures its breaker
+// and a different configuration of a later one is ignored with a warning. The breakers of the hosts still in use
+// keep their state, those of the other hosts are dropped.
+func (bs *breakers) configure(masks []GitlabFetcherConfig) {
+	if bs == nil {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	configured := make(map[string]GitlabFetcherConfig)
+	for _, c := range masks {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil {
+			continue
+		}
+		if first, ok := configured[u.Host]; ok {
+			if first.CircuitBreaker != c.CircuitBreaker {
+				slog.Warn("ignored circuit breaker config, the first mask of the host configures it",
+					slog.String("host", u.Host), slog.String("mask", c.Mask), slog.String("first", first.Mask))
+			}
+			continue
+		}
+		configured[u.Host] = c
+		if cb, ok := bs.hosts[u.Host]; ok {
+			cb.reconfigure(c.CircuitBreaker)
+		} else {
+			bs.hosts[u.Host] = newCircuitBreaker(u.Host, c.CircuitBreaker)
+		}
+	}
+	for host := range bs.hosts {
+		if _, ok := configured[host]; !ok {
+			delete(bs.hosts, host)
+		}
+	}
+}
+
+func newCircuitBreaker(host string, conf CircuitBreakerConfig) *circuitBreaker {
+	cb := &circuitBreaker{host: host}
+	cb.threshold, cb.cooldown = breakerSettings(conf)
+	return cb
+}
+
+// breakerSettings returns the threshold and cooldown of conf with the defaults applied.
+func breakerSettings(conf CircuitBreakerConfig) (int, time.Duration) {
+	threshold, cooldown := conf.Failures, conf.Cooldown
+	if threshold == 0 {
+		threshold = 5
+	}
+	if cooldown == 0 {
+		cooldown = 30 * time.Second
+	}
+	return threshold, cooldown
+}
+
+// reconfigure changes the threshold and cooldown, the failures counted so far are kept.
+func (cb *circuitBreaker) reconfigure(conf CircuitBreakerConfig) {
+	threshold, cooldown := breakerSettings(conf)
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if threshold == cb.threshold && cooldown == cb.cooldown {
+		return
+	}
+	cb.threshold, cb.cooldown = threshold, cooldown
+	if threshold < 0 {
+		cb.failures, cb.probing = 0, false
+	}
+	slog.Info("circuit breaker reconfigured", slog.String("host", cb.host),
+		slog.Int("failures", threshold), slog.Duration("cooldown", cooldown))
+}
+
+// allow reports whether a request may be sent, and whether it is the probe of a half-open circuit.
+func (cb *circuitBreaker) allow() (probe bool, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.threshold < 0 || cb.failures < cb.threshold {
+		return false, nil
+	}
+	if cb.probing || time.Now().Before(cb.openUntil) {
+		return false, fmt.Errorf("%s: %w", cb.host, ErrCircuitOpen)
+	}
+	cb.probing = true
+	return true, nil
+}
+
+// success closes the circuit.
+func (cb *circuitBreaker) success(probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.threshold >= 0 && cb.failures >= cb.threshold {
+		slog.Info("circuit breaker closed", slog.String("host", cb.host))
+	}
+	cb.failures, cb.probing = 0, false
+}
+
+// failure counts a failed request and opens the circuit once the threshold is reached.
+func (cb *circuitBreaker) failure(probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe {
+		cb.probing = false
+	}
+	if cb.threshold < 0 {
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		if cb.failures == cb.threshold || probe {
+			slog.Warn("circuit breaker opened", slog.String("host", cb.host), slog.Duration("cooldown", cb.cooldown))
+		}
+	}
+}
+
+// release ends a request whose outcome says nothing about the host.
+func (cb *circuitBreaker) release(probe bool) {
+	if probe {
+		cb.mu.Lock()
+		cb.probing = false
+		cb.mu.Unlock()
+	}
+}
+
+// do runs a GitLab call as one request of the breaker: an open circuit fails it with ErrCircuitOpen, otherwise
+// its outcome counts once, after the retries of go-gitlab. Network errors and 5xx responses are failures, see
+// isUnavailable.
+func (cb *circuitBreaker) do(f func() error) error {
+	probe, err := cb.allow()
+	if err != nil {
+		return err
+	}
+	err = f()
+	switch {
+	case errors.Is(err, context.Canceled):
+		// given up by the client, not a sign of an unhealthy host
+		cb.release(probe)
+	case isUnavailable(err):
+		cb.failure(probe)
+	default:
+		cb.success(probe)
+	}
+	return err
+}
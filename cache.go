@@ -0,0 +1,459 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jimu/components/sloghelper"
+	"github.com/goproxy/goproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/mod/module"
+)
+
+type (
+	// CacheConfig selects where goproxy caches the module files and the list, latest and query responses.
+	CacheConfig struct {
+		// Tiers are looked up in order, see TieredCache. Without tiers the s3 section is used if it is
+		// enabled, otherwise a memory tier of DefaultMemoryCacheSize.
+		Tiers []CacheTierConfig `json:"tiers" yaml:"tiers" toml:"tiers"`
+	}
+
+	CacheTierConfig struct {
+		Type string `json:"type" yaml:"type" toml:"type"` // "memory", "dir" or "s3", the s3 tier is configured by the s3 section
+		Dir  string `json:"dir" yaml:"dir" toml:"dir"`    // directory of a dir tier
+		// MaxSize in bytes kept by a memory or dir tier, 0 means DefaultMemoryCacheSize for memory and no limit for dir
+		MaxSize     int64 `json:"max_size" yaml:"max_size" toml:"max_size"`
+		MaxFileSize int64 `json:"max_file_size" yaml:"max_file_size" toml:"max_file_size"` // larger files skip the tier, 0 means no limit
+	}
+
+	// CacheStats counts the lookups and writes of a cache tier. Entries, Size and Evictions are only known for
+	// memory and dir tiers.
+	CacheStats struct {
+		Tier         string
+		Hits         uint64
+		Misses       uint64
+		Errors       uint64
+		Puts         uint64
+		ReadBytes    uint64 // size of the hits
+		WrittenBytes uint64 // size of the puts
+		Entries      int
+		Size         int64
+		Evictions    uint64
+	}
+
+	// TieredCache chains caches from the fastest to the slowest. Get reads through the tiers and copies a hit
+	// into the tiers above it. Put writes to the first tier before returning and writes back to the other
+	// tiers in the background.
+	TieredCache struct {
+		tiers []*cacheTier
+
+		mu         sync.Mutex
+		writeBacks map[string][]*writeBack // pending write-backs by name
+	}
+
+	// writeBack is a Put of a file and its copy into the tiers below the first one, done is closed when it ends.
+	// Canceling it stops the copy before the next tier.
+	writeBack struct {
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+
+	cacheTier struct {
+		name        string
+		cacher      goproxy.Cacher
+		maxFileSize int64
+		hits        atomic.Uint64
+		misses      atomic.Uint64
+		errors      atomic.Uint64
+		puts        atomic.Uint64
+		readBytes   atomic.Uint64
+		written     atomic.Uint64
+	}
+
+	// CacheEntry describes a cached file.
+	CacheEntry struct {
+		Name         string    `json:"name"`
+		Tier         string    `json:"tier,omitempty"` // tier of a TieredCache holding the file
+		Size         int64     `json:"size"`
+		ETag         string    `json:"etag,omitempty"`
+		LastModified time.Time `json:"last_modified"`
+	}
+
+	// CacheAdmin is implemented by the caches whose entries can be listed and purged.
+	CacheAdmin interface {
+		// Entries returns the entries whose name starts with prefix.
+		Entries(ctx context.Context, prefix string) ([]CacheEntry, error)
+		// Delete removes an entry, missing entries are ignored.
+		Delete(ctx context.Context, name string) error
+	}
+
+	// sizedCache is implemented by the caches that track their entries.
+	sizedCache interface {
+		stats() (entries int, size int64, evictions uint64)
+	}
+)
+
+var (
+	_ goproxy.Cacher = (*TieredCache)(nil)
+	_ CacheAdmin     = (*TieredCache)(nil)
+)
+
+// NewCache builds the cache tiers of conf.Cache.
+func NewCache(conf Config) (*TieredCache, error) {
+	tiers := conf.Cache.Tiers
+	if len(tiers) == 0 {
+		tiers = []CacheTierConfig{{Type: "memory"}}
+		if conf.S3.Enable {
+			tiers = []CacheTierConfig{{Type: "s3"}}
+		}
+	}
+
+	tc := &TieredCache{writeBacks: make(map[string][]*writeBack)}
+	for _, tier := range tiers {
+		t := &cacheTier{name: tier.Type, maxFileSize: tier.MaxFileSize}
+		var err error
+		switch tier.Type {
+		case "memory":
+			t.cacher = NewMemoryCache(tier.MaxSize)
+		case "dir":
+			t.name += ":" + tier.Dir
+			t.cacher, err = NewDirCache(tier.Dir, tier.MaxSize)
+		case "s3":
+			if tier.MaxSize != 0 {
+				return nil, errors.New("cache tier s3: max_size is not supported")
+			}
+			t.name += ":" + conf.S3.Bucket
+			t.cacher, err = NewS3Cache(conf.S3)
+		default:
+			return nil, fmt.Errorf("unknown cache tier type %q", tier.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cache tier %s: %w", t.name, err)
+		}
+		tc.tiers = append(tc.tiers, t)
+	}
+	return tc, nil
+}
+
+func (tc *TieredCache) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	for i, t := range tc.tiers {
+		spanCtx, span := startSpan(ctx, "cache.Get", attribute.String("cache.tier", t.name), attribute.String("cache.name", name))
+		content, err := t.cacher.Get(spanCtx, name)
+		span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+		endSpan(span, err)
+		if err != nil {
+			t.misses.Add(1)
+			if !errors.Is(err, fs.ErrNotExist) {
+				// a failing tier is skipped, the slower ones may still have the file
+				t.errors.Add(1)
+				slog.Warn("failed to read from cache tier", slog.String("tier", t.name), slog.String("name", name), sloghelper.Error(err))
+			}
+			continue
+		}
+		t.hits.Add(1)
+		t.readBytes.Add(uint64(contentSize(content)))
+		if i == 0 {
+			return content, nil
+		}
+		return tc.promote(ctx, name, content, tc.tiers[:i])
+	}
+	return nil, fs.ErrNotExist
+}
+
+// promote copies content into the faster tiers and returns it rewound.
+func (tc *TieredCache) promote(ctx context.Context, name string, content io.ReadCloser, tiers []*cacheTier) (io.ReadCloser, error) {
+	rs, ok := content.(io.ReadSeeker)
+	if !ok {
+		f, _, err := Save(ctx, content)
+		_ = content.Close()
+		if err != nil {
+			return nil, err
+		}
+		content, rs = f, f
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = content.Close()
+		return nil, err
+	}
+	for _, t := range tiers {
+		if err = t.put(ctx, name, rs, size); err != nil {
+			slog.Warn("failed to copy into cache tier", slog.String("tier", t.name), slog.String("name", name), sloghelper.Error(err))
+		}
+	}
+	if _, err = rs.Seek(0, io.SeekStart); err != nil {
+		_ = content.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+func (tc *TieredCache) Put(ctx context.Context, name string, content io.ReadSeeker) error {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	var tiers []*cacheTier
+	for _, t := range tc.tiers {
+		if t.maxFileSize <= 0 || size <= t.maxFileSize {
+			tiers = append(tiers, t)
+		}
+	}
+	if len(tiers) == 0 {
+		return nil
+	}
+	// registered before the first tier is written so that a concurrent Delete waits for it and cancels the rest
+	wbCtx, wb := tc.startWriteBack(ctx, name)
+	pending := false
+	defer func() {
+		if !pending {
+			tc.endWriteBack(name, wb)
+		}
+	}()
+	if err = tiers[0].put(ctx, name, content, size); err != nil {
+		return err
+	}
+	if len(tiers) == 1 {
+		return nil
+	}
+
+	// content belongs to the caller once Put returns, the write-back reads a copy
+	f, err := os.CreateTemp("", "gitlab-cache-*")
+	if err != nil {
+		return err
+	}
+	if _, err = content.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(f, content)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	pending = true
+	go func() {
+		defer tc.endWriteBack(name, wb)
+		defer os.Remove(f.Name())
+		defer f.Close()
+		for _, t := range tiers[1:] {
+			if wbCtx.Err() != nil {
+				return
+			}
+			if err := t.put(wbCtx, name, f, size); err != nil && wbCtx.Err() == nil {
+				slog.Warn("failed to write back to cache tier", slog.String("tier", t.name), slog.String("name", name), sloghelper.Error(err))
+			}
+		}
+	}()
+	return nil
+}
+
+// Close waits for the pending write-backs, including those started while waiting.
+func (tc *TieredCache) Close() error {
+	for {
+		tc.mu.Lock()
+		var pending []*writeBack
+		for _, wbs := range tc.writeBacks {
+			pending = append(pending, wbs...)
+		}
+		tc.mu.Unlock()
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, wb := range pending {
+			<-wb.done
+		}
+	}
+}
+
+// startWriteBack registers a Put of name, the returned context outlives the request and is canceled by Delete.
+func (tc *TieredCache) startWriteBack(ctx context.Context, name string) (context.Context, *writeBack) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	wb := &writeBack{cancel: cancel, done: make(chan struct{})}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.writeBacks[name] = append(tc.writeBacks[name], wb)
+	return ctx, wb
+}
+
+func (tc *TieredCache) endWriteBack(name string, wb *writeBack) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	wbs := slices.DeleteFunc(tc.writeBacks[name], func(w *writeBack) bool { return w == wb })
+	if len(wbs) == 0 {
+		delete(tc.writeBacks, name)
+	} else {
+		tc.writeBacks[name] = wbs
+	}
+	wb.cancel()
+	close(wb.done)
+}
+
+// Stats returns the counters of every tier, in order.
+func (tc *TieredCache) Stats() []CacheStats {
+	ret := make([]CacheStats, 0, len(tc.tiers))
+	for _, t := range tc.tiers {
+		s := CacheStats{Tier: t.name, Hits: t.hits.Load(), Misses: t.misses.Load(), Errors: t.errors.Load(),
+			Puts: t.puts.Load(), ReadBytes: t.readBytes.Load(), WrittenBytes: t.written.Load()}
+		if sc, ok := t.cacher.(sizedCache); ok {
+			s.Entries, s.Size, s.Evictions = sc.stats()
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// Entries lists the entries of every tier that can be listed, a file held by several tiers is listed once per tier.
+func (tc *TieredCache) Entries(ctx context.Context, prefix string) ([]CacheEntry, error) {
+	var ret []CacheEntry
+	for _, t := range tc.tiers {
+		ca, ok := t.cacher.(CacheAdmin)
+		if !ok {
+			continue
+		}
+		entries, err := ca.Entries(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("cache tier %s: %w", t.name, err)
+		}
+		for _, e := range entries {
+			e.Tier = t.name
+			ret = append(ret, e)
+		}
+	}
+	return ret, nil
+}
+
+// Delete removes name from every tier. The pending write-backs of name are canceled and waited for first so
+// that they cannot bring it back, those of other names go on.
+func (tc *TieredCache) Delete(ctx context.Context, name string) error {
+	tc.mu.Lock()
+	pending := slices.Clone(tc.writeBacks[name])
+	tc.mu.Unlock()
+	for _, wb := range pending {
+		wb.cancel()
+	}
+	for _, wb := range pending {
+		select {
+		case <-wb.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, t := range tc.tiers {
+		ca, ok := t.cacher.(CacheAdmin)
+		if !ok {
+			return fmt.Errorf("cache tier %s does not support deletion", t.name)
+		}
+		if err := ca.Delete(ctx, name); err != nil {
+			return fmt.Errorf("cache tier %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+// put writes content to the tier unless it is larger than the tier accepts.
+func (t *cacheTier) put(ctx context.Context, name string, content io.ReadSeeker, size int64) error {
+	if t.maxFileSize > 0 && size > t.maxFileSize {
+		return nil
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	ctx, span := startSpan(ctx, "cache.Put", attribute.String("cache.tier", t.name), attribute.String("cache.name", name),
+		attribute.Int64("cache.size", size))
+	err := t.cacher.Put(ctx, name, content)
+	endSpan(span, err)
+	if err != nil {
+		t.errors.Add(1)
+		return err
+	}
+	t.puts.Add(1)
+	t.written.Add(uint64(size))
+	return nil
+}
+
+// contentSize returns the size of a file returned by a tier, 0 if it is unknown.
+func contentSize(content io.ReadCloser) int64 {
+	switch c := content.(type) {
+	case *s3Cache:
+		return c.ObjectInfo.Size
+	case io.Seeker:
+		size, err := c.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0
+		}
+		if _, err = c.Seek(0, io.SeekStart); err != nil {
+			return 0
+		}
+		return size
+	}
+	return 0
+}
+
+// putVersion caches the .info, .mod and .zip files of a module version, in this order, under the names goproxy
+// looks up.
+func putVersion(ctx context.Context, cache goproxy.Cacher, path, version string, info, mod, zip io.ReadSeeker) error {
+	prefix, err := versionPrefix(path, version)
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		ext     string
+		content io.ReadSeeker
+	}{{".info", info}, {".mod", mod}, {".zip", zip}} {
+		if err = cache.Put(ctx, prefix+f.ext, f.content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionCached reports whether the zip file of a module version is cached, the last file putVersion may write.
+func versionCached(ctx context.Context, cache goproxy.Cacher, path, version string) (bool, error) {
+	prefix, err := versionPrefix(path, version)
+	if err != nil {
+		return false, err
+	}
+	name := prefix + ".zip"
+	if ca, ok := cache.(CacheAdmin); ok {
+		// listing does not copy the file between tiers
+		entries, err := ca.Entries(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range entries {
+			if e.Name == name {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	rc, err := cache.Get(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, rc.Close()
+}
+
+// versionPrefix returns the cache name of a module version without extension.
+func versionPrefix(path, version string) (string, error) {
+	escaped, err := module.EscapePath(path)
+	if err != nil {
+		return "", err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	return escaped + "/@v/" + escapedVersion, nil
+}
@@ -0,0 +1,193 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func readCache(t *testing.T, c interface {
+	Get(context.Context, string) (io.ReadCloser, error)
+}, name string) (string, error) {
+	rc, err := c.Get(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	assert.NoError(t, err, name)
+	return string(data), nil
+}
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	mc := gitlabgoproxy.NewMemoryCache(10)
+
+	assert.NoError(t, mc.Put(ctx, "a/@v/list", strings.NewReader("v1.0.0")))
+	assert.NoError(t, mc.Put(ctx, "b/@v/list", strings.NewReader("v2.0")))
+	data, err := readCache(t, mc, "a/@v/list")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v1.0.0", data)
+
+	// b is the least recently used
+	assert.NoError(t, mc.Put(ctx, "c/@v/list", strings.NewReader("v3.0")))
+	_, err = readCache(t, mc, "b/@v/list")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = readCache(t, mc, "a/@v/list")
+	assert.NoError(t, err)
+
+	// larger than the cache
+	assert.NoError(t, mc.Put(ctx, "d/@v/list", strings.NewReader("v1.0.0\nv1.1.0")))
+	_, err = readCache(t, mc, "d/@v/list")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestDirCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dc, err := gitlabgoproxy.NewDirCache(dir, 0)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"example.com/a/@v/v1.0.0.mod", "example.com/b/@v/v1.0.0.mod", "example.com/c/@v/v1.0.0.mod"} {
+		assert.NoError(t, dc.Put(ctx, name, strings.NewReader("module "+name)))
+	}
+	data, err := readCache(t, dc, "example.com/a/@v/v1.0.0.mod")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "module example.com/a/@v/v1.0.0.mod", data)
+	assert.Error(t, dc.Put(ctx, "../escape", strings.NewReader("x")))
+	_, err = readCache(t, dc, "../escape")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// reopened with a limit: the files are indexed, the oldest are evicted and leftovers of writes removed
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "example.com", ".tmp-leftover"), []byte("x"), 0o644))
+	dc, err = gitlabgoproxy.NewDirCache(dir, 70)
+	assert.NoError(t, err)
+	_, err = readCache(t, dc, "example.com/a/@v/v1.0.0.mod")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	for _, name := range []string{"example.com/b/@v/v1.0.0.mod", "example.com/c/@v/v1.0.0.mod"} {
+		_, err = readCache(t, dc, name)
+		assert.NoError(t, err, name)
+	}
+	_, err = os.Stat(filepath.Join(dir, "example.com", ".tmp-leftover"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+	disk, remote := t.TempDir(), t.TempDir()
+	tc, err := gitlabgoproxy.NewCache(gitlabgoproxy.Config{Cache: gitlabgoproxy.CacheConfig{Tiers: []gitlabgoproxy.CacheTierConfig{
+		{Type: "memory", MaxFileSize: 8},
+		{Type: "dir", Dir: disk},
+		{Type: "dir", Dir: remote},
+	}}})
+	assert.NoError(t, err)
+
+	// written back to every tier that accepts the file
+	assert.NoError(t, tc.Put(ctx, "example.com/a/@v/list", strings.NewReader("v1.0.0")))
+	assert.NoError(t, tc.Put(ctx, "example.com/a/@v/v1.0.0.zip", strings.NewReader("too large for memory")))
+	assert.NoError(t, tc.Close())
+	for _, name := range []string{"example.com/a/@v/list", "example.com/a/@v/v1.0.0.zip"} {
+		for _, dir := range []string{disk, remote} {
+			_, err = os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+			assert.NoError(t, err, name)
+		}
+	}
+
+	// read through: a hit in the last tier is copied into the tiers above it
+	rc, err := gitlabgoproxy.NewDirCache(remote, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Put(ctx, "example.com/b/@latest", strings.NewReader(`{}`)))
+	for range 2 {
+		data, err := readCache(t, tc, "example.com/b/@latest")
+		assert.NoError(t, err)
+		assert.EqualValues(t, `{}`, data)
+	}
+	data, err := readCache(t, tc, "example.com/a/@v/v1.0.0.zip")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "too large for memory", data)
+	_, err = readCache(t, tc, "example.com/c/@latest")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.EqualValues(t, []gitlabgoproxy.CacheStats{
+		{Tier: "memory", Hits: 1, Misses: 3, Puts: 2, ReadBytes: 2, WrittenBytes: 8, Entries: 2, Size: 8},
+		{Tier: "dir:" + disk, Hits: 1, Misses: 2, Puts: 3, ReadBytes: 20, WrittenBytes: 28, Entries: 3, Size: 28},
+		{Tier: "dir:" + remote, Hits: 1, Misses: 1, Puts: 2, ReadBytes: 2, WrittenBytes: 26, Entries: 3, Size: 28},
+	}, tc.Stats())
+
+	// Close may run while requests keep writing
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				assert.NoError(t, tc.Put(ctx, fmt.Sprintf("example.com/d%d/@v/v1.0.%d.info", i, j), strings.NewReader("{}")))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				assert.NoError(t, tc.Close())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, tc.Close())
+	_, err = os.Stat(filepath.Join(remote, "example.com", "d7", "@v", "v1.0.19.info"))
+	assert.NoError(t, err)
+
+	for _, conf := range []gitlabgoproxy.Config{
+		{Cache: gitlabgoproxy.CacheConfig{Tiers: []gitlabgoproxy.CacheTierConfig{{Type: "redis"}}}},
+		{Cache: gitlabgoproxy.CacheConfig{Tiers: []gitlabgoproxy.CacheTierConfig{{Type: "dir"}}}},
+		{Cache: gitlabgoproxy.CacheConfig{Tiers: []gitlabgoproxy.CacheTierConfig{{Type: "s3"}}}},
+		{Cache: gitlabgoproxy.CacheConfig{Tiers: []gitlabgoproxy.CacheTierConfig{{Type: "s3", MaxSize: 1}}}, S3: gitlabgoproxy.S3Config{Enable: true}},
+	} {
+		_, err = gitlabgoproxy.NewCache(conf)
+		assert.Error(t, err)
+	}
+	tc, err = gitlabgoproxy.NewCache(gitlabgoproxy.Config{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []gitlabgoproxy.CacheStats{{Tier: "memory"}}, tc.Stats())
+}
+
+func TestTieredCache_Delete(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	fs3 := newFakeS3(t, "modules")
+	tc, err := gitlabgoproxy.NewCache(gitlabgoproxy.Config{
+		Cache: gitlabgoproxy.CacheConfig{Tiers: []gitlabgoproxy.CacheTierConfig{{Type: "memory"}, {Type: "s3"}}},
+		S3: gitlabgoproxy.S3Config{Enable: true, Endpoint: strings.TrimPrefix(fs3.URL, "http://"), DisableTLS: true,
+			Region: "us-east-1", Bucket: "modules", AccessKeyID: "AKIDSTATIC", SecretAccessKey: "secret"},
+	})
+	assert.NoError(t, err)
+	slow, fast := "example.com/slow/@v/v1.0.0.zip", "example.com/fast/@v/list"
+	release := fs3.stall(slow)
+	defer release()
+
+	// deleting a name does not wait for the write-backs of other names
+	assert.NoError(t, tc.Put(ctx, slow, strings.NewReader("zip")))
+	assert.NoError(t, tc.Put(ctx, fast, strings.NewReader("v1.0.0")))
+	dctx, dcancel := context.WithTimeout(ctx, 2*time.Second)
+	defer dcancel()
+	assert.NoError(t, tc.Delete(dctx, fast))
+	_, err = readCache(t, tc, fast)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// the pending write-back of the deleted name is canceled and does not bring it back
+	assert.NoError(t, tc.Delete(dctx, slow))
+	release()
+	assert.NoError(t, tc.Close())
+	_, err = readCache(t, tc, slow)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Empty(t, fs3.object("modules", slow))
+}
@@ -3,7 +3,9 @@ package gitlabgoproxy
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
@@ -16,26 +18,55 @@ import (
 	"github.com/goproxy/goproxy"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 type (
 	S3Config struct {
 		AccessKeyID        string `json:"access_key_id" toml:"access_key_id" yaml:"access_key_id"`
 		SecretAccessKey    string `json:"secret_access_key" toml:"secret_access_key" yaml:"secret_access_key"`
+		SessionToken       string `json:"session_token" toml:"session_token" yaml:"session_token"`
 		Endpoint           string `json:"endpoint" toml:"endpoint" yaml:"endpoint"`
 		DisableTLS         bool   `json:"disable_tls" toml:"disable_tls" yaml:"disable_tls"`
 		InsecureSkipVerify bool   `json:"insecure_skip_verify" toml:"insecure_skip_verify" yaml:"insecure_skip_verify"`
 		Bucket             string `json:"bucket" toml:"bucket" yaml:"bucket"`
 		Enable             bool   `json:"enable" toml:"enable" yaml:"enable"`
+		// Prefix of the object keys, for buckets shared with other services
+		Prefix string `json:"prefix" toml:"prefix" yaml:"prefix"`
+		// Region of the bucket, empty means it is looked up
+		Region string `json:"region" toml:"region" yaml:"region"`
+		// BucketLookup is "path" (default), "dns" for virtual-host style, or "auto"
+		BucketLookup string `json:"bucket_lookup" toml:"bucket_lookup" yaml:"bucket_lookup"`
+		// Bootstrap is "check" to fail at startup if the bucket does not exist, or "create" to create it
+		Bootstrap string `json:"bootstrap" toml:"bootstrap" yaml:"bootstrap"`
+		// Credentials are tried in order until one yields keys: "static" (the keys above), "env" (AWS_* and
+		// MINIO_* variables), "file" (shared credentials file) and "iam" (web identity token, ECS task or EC2
+		// instance role). Empty means static if access_key_id is set, otherwise env, file and iam.
+		Credentials     []string  `json:"credentials" toml:"credentials" yaml:"credentials"`
+		CredentialsFile string    `json:"credentials_file" toml:"credentials_file" yaml:"credentials_file"` // default AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials
+		Profile         string    `json:"profile" toml:"profile" yaml:"profile"`                            // default AWS_PROFILE or "default"
+		SSE             SSEConfig `json:"sse" toml:"sse" yaml:"sse"`
+	}
+
+	// SSEConfig enables server-side encryption of the cached objects.
+	SSEConfig struct {
+		Type     string `json:"type" toml:"type" yaml:"type"`                   // "sse-s3", "sse-kms" or "sse-c", empty disables encryption
+		KMSKeyID string `json:"kms_key_id" toml:"kms_key_id" yaml:"kms_key_id"` // key of sse-kms
+		Key      string `json:"key" toml:"key" yaml:"key"`                      // base64 encoded 32 bytes key of sse-c
 	}
 
 	S3Cache struct {
 		client *minio.Client
 		bucket string
+		prefix string
+		sse    encrypt.ServerSide
 	}
 )
 
-var _ goproxy.Cacher = (*S3Cache)(nil)
+var (
+	_ goproxy.Cacher = (*S3Cache)(nil)
+	_ CacheAdmin     = (*S3Cache)(nil)
+)
 
 const partSize = uint64(100 << 20)
 
@@ -43,25 +74,131 @@ func NewS3Cache(conf S3Config) (goproxy.Cacher, error) {
 	if !conf.Enable {
 		return nil, errors.New("cacher disabled")
 	}
+	creds, err := s3Credentials(conf)
+	if err != nil {
+		return nil, err
+	}
 	opts := &minio.Options{
-		Creds:        credentials.NewStaticV4(conf.AccessKeyID, conf.SecretAccessKey, ""),
-		Secure:       !conf.DisableTLS,
-		BucketLookup: minio.BucketLookupPath,
+		Creds:  creds,
+		Secure: !conf.DisableTLS,
+		Region: conf.Region,
+	}
+	switch conf.BucketLookup {
+	case "", "path":
+		opts.BucketLookup = minio.BucketLookupPath
+	case "dns":
+		opts.BucketLookup = minio.BucketLookupDNS
+	case "auto":
+		opts.BucketLookup = minio.BucketLookupAuto
+	default:
+		return nil, fmt.Errorf("unknown s3 bucket lookup %q", conf.BucketLookup)
 	}
 	if opts.Secure && conf.InsecureSkipVerify {
 		opts.Transport = &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
 	}
+	sse, err := s3ServerSide(conf.SSE)
+	if err != nil {
+		return nil, err
+	}
 	client, err := minio.New(conf.Endpoint, opts)
 	if err != nil {
 		return nil, err
 	}
-	return &S3Cache{client: client, bucket: conf.Bucket}, nil
+
+	s3 := &S3Cache{client: client, bucket: conf.Bucket, sse: sse}
+	if prefix := strings.Trim(conf.Prefix, "/"); prefix != "" {
+		s3.prefix = prefix + "/"
+	}
+	if err = s3.bootstrap(conf.Bootstrap, conf.Region); err != nil {
+		return nil, err
+	}
+	return s3, nil
+}
+
+// s3Credentials chains the credential providers selected by conf.Credentials.
+func s3Credentials(conf S3Config) (*credentials.Credentials, error) {
+	names := conf.Credentials
+	if len(names) == 0 {
+		names = []string{"env", "file", "iam"}
+		if conf.AccessKeyID != "" {
+			names = []string{"static"}
+		}
+	}
+	providers := make([]credentials.Provider, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "static":
+			providers = append(providers, &credentials.Static{Value: credentials.Value{
+				AccessKeyID:     conf.AccessKeyID,
+				SecretAccessKey: conf.SecretAccessKey,
+				SessionToken:    conf.SessionToken,
+				SignerType:      credentials.SignatureV4,
+			}})
+		case "env":
+			providers = append(providers, &credentials.EnvAWS{}, &credentials.EnvMinio{})
+		case "file":
+			providers = append(providers, &credentials.FileAWSCredentials{Filename: conf.CredentialsFile, Profile: conf.Profile})
+		case "iam":
+			providers = append(providers, &credentials.IAM{})
+		default:
+			return nil, fmt.Errorf("unknown s3 credentials provider %q", name)
+		}
+	}
+	return credentials.NewChainCredentials(providers), nil
+}
+
+func s3ServerSide(conf SSEConfig) (encrypt.ServerSide, error) {
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case "sse-s3":
+		return encrypt.NewSSE(), nil
+	case "sse-kms":
+		if conf.KMSKeyID == "" {
+			return nil, errors.New("sse-kms needs kms_key_id")
+		}
+		return encrypt.NewSSEKMS(conf.KMSKeyID, nil)
+	case "sse-c":
+		key, err := base64.StdEncoding.DecodeString(conf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("sse-c key: %w", err)
+		}
+		return encrypt.NewSSEC(key)
+	default:
+		return nil, fmt.Errorf("unknown s3 server-side encryption %q", conf.Type)
+	}
+}
+
+// bootstrap checks or creates the bucket, as selected by mode.
+func (s3 *S3Cache) bootstrap(mode, region string) error {
+	if mode == "" {
+		return nil
+	}
+	if mode != "check" && mode != "create" {
+		return fmt.Errorf("unknown s3 bootstrap %q", mode)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ok, err := s3.client.BucketExists(ctx, s3.bucket)
+	switch {
+	case err != nil:
+		return fmt.Errorf("check bucket %s: %w", s3.bucket, err)
+	case ok:
+		return nil
+	case mode == "check":
+		return fmt.Errorf("bucket %s does not exist", s3.bucket)
+	}
+	if err = s3.client.MakeBucket(ctx, s3.bucket, minio.MakeBucketOptions{Region: region}); err != nil {
+		return fmt.Errorf("create bucket %s: %w", s3.bucket, err)
+	}
+	slog.Info("created bucket", slog.String("bucket", s3.bucket))
+	return nil
 }
 
 func (s3 *S3Cache) Get(ctx context.Context, name string) (io.ReadCloser, error) {
-	o, err := s3.client.GetObject(ctx, s3.bucket, name, minio.GetObjectOptions{})
+	o, err := s3.client.GetObject(ctx, s3.bucket, s3.prefix+name, minio.GetObjectOptions{ServerSideEncryption: s3.sse})
 	if err != nil {
 		slog.Warn("cache missed", slog.String("name", name), slog.String("error", err.Error()))
 		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
@@ -111,10 +248,11 @@ func (s3 *S3Cache) Put(ctx context.Context, name string, content io.ReadSeeker)
 		}
 	}
 
-	_, err = s3.client.PutObject(ctx, s3.bucket, name, content, size, minio.PutObjectOptions{
-		ContentType:    contentType,
-		PartSize:       partSize,
-		SendContentMd5: true,
+	_, err = s3.client.PutObject(ctx, s3.bucket, s3.prefix+name, content, size, minio.PutObjectOptions{
+		ContentType:          contentType,
+		PartSize:             partSize,
+		SendContentMd5:       true,
+		ServerSideEncryption: s3.sse,
 	})
 	if err != nil {
 		logger.Warn("failed to put object", slog.String("error", err.Error()))
@@ -123,6 +261,26 @@ func (s3 *S3Cache) Put(ctx context.Context, name string, content io.ReadSeeker)
 	return err
 }
 
+func (s3 *S3Cache) Entries(ctx context.Context, prefix string) ([]CacheEntry, error) {
+	var ret []CacheEntry
+	for o := range s3.client.ListObjects(ctx, s3.bucket, minio.ListObjectsOptions{Prefix: s3.prefix + prefix, Recursive: true}) {
+		if o.Err != nil {
+			return nil, o.Err
+		}
+		ret = append(ret, CacheEntry{
+			Name:         strings.TrimPrefix(o.Key, s3.prefix),
+			Size:         o.Size,
+			ETag:         o.ETag,
+			LastModified: o.LastModified,
+		})
+	}
+	return ret, nil
+}
+
+func (s3 *S3Cache) Delete(ctx context.Context, name string) error {
+	return s3.client.RemoveObject(ctx, s3.bucket, s3.prefix+name, minio.RemoveObjectOptions{})
+}
+
 // s3Cache is the cache returned by [s3Cacher.Get].
 type s3Cache struct {
 	*minio.Object
@@ -0,0 +1,214 @@
+package gitlabgoproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 serves the subset of the S3 API used by S3Cache, without checking signatures.
+type fakeS3 struct {
+	*httptest.Server
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	headers map[string]http.Header   // last request headers by method and path
+	stalled map[string]chan struct{} // uploads of these keys wait until the channel is closed or the client gives up
+}
+
+func newFakeS3(t *testing.T, buckets ...string) *fakeS3 {
+	fs3 := &fakeS3{buckets: make(map[string]map[string][]byte), headers: make(map[string]http.Header),
+		stalled: make(map[string]chan struct{})}
+	for _, b := range buckets {
+		fs3.buckets[b] = make(map[string][]byte)
+	}
+	fs3.Server = httptest.NewServer(http.HandlerFunc(fs3.serve))
+	t.Cleanup(fs3.Close)
+	return fs3
+}
+
+func (fs3 *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	fs3.mu.Lock()
+	stalled := fs3.stalled[key]
+	fs3.mu.Unlock()
+	if stalled != nil && r.Method == http.MethodPut {
+		// the server notices a client giving up once the body has been read
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		select {
+		case <-stalled:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	fs3.mu.Lock()
+	defer fs3.mu.Unlock()
+	fs3.headers[r.Method+" "+r.URL.Path] = r.Header.Clone()
+	objects, ok := fs3.buckets[bucket]
+
+	switch {
+	case key == "" && r.Method == http.MethodPut:
+		fs3.buckets[bucket] = make(map[string][]byte)
+		return
+	case !ok:
+		writeS3Error(w, "NoSuchBucket")
+		return
+	case key == "":
+		return
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err == nil && strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data, err = decodeAWSChunked(data)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		objects[key] = data
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+		return
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	data, ok := objects[key]
+	if !ok {
+		writeS3Error(w, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+	http.ServeContent(w, r, key, time.Date(2024, 6, 28, 9, 4, 20, 0, time.UTC), bytes.NewReader(data))
+}
+
+// request returns the headers of the last request with the method and path of name.
+func (fs3 *fakeS3) request(name string) http.Header {
+	fs3.mu.Lock()
+	defer fs3.mu.Unlock()
+	return fs3.headers[name]
+}
+
+// stall holds the uploads of key until the returned function is called.
+func (fs3 *fakeS3) stall(key string) (release func()) {
+	ch := make(chan struct{})
+	fs3.mu.Lock()
+	defer fs3.mu.Unlock()
+	fs3.stalled[key] = ch
+	return sync.OnceFunc(func() { close(ch) })
+}
+
+func (fs3 *fakeS3) object(bucket, key string) string {
+	fs3.mu.Lock()
+	defer fs3.mu.Unlock()
+	return string(fs3.buckets[bucket][key])
+}
+
+func writeS3Error(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write([]byte("<Error><Code>" + code + "</Code><Message>not found</Message></Error>"))
+}
+
+// decodeAWSChunked strips the chunk signatures of a streaming upload.
+func decodeAWSChunked(data []byte) ([]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(data))
+	var out []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil || n == 0 {
+			return out, err
+		}
+		chunk := make([]byte, n+2)
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		out = append(out, chunk[:n]...)
+	}
+}
+
+func TestS3Cache(t *testing.T) {
+	ctx := context.Background()
+	fs3 := newFakeS3(t, "shared")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	conf := gitlabgoproxy.S3Config{
+		Enable:          true,
+		Endpoint:        strings.TrimPrefix(fs3.URL, "http://"),
+		DisableTLS:      true,
+		Region:          "us-east-1",
+		Bucket:          "shared",
+		Prefix:          "/teams/goproxy/",
+		Bootstrap:       "check",
+		AccessKeyID:     "AKIDSTATIC",
+		SecretAccessKey: "secret",
+		SSE:             gitlabgoproxy.SSEConfig{Type: "sse-c", Key: key},
+	}
+	c, err := gitlabgoproxy.NewS3Cache(conf)
+	assert.NoError(t, err)
+
+	// objects are written below the prefix, encrypted with the customer key
+	assert.NoError(t, c.Put(ctx, "example.com/a/@v/list", strings.NewReader("v1.0.0\nv1.1.0")))
+	assert.EqualValues(t, "v1.0.0\nv1.1.0", fs3.object("shared", "teams/goproxy/example.com/a/@v/list"))
+	put := fs3.request("PUT /shared/teams/goproxy/example.com/a/@v/list")
+	assert.EqualValues(t, "AES256", put.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"))
+	assert.Contains(t, put.Get("Authorization"), "Credential=AKIDSTATIC/")
+	assert.EqualValues(t, "text/plain; charset=utf-8", put.Get("Content-Type"))
+
+	data, err := readCache(t, c, "example.com/a/@v/list")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v1.0.0\nv1.1.0", data)
+	get := fs3.request("GET /shared/teams/goproxy/example.com/a/@v/list")
+	assert.EqualValues(t, "AES256", get.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"))
+	_, err = readCache(t, c, "example.com/b/@v/list")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// a missing bucket fails the check and is created on demand, with credentials from the environment
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	conf = gitlabgoproxy.S3Config{Enable: true, Endpoint: conf.Endpoint, DisableTLS: true, Region: "us-east-1",
+		Bucket: "goproxy", Bootstrap: "check", Credentials: []string{"env"}, SSE: gitlabgoproxy.SSEConfig{Type: "sse-s3"}}
+	_, err = gitlabgoproxy.NewS3Cache(conf)
+	assert.ErrorContains(t, err, "does not exist")
+	conf.Bootstrap = "create"
+	c, err = gitlabgoproxy.NewS3Cache(conf)
+	assert.NoError(t, err)
+	assert.Contains(t, fs3.request("PUT /goproxy/").Get("Authorization"), "Credential=AKIDENV/")
+	assert.NoError(t, c.Put(ctx, "example.com/a/@latest", strings.NewReader(`{}`)))
+	put = fs3.request("PUT /goproxy/example.com/a/@latest")
+	assert.EqualValues(t, "AES256", put.Get("X-Amz-Server-Side-Encryption"))
+
+	for _, conf := range []gitlabgoproxy.S3Config{
+		{BucketLookup: "virtual"},
+		{Bootstrap: "always"},
+		{Credentials: []string{"vault"}},
+		{SSE: gitlabgoproxy.SSEConfig{Type: "sse-kms"}},
+		{SSE: gitlabgoproxy.SSEConfig{Type: "sse-c", Key: "c2hvcnQ="}},
+		{SSE: gitlabgoproxy.SSEConfig{Type: "aes"}},
+	} {
+		conf.Enable, conf.Endpoint, conf.DisableTLS, conf.Region, conf.Bucket = true, "127.0.0.1:1", true, "us-east-1", "b"
+		_, err = gitlabgoproxy.NewS3Cache(conf)
+		assert.Error(t, err)
+	}
+}
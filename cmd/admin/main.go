@@ -0,0 +1,114 @@
+// Command admin lists and purges the cache entries of a gitlab-goproxy server through its admin API.
+//
+//	admin [-server URL] [-token TOKEN] list|purge -module PATH [-version VERSION]
+//	admin [-server URL] [-token TOKEN] list|purge -mask MASK
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	gp "github.com/jacexh/gitlab-goproxy"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "admin:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	server := flags.String("server", envOr("GOPROXY_ADMIN_SERVER", "http://localhost:8080"), "address of the proxy")
+	token := flags.String("token", os.Getenv("GOPROXY_ADMIN_TOKEN"), "admin token")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("missing command: list or purge")
+	}
+
+	cmd := flag.NewFlagSet(flags.Arg(0), flag.ContinueOnError)
+	mod := cmd.String("module", "", "module path")
+	version := cmd.String("version", "", "module version")
+	mask := cmd.String("mask", "", "mask of the modules, as configured")
+	if err := cmd.Parse(flags.Args()[1:]); err != nil {
+		return err
+	}
+	q := url.Values{}
+	for k, v := range map[string]string{"module": *mod, "version": *version, "mask": *mask} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	method := http.MethodGet
+	switch cmd.Name() {
+	case "list":
+	case "purge":
+		method = http.MethodDelete
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Name())
+	}
+	body, err := call(method, strings.TrimSuffix(*server, "/")+gp.AdminPrefix+"cache?"+q.Encode(), *token)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if method == http.MethodDelete {
+		var ret struct{ Purged []string }
+		if err = json.NewDecoder(body).Decode(&ret); err != nil {
+			return err
+		}
+		for _, name := range ret.Purged {
+			fmt.Println("purged", name)
+		}
+		return nil
+	}
+	var entries []gp.AdminEntry
+	if err = json.NewDecoder(body).Decode(&entries); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTIER\tSIZE\tETAG\tLAST MODIFIED\tSOURCE")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", e.Name, e.Tier, e.Size, e.ETag, e.LastModified.Format(time.RFC3339), e.Source)
+	}
+	return tw.Flush()
+}
+
+func call(method, u, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
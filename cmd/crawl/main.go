@@ -0,0 +1,92 @@
+// Command crawl builds into the cache every version of the Go modules of the groups configured for the masks,
+// with the configuration of the proxy, then exits. An interrupted crawl resumes where it stopped.
+//
+//	crawl [-concurrency N] [-progress 10s]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-jimu/components/config/loader"
+	"github.com/go-jimu/components/sloghelper"
+	gp "github.com/jacexh/gitlab-goproxy"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "crawl:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	flags := flag.NewFlagSet("crawl", flag.ContinueOnError)
+	concurrency := flags.Int("concurrency", 0, "projects crawled in parallel, overrides crawl.concurrency")
+	every := flags.Duration("progress", 10*time.Second, "interval between progress reports")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+
+	_ = sloghelper.NewLog(sloghelper.Options{Output: "console"})
+	conf := new(gp.Config)
+	if err := loader.Load(conf); err != nil {
+		return fmt.Errorf("failed to load configs: %w", err)
+	}
+	if *concurrency > 0 {
+		conf.Crawl.Concurrency = *concurrency
+	}
+	flushTraces, err := gp.SetupTracing(context.Background(), conf.Tracing)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+	defer func() { _ = flushTraces(context.Background()) }()
+	cacher, err := gp.NewCache(*conf)
+	if err != nil {
+		return fmt.Errorf("failed to initialize cache: %w", err)
+	}
+	// flush the write-backs to the slower tiers before exiting
+	defer cacher.Close()
+	fetcher, err := gp.NewMixedFetcher(*conf)
+	if err != nil {
+		return fmt.Errorf("failed to initialize mixed fetcher: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	crawler := gp.NewCrawler(conf.Crawl, fetcher, cacher)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report(crawler.Progress())
+			}
+		}
+	}()
+	progress, err := crawler.Run(ctx)
+	close(done)
+	report(progress)
+	if err != nil {
+		return err
+	}
+	if progress.Failed > 0 {
+		return fmt.Errorf("%d failures, see the logs", progress.Failed)
+	}
+	return nil
+}
+
+func report(p gp.CrawlProgress) {
+	slog.Info("crawl progress", slog.Int("projects", p.Projects), slog.Int("modules", p.Modules), slog.Int("versions", p.Versions),
+		slog.Int("built", p.Built), slog.Int("skipped", p.Skipped), slog.Int("failed", p.Failed))
+}
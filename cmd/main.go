@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/go-jimu/components/config/loader"
 	"github.com/go-jimu/components/sloghelper"
@@ -28,9 +34,13 @@ func main() {
 
 	slog.Info("loaded configs", slog.Any("config", conf))
 
-	cacher, err := gp.NewS3Cache(conf.S3)
+	cacher, err := gp.NewCache(conf)
 	if err != nil {
-		slog.Warn("failed to enable cacher", slog.String("error", err.Error()))
+		slog.Error("failed to initialize cache", sloghelper.Error(err))
+		return
+	}
+	for _, s := range cacher.Stats() {
+		slog.Info("enabled cache tier", slog.String("tier", s.Tier))
 	}
 
 	fetcher, err := gp.NewMixedFetcher(conf)
@@ -39,11 +49,177 @@ func main() {
 		return
 	}
 
-	http.ListenAndServe(":8080", &goproxy.Goproxy{
+	flushTraces, err := gp.SetupTracing(context.Background(), conf.Tracing)
+	if err != nil {
+		slog.Error("failed to initialize tracing", sloghelper.Error(err))
+		return
+	}
+
+	// SIGTERM stops the background crawls, those started by the admin API too, and starts draining the server
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	crawler := gp.NewCrawler(conf.Crawl, fetcher, cacher)
+	go crawler.Start(ctx)
+	go watchConfig(ctx, gp.NewReloader(conf, fetcher))
+
+	var handler http.Handler = &gp.StaleHandler{Next: &goproxy.Goproxy{
 		// ProxiedSumDBs: []string{
 		// 	"sum.golang.org https://goproxy.cn/sumdb/sum.golang.org", // Proxy default checksum database
 		// },
 		Fetcher: fetcher,
 		Cacher:  cacher,
-	})
+	}}
+	if conf.GoGet {
+		handler = &gp.GoGetHandler{Fetcher: fetcher, Next: handler}
+	}
+	// go-get responses name the project and its default branch, they need credentials as well
+	if conf.ClientAuth.Enable {
+		handler = &gp.AuthHandler{Fetcher: fetcher, TTL: conf.ClientAuth.TTL, NegativeTTL: conf.ClientAuth.NegativeTTL, Next: handler}
+	}
+	if conf.Admin.Token != "" {
+		handler = &gp.AdminHandler{Cache: cacher, Fetcher: fetcher, Crawler: crawler, Context: ctx, Token: conf.Admin.Token, Next: handler}
+	}
+	var webhook *gp.WebhookHandler
+	if conf.Webhook.Secret != "" {
+		webhook = &gp.WebhookHandler{Cache: cacher, Fetcher: fetcher, Secret: conf.Webhook.Secret, Prebuild: conf.Webhook.Prebuild, Next: handler}
+		handler = webhook
+	}
+	handler = &gp.TracingHandler{Next: handler}
+	// the metrics are served on their own address, or on the proxy port behind a token
+	var metrics *gp.Server
+	switch {
+	case conf.Metrics.Address != "":
+		// the checks of /readyz are served on the metrics address, behind the token if there is one
+		metrics, err = gp.NewServer(gp.ServerConfig{Address: conf.Metrics.Address},
+			&gp.MetricsHandler{Fetcher: fetcher, Cache: cacher, Token: conf.Metrics.Token, Next: &gp.HealthHandler{
+				Fetcher: fetcher, Cache: cacher, Token: conf.Metrics.Token, ShowChecks: conf.Metrics.Token == "", Next: http.NotFoundHandler()}})
+		if err != nil {
+			slog.Error("failed to initialize metrics server", sloghelper.Error(err))
+			return
+		}
+	case conf.Metrics.Token != "":
+		handler = &gp.MetricsHandler{Fetcher: fetcher, Cache: cacher, Token: conf.Metrics.Token, Next: handler}
+	default:
+		slog.Info("metrics are disabled, set metrics.address or metrics.token to serve them")
+	}
+	// the public probes only answer whether the proxy is ready, the checks need the metrics token
+	handler = &gp.HealthHandler{Fetcher: fetcher, Cache: cacher, Token: conf.Metrics.Token, Next: handler}
+
+	srv, err := gp.NewServer(conf.Server, handler)
+	if err != nil {
+		slog.Error("failed to initialize server", sloghelper.Error(err))
+		return
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- srv.ListenAndServe() }()
+	if metrics != nil {
+		go func() { errc <- metrics.ListenAndServe() }()
+	}
+	select {
+	case err = <-errc:
+		slog.Error("failed to serve", sloghelper.Error(err))
+		return
+	case <-ctx.Done():
+	}
+	if metrics != nil {
+		// scrapes are short, the metrics stop before draining the proxy
+		mctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_ = metrics.Shutdown(mctx)
+		cancel()
+	}
+	shutdown(srv, fetcher, cacher, webhook, flushTraces)
+}
+
+// configPollInterval is how often the files of the config directory are checked for changes.
+const configPollInterval = 5 * time.Second
+
+// watchConfig reloads the configuration on SIGHUP and when a file of the config directory is modified, see
+// gp.Reloader for what is reloaded.
+func watchConfig(ctx context.Context, reloader *gp.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	last := configModTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("received SIGHUP, reloading configs")
+		case <-ticker.C:
+			modTime := configModTime()
+			if modTime.Equal(last) {
+				continue
+			}
+			last = modTime
+			slog.Info("config files changed, reloading configs")
+		}
+		conf, err := parseConfig()
+		if err != nil {
+			slog.Error("failed to load configs", sloghelper.Error(err))
+			continue
+		}
+		_ = reloader.Apply(conf)
+	}
+}
+
+// configModTime returns the latest modification time of the files in the config directory, GOPROXY_CONFIG_DIR
+// or ./configs. Symbolic links are followed, as those of a mounted Kubernetes ConfigMap.
+func configModTime() time.Time {
+	dir := os.Getenv("GOPROXY_CONFIG_DIR")
+	if dir == "" {
+		dir = "configs"
+	}
+	var latest time.Time
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return latest
+	}
+	for _, e := range entries {
+		if fi, err := os.Stat(filepath.Join(dir, e.Name())); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// shutdown drains the proxy within the shutdown timeout: the requests in flight, then the downloads of the
+// background jobs and the write-backs to the slower cache tiers, then the temporary files left behind and the
+// spans not exported yet.
+func shutdown(srv *gp.Server, fetcher *gp.MixedFetcher, cacher *gp.TieredCache, webhook *gp.WebhookHandler,
+	flushTraces func(context.Context) error) {
+	slog.Info("shutting down", slog.Duration("timeout", srv.ShutdownTimeout()))
+	ctx, cancel := context.WithTimeout(context.Background(), srv.ShutdownTimeout())
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("failed to wait for requests in flight", sloghelper.Error(err))
+	}
+	if webhook != nil {
+		wait(ctx, webhook.Wait)
+	}
+	if err := fetcher.Drain(ctx); err != nil {
+		slog.Error("failed to wait for downloads", sloghelper.Error(err))
+	}
+	wait(ctx, func() { _ = cacher.Close() })
+	slog.Info("removed temporary files", slog.Int("files", gp.RemoveTempFiles()))
+	if err := flushTraces(ctx); err != nil {
+		slog.Error("failed to export traces", sloghelper.Error(err))
+	}
+}
+
+// wait calls f and waits for it to return until ctx is done.
+func wait(ctx context.Context, f func()) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
 }
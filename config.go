@@ -0,0 +1,62 @@
+package gitlabgoproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+)
+
+// loggedConfig is Config without its LogValue method.
+type loggedConfig Config
+
+// LogValue logs conf with its secrets replaced by a digest, see redactSecret. Logs are read by more people than
+// the configuration: the admin token alone grants purging the cache.
+func (conf Config) LogValue() slog.Value {
+	c := loggedConfig(conf)
+	c.Masks = redactMasks(conf.Masks)
+	c.Upstream.Proxy = redactURL(conf.Upstream.Proxy)
+	c.Upstream.Proxies = make([]UpstreamProxy, len(conf.Upstream.Proxies))
+	for i, p := range conf.Upstream.Proxies {
+		p.URL = redactURL(p.URL)
+		p.Password = redactSecret(p.Password)
+		p.Token = redactSecret(p.Token)
+		c.Upstream.Proxies[i] = p
+	}
+	c.S3.AccessKeyID = redactSecret(conf.S3.AccessKeyID)
+	c.S3.SecretAccessKey = redactSecret(conf.S3.SecretAccessKey)
+	c.S3.SessionToken = redactSecret(conf.S3.SessionToken)
+	c.S3.SSE.Key = redactSecret(conf.S3.SSE.Key)
+	c.Admin.Token = redactSecret(conf.Admin.Token)
+	c.Webhook.Secret = redactSecret(conf.Webhook.Secret)
+	c.Metrics.Token = redactSecret(conf.Metrics.Token)
+	return slog.AnyValue(c)
+}
+
+// redactMasks returns a copy of masks with their access tokens redacted.
+func redactMasks(masks []GitlabFetcherConfig) []GitlabFetcherConfig {
+	redacted := make([]GitlabFetcherConfig, len(masks))
+	for i, m := range masks {
+		m.AccessToken = redactSecret(m.AccessToken)
+		redacted[i] = m
+	}
+	return redacted
+}
+
+// redactSecret replaces a non-empty secret by a short digest, which tells whether it changed but not its value.
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
+
+// redactURL hides the password of a URL, like url.URL.Redacted.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return u.Redacted()
+}
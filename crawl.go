@@ -0,0 +1,246 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jimu/components/sloghelper"
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/sync/errgroup"
+)
+
+type (
+	CrawlConfig struct {
+		// Interval between two background crawls of the groups of the masks, 0 disables them
+		Interval    time.Duration `json:"interval" yaml:"interval" toml:"interval"`
+		Concurrency int           `json:"concurrency" yaml:"concurrency" toml:"concurrency"` // projects crawled in parallel, 0 means DefaultCrawlConcurrency
+	}
+
+	// Crawler builds into a cache every version of the Go modules of the groups of the masks, see
+	// GitlabFetcherConfig.Groups, so that the first download of a version does not pay for the archive
+	// and the zip. The modules are the go.mod files of the default branch of every project, and their
+	// versions those listed by GitlabFetcher.List. Versions already cached are skipped, a crawl that
+	// has been interrupted resumes where it stopped.
+	Crawler struct {
+		fetcher  *MixedFetcher
+		cache    goproxy.Cacher
+		conf     CrawlConfig
+		running  atomic.Bool
+		mu       sync.Mutex
+		progress CrawlProgress
+	}
+
+	// CrawlProgress counts what the current or last crawl went through.
+	CrawlProgress struct {
+		Projects int       `json:"projects"`
+		Modules  int       `json:"modules"`
+		Versions int       `json:"versions"` // found, each is built, skipped or failed
+		Built    int       `json:"built"`
+		Skipped  int       `json:"skipped"` // already cached
+		Failed   int       `json:"failed"`  // groups, projects, modules or versions that could not be crawled
+		Started  time.Time `json:"started"`
+		Finished time.Time `json:"finished"` // zero while the crawl is running
+	}
+)
+
+const DefaultCrawlConcurrency = 4
+
+// ErrCrawlRunning is returned by Crawler.Run while another crawl is running.
+var ErrCrawlRunning = errors.New("a crawl is already running")
+
+func NewCrawler(conf CrawlConfig, fetcher *MixedFetcher, cache goproxy.Cacher) *Crawler {
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = DefaultCrawlConcurrency
+	}
+	return &Crawler{fetcher: fetcher, cache: cache, conf: conf}
+}
+
+// Start crawls every Interval until ctx is done, starting right away. It returns immediately if Interval is 0.
+func (c *Crawler) Start(ctx context.Context) {
+	if c.conf.Interval <= 0 {
+		return
+	}
+	for {
+		if _, err := c.Run(ctx); err != nil && !errors.Is(err, ErrCrawlRunning) && ctx.Err() == nil {
+			slog.Error("failed to crawl groups", sloghelper.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.conf.Interval):
+		}
+	}
+}
+
+// Progress returns the counters of the current or last crawl.
+func (c *Crawler) Progress() CrawlProgress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.progress
+}
+
+// Run crawls the groups of every mask once. Projects and versions that fail are logged and counted, the error
+// is only about the crawl itself, e.g. a canceled ctx.
+func (c *Crawler) Run(ctx context.Context) (CrawlProgress, error) {
+	if !c.running.CompareAndSwap(false, true) {
+		return c.Progress(), ErrCrawlRunning
+	}
+	defer c.running.Store(false)
+	c.update(func(p *CrawlProgress) { *p = CrawlProgress{Started: time.Now()} })
+	slog.Info("start to crawl groups")
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(c.conf.Concurrency)
+	for _, gf := range c.fetcher.masks() {
+		seen := make(map[string]bool)
+		for _, group := range gf.config.Groups {
+			projects, err := gf.gitlab.ListGroupProjects(gCtx, group)
+			if err != nil {
+				if gCtx.Err() != nil {
+					break
+				}
+				slog.Error("failed to list group projects", slog.String("mask", gf.config.Mask), slog.String("group", group), sloghelper.Error(err))
+				c.update(func(p *CrawlProgress) { p.Failed++ })
+				continue
+			}
+			for _, project := range projects {
+				// subgroups may be configured along with their parents
+				if seen[project] {
+					continue
+				}
+				seen[project] = true
+				c.update(func(p *CrawlProgress) { p.Projects++ })
+				g.Go(func() error {
+					c.crawlProject(gCtx, gf, project)
+					return nil
+				})
+			}
+		}
+	}
+	_ = g.Wait()
+
+	c.update(func(p *CrawlProgress) { p.Finished = time.Now() })
+	progress := c.Progress()
+	slog.Info("finished crawling groups", slog.Int("projects", progress.Projects), slog.Int("modules", progress.Modules),
+		slog.Int("built", progress.Built), slog.Int("skipped", progress.Skipped), slog.Int("failed", progress.Failed),
+		slog.Duration("elapsed", progress.Finished.Sub(progress.Started)))
+	return progress, ctx.Err()
+}
+
+// crawlProject builds the versions of the modules of a project one after the other.
+func (c *Crawler) crawlProject(ctx context.Context, gf *GitlabFetcher, project string) {
+	for _, mod := range c.modules(ctx, gf, project) {
+		versions, err := gf.List(ctx, mod)
+		if err != nil && !errors.Is(err, errNoVersions) {
+			if ctx.Err() == nil {
+				slog.Error("failed to list module versions", slog.String("path", mod), sloghelper.Error(err))
+				c.update(func(p *CrawlProgress) { p.Failed++ })
+			}
+			continue
+		}
+		c.update(func(p *CrawlProgress) { p.Modules++; p.Versions += len(versions) })
+		for _, version := range versions {
+			if ctx.Err() != nil {
+				return
+			}
+			c.build(ctx, gf, mod, version)
+		}
+	}
+}
+
+// modules returns the paths of the modules of a project that gf serves.
+func (c *Crawler) modules(ctx context.Context, gf *GitlabFetcher, project string) []string {
+	fail := func(msg string, err error) []string {
+		if ctx.Err() == nil {
+			slog.Error(msg, slog.String("project", project), sloghelper.Error(err))
+			c.update(func(p *CrawlProgress) { p.Failed++ })
+		}
+		return nil
+	}
+	branch, err := gf.gitlab.DefaultBranch(ctx, project)
+	if err != nil {
+		// empty projects have no default branch
+		slog.Debug("skip project without default branch", slog.String("project", project), sloghelper.Error(err))
+		return nil
+	}
+	files, err := gf.gitlab.FindFiles(ctx, project, branch, "go.mod")
+	if err != nil {
+		return fail("failed to find go.mod files", err)
+	}
+
+	var ret []string
+	for _, file := range files {
+		if ignoredDir(file) {
+			continue
+		}
+		data, err := gf.gitlab.GetFile(ctx, project, file, branch)
+		if err != nil {
+			return fail("failed to read go.mod file", err)
+		}
+		mod := modfile.ModulePath(data)
+		if mod == "" || c.fetcher.Route(mod) != gf {
+			slog.Debug("skip module not served by the mask", slog.String("project", project), slog.String("file", file), slog.String("path", mod))
+			continue
+		}
+		ret = append(ret, mod)
+	}
+	return ret
+}
+
+// ignoredDir reports whether the go command ignores the directory of file: vendor and testdata directories, and
+// those starting with a dot or an underscore.
+func ignoredDir(file string) bool {
+	elems := strings.Split(file, "/")
+	for _, e := range elems[:len(elems)-1] {
+		if e == "vendor" || e == "testdata" || strings.HasPrefix(e, ".") || strings.HasPrefix(e, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// build downloads and caches a module version unless it is cached.
+func (c *Crawler) build(ctx context.Context, gf *GitlabFetcher, path, version string) {
+	fail := func(msg string, err error) {
+		if ctx.Err() == nil {
+			slog.Error(msg, slog.String("path", path), slog.String("version", version), sloghelper.Error(err))
+			c.update(func(p *CrawlProgress) { p.Failed++ })
+		}
+	}
+	cached, err := versionCached(ctx, c.cache, path, version)
+	if err != nil {
+		fail("failed to look up cached module version", err)
+		return
+	}
+	if cached {
+		c.update(func(p *CrawlProgress) { p.Skipped++ })
+		return
+	}
+
+	info, mod, zip, err := gf.Download(ctx, path, version)
+	if err != nil {
+		fail("failed to build module version", err)
+		return
+	}
+	defer info.Close()
+	defer mod.Close()
+	defer zip.Close()
+	if err = putVersion(ctx, c.cache, path, version, info, mod, zip); err != nil {
+		fail("failed to cache module version", err)
+		return
+	}
+	c.update(func(p *CrawlProgress) { p.Built++ })
+	slog.Info("built module version", slog.String("path", path), slog.String("version", version))
+}
+
+func (c *Crawler) update(f func(*CrawlProgress)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.progress)
+}
@@ -0,0 +1,119 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrawler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	fg := newFixtureGitLab(t)
+	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "gitlab.com", Groups: []string{"wongidle", "group", "group/sub"}})
+	assert.NoError(t, err)
+	fetcher := &gitlabgoproxy.MixedFetcher{Masks: []*gitlabgoproxy.GitlabFetcher{f.(*gitlabgoproxy.GitlabFetcher)}}
+	cache, err := gitlabgoproxy.NewCache(gitlabgoproxy.Config{})
+	assert.NoError(t, err)
+	crawler := gitlabgoproxy.NewCrawler(gitlabgoproxy.CrawlConfig{Concurrency: 2}, fetcher, cache)
+
+	progress, err := crawler.Run(ctx)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 6, progress.Projects)
+	assert.Zero(t, progress.Failed)
+	assert.Zero(t, progress.Skipped)
+	assert.EqualValues(t, progress.Versions, progress.Built)
+	assert.False(t, progress.Finished.Before(progress.Started))
+	assert.EqualValues(t, progress, crawler.Progress())
+
+	// submodules and major versions are built under their module path
+	for _, name := range []string{
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.zip",
+		"gitlab.com/wongidle/foobar/pkg/@v/v0.2.1.zip",
+		"gitlab.com/wongidle/mutiples/v2/@v/v2.0.1.info",
+		"gitlab.com/wongidle/mutiples/pkg/str/v2/@v/v2.0.2.mod",
+		"gitlab.com/wongidle/nested/lib/@v/v1.0.0.zip",
+		"gitlab.com/wongidle/legacy/v4/@v/v4.0.0.zip",
+		"gitlab.com/group/sub/nested/@v/v1.0.0.zip",
+	} {
+		_, err = readCache(t, cache, name)
+		assert.NoError(t, err, name)
+	}
+
+	// cached versions are skipped, so that a crawl resumes
+	assert.NoError(t, cache.Delete(ctx, "gitlab.com/wongidle/foobar/@v/v0.1.1.zip"))
+	built := progress.Built
+	progress, err = crawler.Run(ctx)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, progress.Built)
+	assert.EqualValues(t, built-1, progress.Skipped)
+	_, err = readCache(t, cache, "gitlab.com/wongidle/foobar/@v/v0.1.1.zip")
+	assert.NoError(t, err)
+
+	// a missing group is counted as a failure, a canceled crawl returns early
+	f, err = gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "gitlab.com", Groups: []string{"missing"}})
+	assert.NoError(t, err)
+	fetcher.Masks[0] = f.(*gitlabgoproxy.GitlabFetcher)
+	progress, err = crawler.Run(ctx)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, progress.Failed)
+	canceled, cancelRun := context.WithCancel(ctx)
+	cancelRun()
+	_, err = crawler.Run(canceled)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the admin API reports the progress and starts crawls
+	srv := httptest.NewServer(&gitlabgoproxy.AdminHandler{Cache: cache, Fetcher: fetcher, Crawler: crawler, Token: "secret"})
+	defer srv.Close()
+	before := time.Now()
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		req, err := http.NewRequest(method, srv.URL+gitlabgoproxy.AdminPrefix+"crawl", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		if method == http.MethodGet {
+			assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&progress))
+		} else {
+			assert.EqualValues(t, http.StatusAccepted, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+	assert.Eventually(t, func() bool {
+		p := crawler.Progress()
+		return !p.Started.Before(before) && !p.Finished.IsZero()
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 1, crawler.Progress().Failed)
+
+	// crawls started by the API stop with the context of the handler, not with their request
+	f, err = gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "gitlab.com", Groups: []string{"wongidle"}})
+	assert.NoError(t, err)
+	fetcher.Masks[0] = f.(*gitlabgoproxy.GitlabFetcher)
+	stopped, stop := context.WithCancel(ctx)
+	stop()
+	srv = httptest.NewServer(&gitlabgoproxy.AdminHandler{Cache: cache, Fetcher: fetcher, Crawler: crawler, Context: stopped, Token: "secret"})
+	defer srv.Close()
+	before = time.Now()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+gitlabgoproxy.AdminPrefix+"crawl", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, http.StatusAccepted, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		p := crawler.Progress()
+		return !p.Started.Before(before) && !p.Finished.IsZero()
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Zero(t, crawler.Progress().Projects)
+}
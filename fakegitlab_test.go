@@ -0,0 +1,818 @@
+package gitlabgoproxy_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+)
+
+type (
+	// fakeGitLab is an offline stand-in for the subset of the GitLab v4 API used by GitlabHost.
+	// Projects are built from in-memory commit graphs, see newFixtureGitLab.
+	fakeGitLab struct {
+		*httptest.Server
+
+		mu       sync.Mutex
+		token    string
+		tokens   map[string][]string // scopes of the tokens known to /personal_access_tokens/self
+		projects map[string]*fakeProject
+		faults   []*fault
+		calls    []string
+		sent     int // body bytes written by throttled responses
+	}
+
+	fakeProject struct {
+		ID            int
+		Path          string
+		DefaultBranch string
+
+		gl       *fakeGitLab
+		commits  map[string]*fakeCommit
+		branches map[string]string
+		tags     map[string]string
+		archives map[string][]byte
+		readers  []string // credentials allowed to clone, nil means every known token
+	}
+
+	fakeCommit struct {
+		ID      string
+		Parents []string
+		Time    time.Time
+		Files   map[string]string
+	}
+
+	// fault makes the fake server misbehave for matching requests.
+	fault struct {
+		Path     string        // substring of the escaped request path, empty matches every request
+		Status   int           // respond with this status instead of serving the request
+		Truncate bool          // announce the full Content-Length but send only half of the body
+		Delay    time.Duration // wait before responding
+		Throttle time.Duration // pause between the 32 KiB chunks of the body
+		Times    int           // number of requests affected, 0 means unlimited
+	}
+)
+
+func newFakeGitLab(t testing.TB) *fakeGitLab {
+	fg := &fakeGitLab{projects: make(map[string]*fakeProject), tokens: make(map[string][]string)}
+	fg.Server = httptest.NewServer(http.HandlerFunc(fg.serveHTTP))
+	t.Cleanup(fg.Close)
+	return fg
+}
+
+// Endpoint returns the API base URL to put into GitlabFetcherConfig.
+func (fg *fakeGitLab) Endpoint() string {
+	return fg.URL + "/api/v4"
+}
+
+func (fg *fakeGitLab) AddProject(name string) *fakeProject {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	p := &fakeProject{
+		ID:            len(fg.projects) + 1,
+		Path:          name,
+		DefaultBranch: "main",
+		gl:            fg,
+		commits:       make(map[string]*fakeCommit),
+		branches:      make(map[string]string),
+		tags:          make(map[string]string),
+		archives:      make(map[string][]byte),
+	}
+	fg.projects[name] = p
+	return p
+}
+
+// RequireToken makes every request without the token in PRIVATE-TOKEN or Authorization: Bearer fail with 401.
+func (fg *fakeGitLab) RequireToken(token string) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.token = token
+}
+
+// AddToken makes /personal_access_tokens/self accept token with scopes. The token of RequireToken has the
+// api scope unless it is added.
+func (fg *fakeGitLab) AddToken(token string, scopes ...string) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.tokens[token] = scopes
+}
+
+// Restrict limits the credentials that can clone the project over HTTP, each either a token or
+// "username:token" for a deploy token.
+func (p *fakeProject) Restrict(credentials ...string) {
+	p.gl.mu.Lock()
+	defer p.gl.mu.Unlock()
+	p.readers = credentials
+}
+
+func (fg *fakeGitLab) Inject(f fault) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.faults = append(fg.faults, &f)
+}
+
+// Unavailable makes the next request fail with a 503 and returns a context that expires during the first retry
+// backoff of go-gitlab, at least 700ms: the call made with it fails once without waiting for the retries.
+func (fg *fakeGitLab) Unavailable(t testing.TB) context.Context {
+	fg.Inject(fault{Status: http.StatusServiceUnavailable, Times: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// Calls returns how many requests have been received whose escaped path contains substr.
+func (fg *fakeGitLab) Calls(substr string) int {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	n := 0
+	for _, c := range fg.calls {
+		if strings.Contains(c, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// Resolve returns the commit a ref of project points to.
+func (fg *fakeGitLab) Resolve(project, ref string) string {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	if c := fg.projects[project].resolve(ref); c != nil {
+		return c.ID
+	}
+	return ""
+}
+
+// Files returns the tree of project at ref.
+func (fg *fakeGitLab) Files(project, ref string) map[string]string {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	if c := fg.projects[project].resolve(ref); c != nil {
+		return c.Files
+	}
+	return nil
+}
+
+// Commit adds a commit on top of branch, creating the branch if needed. Files with empty content are deleted.
+func (p *fakeProject) Commit(branch string, t time.Time, files map[string]string) string {
+	p.gl.mu.Lock()
+	defer p.gl.mu.Unlock()
+	c := &fakeCommit{Time: t, Files: make(map[string]string)}
+	if head, ok := p.branches[branch]; ok {
+		c.Parents = []string{head}
+		for name, content := range p.commits[head].Files {
+			c.Files[name] = content
+		}
+	}
+	for name, content := range files {
+		if content == "" {
+			delete(c.Files, name)
+			continue
+		}
+		c.Files[name] = content
+	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s %s %d %v", p.Path, branch, len(p.commits), c.Parents)))
+	c.ID = hex.EncodeToString(sum[:])
+	p.commits[c.ID] = c
+	p.branches[branch] = c.ID
+	return c.ID
+}
+
+// Tag points tag at commit, moving it if it already exists.
+func (p *fakeProject) Tag(tag, commit string) {
+	p.gl.mu.Lock()
+	defer p.gl.mu.Unlock()
+	p.tags[tag] = commit
+}
+
+func (p *fakeProject) DeleteTag(tag string) {
+	p.gl.mu.Lock()
+	defer p.gl.mu.Unlock()
+	delete(p.tags, tag)
+}
+
+// resolve maps a branch, tag, full or abbreviated commit hash to a commit.
+func (p *fakeProject) resolve(ref string) *fakeCommit {
+	if id, ok := p.branches[ref]; ok {
+		return p.commits[id]
+	}
+	if id, ok := p.tags[ref]; ok {
+		return p.commits[id]
+	}
+	if ref == "HEAD" {
+		return p.commits[p.branches[p.DefaultBranch]]
+	}
+	if len(ref) < 7 {
+		return nil
+	}
+	var found *fakeCommit
+	for id, c := range p.commits {
+		if strings.HasPrefix(id, ref) {
+			if found != nil {
+				return nil
+			}
+			found = c
+		}
+	}
+	return found
+}
+
+// ancestors returns the commits reachable from id, including itself, in breadth-first order.
+func (p *fakeProject) ancestors(id string) []string {
+	seen := map[string]bool{id: true}
+	queue := []string{id}
+	for i := 0; i < len(queue); i++ {
+		for _, parent := range p.commits[queue[i]].Parents {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return queue
+}
+
+func (fg *fakeGitLab) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	raw := r.URL.EscapedPath()
+	fg.mu.Lock()
+	fg.calls = append(fg.calls, raw)
+	f := fg.matchFault(raw)
+	required := fg.token
+	fg.mu.Unlock()
+
+	if f != nil && f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if f != nil && f.Status != 0 {
+		writeMessage(w, f.Status, http.StatusText(f.Status))
+		return
+	}
+	token := r.Header.Get("PRIVATE-TOKEN")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if raw == "/api/v4/personal_access_tokens/self" {
+		fg.tokenSelf(w, token, required)
+		return
+	}
+	if strings.HasSuffix(raw, ".git/info/refs") {
+		fg.infoRefs(w, r, raw, required)
+		return
+	}
+	if required != "" && token != required {
+		writeMessage(w, http.StatusUnauthorized, "401 Unauthorized")
+		return
+	}
+
+	fg.mu.Lock()
+	if f == nil || (!f.Truncate && f.Throttle <= 0) {
+		defer fg.mu.Unlock()
+		fg.route(w, r, raw)
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	fg.route(rec, r, raw)
+	fg.mu.Unlock()
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	body := rec.Body.Bytes()
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(rec.Code)
+	if f.Truncate {
+		body = body[:len(body)/2]
+	}
+	if f.Throttle <= 0 {
+		_, _ = w.Write(body)
+		return
+	}
+	for len(body) > 0 {
+		n, err := w.Write(body[:min(len(body), 32<<10)])
+		fg.mu.Lock()
+		fg.sent += n
+		fg.mu.Unlock()
+		if err != nil {
+			return
+		}
+		body = body[n:]
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(f.Throttle):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Sent returns how many body bytes the responses slowed down by a Throttle fault have written.
+func (fg *fakeGitLab) Sent() int {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	return fg.sent
+}
+
+func (fg *fakeGitLab) tokenSelf(w http.ResponseWriter, token, required string) {
+	fg.mu.Lock()
+	scopes, ok := fg.tokens[token]
+	fg.mu.Unlock()
+	if !ok && (token == "" || token != required) {
+		writeMessage(w, http.StatusUnauthorized, "401 Unauthorized")
+		return
+	}
+	if !ok {
+		scopes = []string{"api"}
+	}
+	writeJSON(w, map[string]any{"id": 1, "name": "fake", "active": true, "revoked": false, "scopes": scopes})
+}
+
+// infoRefs answers the smart HTTP discovery of git clone, authenticated with Basic credentials.
+func (fg *fakeGitLab) infoRefs(w http.ResponseWriter, r *http.Request, raw, required string) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="GitLab"`)
+		writeMessage(w, http.StatusUnauthorized, "HTTP Basic: Access denied")
+		return
+	}
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	name, _ := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(raw, "/"), ".git/info/refs"))
+	_, known := fg.tokens[password]
+	known = known || password == required
+	p, exists := fg.projects[name]
+	switch {
+	case exists && p.readers == nil && known,
+		exists && (slices.Contains(p.readers, password) || slices.Contains(p.readers, username+":"+password)):
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte("001e# service=git-upload-pack\n0000"))
+	case known:
+		// GitLab does not tell apart missing projects and projects the user cannot see
+		writeMessage(w, http.StatusNotFound, "404 Not Found")
+	default:
+		writeMessage(w, http.StatusUnauthorized, "HTTP Basic: Access denied")
+	}
+}
+
+func (fg *fakeGitLab) matchFault(raw string) *fault {
+	for i, f := range fg.faults {
+		if !strings.Contains(raw, f.Path) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				fg.faults = append(fg.faults[:i:i], fg.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (fg *fakeGitLab) route(w http.ResponseWriter, r *http.Request, raw string) {
+	if rest, ok := strings.CutPrefix(raw, "/api/v4/groups/"); ok {
+		fg.listGroupProjects(w, r, rest)
+		return
+	}
+	rest, ok := strings.CutPrefix(raw, "/api/v4/projects/")
+	if !ok {
+		writeMessage(w, http.StatusNotFound, "404 Not Found")
+		return
+	}
+	id, rest, _ := strings.Cut(rest, "/")
+	name, _ := url.PathUnescape(id)
+	p, ok := fg.projects[name]
+	if !ok {
+		writeMessage(w, http.StatusNotFound, "404 Project Not Found")
+		return
+	}
+
+	switch {
+	case rest == "":
+		writeJSON(w, map[string]any{
+			"id":                  p.ID,
+			"path":                path.Base(p.Path),
+			"path_with_namespace": p.Path,
+			"default_branch":      p.DefaultBranch,
+		})
+
+	case rest == "repository/tags":
+		p.listTags(w, r)
+
+	case strings.HasPrefix(rest, "repository/tags/"):
+		tag, _ := url.PathUnescape(strings.TrimPrefix(rest, "repository/tags/"))
+		id, ok := p.tags[tag]
+		if !ok {
+			writeMessage(w, http.StatusNotFound, "404 Tag Not Found")
+			return
+		}
+		writeJSON(w, p.tagJSON(tag, id))
+
+	case strings.HasPrefix(rest, "repository/commits/"):
+		ref, _ := url.PathUnescape(strings.TrimPrefix(rest, "repository/commits/"))
+		c := p.resolve(ref)
+		if c == nil {
+			writeMessage(w, http.StatusNotFound, "404 Commit Not Found")
+			return
+		}
+		writeJSON(w, commitJSON(c))
+
+	case rest == "repository/merge_base":
+		refs := r.URL.Query()["refs[]"]
+		if len(refs) != 2 {
+			writeMessage(w, http.StatusBadRequest, "Provide exactly two refs")
+			return
+		}
+		a, b := p.resolve(refs[0]), p.resolve(refs[1])
+		if a == nil || b == nil {
+			writeMessage(w, http.StatusNotFound, "404 Commit Not Found")
+			return
+		}
+		reachable := make(map[string]bool)
+		for _, id := range p.ancestors(a.ID) {
+			reachable[id] = true
+		}
+		for _, id := range p.ancestors(b.ID) {
+			if reachable[id] {
+				writeJSON(w, commitJSON(p.commits[id]))
+				return
+			}
+		}
+		writeMessage(w, http.StatusNotFound, "404 Merge Base Not Found")
+
+	case strings.HasPrefix(rest, "repository/files/") && strings.HasSuffix(rest, "/raw"):
+		file, _ := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(rest, "repository/files/"), "/raw"))
+		ref := r.URL.Query().Get("ref")
+		if ref == "" {
+			ref = p.DefaultBranch
+		}
+		c := p.resolve(ref)
+		if c == nil {
+			writeMessage(w, http.StatusNotFound, "404 Commit Not Found")
+			return
+		}
+		content, ok := c.Files[file]
+		if !ok {
+			writeMessage(w, http.StatusNotFound, "404 File Not Found")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(content))
+
+	case rest == "repository/tree":
+		ref := r.URL.Query().Get("ref")
+		if ref == "" {
+			ref = p.DefaultBranch
+		}
+		c := p.resolve(ref)
+		if c == nil {
+			writeMessage(w, http.StatusNotFound, "404 Tree Not Found")
+			return
+		}
+		// files only, GitLab lists the directories too
+		names := make([]string, 0, len(c.Files))
+		for name := range c.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		ret := make([]any, 0)
+		for _, name := range paginate(w, r, names) {
+			ret = append(ret, map[string]any{"id": name, "name": path.Base(name), "type": "blob", "path": name, "mode": "100644"})
+		}
+		writeJSON(w, ret)
+
+	case rest == "repository/archive.zip":
+		ref := r.URL.Query().Get("sha")
+		if ref == "" {
+			ref = p.DefaultBranch
+		}
+		c := p.resolve(ref)
+		if c == nil {
+			writeMessage(w, http.StatusNotFound, "404 Commit Not Found")
+			return
+		}
+		data, err := p.archive(c, r.URL.Query().Get("path"))
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		_, _ = w.Write(data)
+
+	default:
+		writeMessage(w, http.StatusNotFound, "404 Not Found")
+	}
+}
+
+func (p *fakeProject) listTags(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	search := q.Get("search")
+	names := make([]string, 0, len(p.tags))
+	for name := range p.tags {
+		switch {
+		case strings.HasPrefix(search, "^") && !strings.HasPrefix(name, search[1:]):
+			continue
+		case !strings.HasPrefix(search, "^") && !strings.Contains(name, search):
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if q.Get("sort") == "desc" {
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	}
+
+	ret := make([]any, 0)
+	for _, name := range paginate(w, r, names) {
+		ret = append(ret, p.tagJSON(name, p.tags[name]))
+	}
+	writeJSON(w, ret)
+}
+
+// listGroupProjects serves the projects of a group and, with include_subgroups, of its subgroups.
+func (fg *fakeGitLab) listGroupProjects(w http.ResponseWriter, r *http.Request, rest string) {
+	id, rest, _ := strings.Cut(rest, "/")
+	group, _ := url.PathUnescape(id)
+	if rest != "projects" {
+		writeMessage(w, http.StatusNotFound, "404 Not Found")
+		return
+	}
+	subgroups := r.URL.Query().Get("include_subgroups") == "true"
+	names := make([]string, 0)
+	for name := range fg.projects {
+		if ns, ok := strings.CutPrefix(path.Dir(name), group); ok && (ns == "" || (subgroups && ns[0] == '/')) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		writeMessage(w, http.StatusNotFound, "404 Group Not Found")
+		return
+	}
+	sort.Strings(names)
+	ret := make([]any, 0)
+	for _, name := range paginate(w, r, names) {
+		p := fg.projects[name]
+		ret = append(ret, map[string]any{"id": p.ID, "path": path.Base(name), "path_with_namespace": name})
+	}
+	writeJSON(w, ret)
+}
+
+// paginate returns the page of names selected by the page and per_page parameters.
+func paginate(w http.ResponseWriter, r *http.Request, names []string) []string {
+	q := r.URL.Query()
+	page, _ := strconv.Atoi(q.Get("page"))
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 20
+	}
+	start := min((page-1)*perPage, len(names))
+	end := min(start+perPage, len(names))
+	w.Header().Set("X-Total", strconv.Itoa(len(names)))
+	return names[start:end]
+}
+
+func (p *fakeProject) tagJSON(name, id string) map[string]any {
+	return map[string]any{
+		"name":   name,
+		"target": id,
+		"commit": commitJSON(p.commits[id]),
+	}
+}
+
+// archive builds a zip laid out like GitLab's: a single top-level directory holding the
+// repository tree, restricted to dir when it is not empty.
+func (p *fakeProject) archive(c *fakeCommit, dir string) ([]byte, error) {
+	key := c.ID + ":" + dir
+	if data, ok := p.archives[key]; ok {
+		return data, nil
+	}
+	top := fmt.Sprintf("%s-%s-%s/", path.Base(p.Path), c.ID, c.ID)
+	if dir != "" {
+		top = strings.TrimSuffix(top, "/") + "-" + strings.ReplaceAll(dir, "/", "-") + "/"
+	}
+	names := make([]string, 0, len(c.Files))
+	for name := range c.Files {
+		if dir == "" || strings.HasPrefix(name, dir+"/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	if _, err := zw.Create(top); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		fw, err := zw.Create(top + name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = fw.Write([]byte(c.Files[name])); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	p.archives[key] = buf.Bytes()
+	return buf.Bytes(), nil
+}
+
+func commitJSON(c *fakeCommit) map[string]any {
+	parents := c.Parents
+	if parents == nil {
+		parents = []string{}
+	}
+	return map[string]any{
+		"id":             c.ID,
+		"short_id":       c.ID[:8],
+		"title":          "commit " + c.ID[:8],
+		"parent_ids":     parents,
+		"authored_date":  c.Time,
+		"committed_date": c.Time,
+		"created_at":     c.Time,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeMessage(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+var (
+	foobarTime   = time.Date(2024, 6, 28, 17, 4, 20, 0, time.FixedZone("", 8*3600))
+	mutiplesTime = time.Date(2024, 6, 27, 6, 22, 26, 0, time.UTC)
+	untaggedTime = time.Date(2024, 7, 2, 8, 30, 0, 0, time.UTC)
+	mainTime     = time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)
+)
+
+// newFixtureGitLab serves the projects the test suite was originally written against on gitlab.com:
+//
+//	wongidle/foobar    v0.1.0 v0.1.1 v0.2.0 pkg/v0.2.0 pkg/v0.2.1, main one commit ahead of the tags
+//	wongidle/mutiples  v2.0.1 v2.0.2 pkg/str/v2.0.2 (module paths with /v2)
+//	wongidle/untagged  no tags at all
+//	WhyNotHugo/darkman v1.5.3 v1.5.4 v2.0.0
+//	group/sub/nested   v1.0.0, lives in a subgroup
+//	wongidle/nested    v1.0.0 lib/v1.0.0, with modules nested in the root module and in lib
+//	wongidle/legacy    v1.0.0 v2.0.0 v3.1.0 without /vN suffix, v4.0.0 declaring /v4
+//	backend/payments/ledger v1.0.0 api/v1.0.0, module path go.corp.example/payments/ledger
+func newFixtureGitLab(t testing.TB) *fakeGitLab {
+	fg := newFakeGitLab(t)
+
+	foobar := fg.AddProject("wongidle/foobar")
+	c := foobar.Commit("main", foobarTime.Add(-2*time.Hour), map[string]string{
+		"go.mod":    "module gitlab.com/wongidle/foobar\n\ngo 1.22.0\n",
+		"foobar.go": "package foobar\n",
+	})
+	foobar.Tag("v0.1.0", c)
+	c = foobar.Commit("main", foobarTime.Add(-time.Hour), map[string]string{
+		"foobar.go": "package foobar\n\nfunc Hello() string { return \"hello\" }\n",
+	})
+	foobar.Tag("v0.1.1", c)
+	c = foobar.Commit("main", foobarTime, map[string]string{
+		"pkg/go.mod":          "module gitlab.com/wongidle/foobar/pkg\n\ngo 1.22.0\n",
+		"pkg/pkg.go":          "package pkg\n",
+		"internal/pkg/pkg.go": "package pkg\n",
+	})
+	foobar.Tag("v0.2.0", c)
+	foobar.Tag("pkg/v0.2.0", c)
+	c = foobar.Commit("main", foobarTime.Add(time.Hour), map[string]string{
+		"pkg/pkg.go": "package pkg\n\nconst Version = \"v0.2.1\"\n",
+	})
+	foobar.Tag("pkg/v0.2.1", c)
+	foobar.Commit("main", mainTime, map[string]string{
+		"foobar.go": "package foobar\n\nfunc Hello() string { return \"hello, world\" }\n",
+	})
+
+	mutiples := fg.AddProject("wongidle/mutiples")
+	c = mutiples.Commit("main", mutiplesTime.Add(-time.Hour), map[string]string{
+		"go.mod":                              "module gitlab.com/wongidle/mutiples/v2\n\ngo 1.22.0\n",
+		"mutiples.go":                         "package mutiples\n",
+		"internal/pkg/bytesconv/bytesconv.go": "package bytesconv\n",
+	})
+	mutiples.Tag("v2.0.1", c)
+	c = mutiples.Commit("main", mutiplesTime, map[string]string{
+		"pkg/str/go.mod": "module gitlab.com/wongidle/mutiples/pkg/str/v2\n\ngo 1.22.0\n",
+		"pkg/str/str.go": "package str\n",
+	})
+	mutiples.Tag("v2.0.2", c)
+	mutiples.Tag("pkg/str/v2.0.2", c)
+
+	untagged := fg.AddProject("wongidle/untagged")
+	untagged.Commit("main", untaggedTime, map[string]string{
+		"go.mod":      "module gitlab.com/wongidle/untagged\n\ngo 1.22.0\n",
+		"untagged.go": "package untagged\n",
+	})
+
+	darkman := fg.AddProject("WhyNotHugo/darkman")
+	for i, tag := range []string{"v1.5.3", "v1.5.4", "v2.0.0"} {
+		c = darkman.Commit("main", foobarTime.Add(time.Duration(i)*time.Hour), map[string]string{
+			"go.mod":     "module gitlab.com/WhyNotHugo/darkman\n\ngo 1.22.0\n",
+			"darkman.go": "package main\n\n// " + tag + "\n",
+		})
+		darkman.Tag(tag, c)
+	}
+
+	nested := fg.AddProject("group/sub/nested")
+	c = nested.Commit("main", foobarTime, map[string]string{
+		"go.mod":    "module gitlab.com/group/sub/nested\n\ngo 1.22.0\n",
+		"nested.go": "package nested\n",
+	})
+	nested.Tag("v1.0.0", c)
+
+	modules := fg.AddProject("wongidle/nested")
+	c = modules.Commit("main", foobarTime, map[string]string{
+		"go.mod":            "module gitlab.com/wongidle/nested\n\ngo 1.22.0\n",
+		"nested.go":         "package nested\n",
+		"docs/README.md":    "# nested\n",
+		"tools/go.mod":      "module gitlab.com/wongidle/nested/tools\n\ngo 1.22.0\n",
+		"tools/tools.go":    "package tools\n",
+		"tools/gen/gen.go":  "package gen\n",
+		"lib/go.mod":        "module gitlab.com/wongidle/nested/lib\n\ngo 1.22.0\n",
+		"lib/lib.go":        "package lib\n",
+		"lib/sub/go.mod":    "module gitlab.com/wongidle/nested/lib/sub\n\ngo 1.22.0\n",
+		"lib/sub/sub.go":    "package sub\n",
+		"lib/sub/x/go.mod":  "module gitlab.com/wongidle/nested/lib/sub/x\n\ngo 1.22.0\n",
+		"lib/internal/i.go": "package internal\n",
+	})
+	modules.Tag("v1.0.0", c)
+	modules.Tag("lib/v1.0.0", c)
+
+	// v2+ tags without a major version suffix, served as +incompatible
+	legacy := fg.AddProject("wongidle/legacy")
+	c = legacy.Commit("main", foobarTime, map[string]string{
+		"legacy.go": "package legacy\n",
+	})
+	legacy.Tag("v1.0.0", c)
+	c = legacy.Commit("main", foobarTime.Add(time.Hour), map[string]string{
+		"legacy.go": "package legacy\n\nconst Version = 2\n",
+	})
+	legacy.Tag("v2.0.0", c)
+	c = legacy.Commit("main", foobarTime.Add(2*time.Hour), map[string]string{
+		"go.mod": "module gitlab.com/wongidle/legacy\n\ngo 1.22.0\n",
+	})
+	legacy.Tag("v3.1.0", c)
+	c = legacy.Commit("main", foobarTime.Add(3*time.Hour), map[string]string{
+		"go.mod": "module gitlab.com/wongidle/legacy/v4\n\ngo 1.22.0\n",
+	})
+	legacy.Tag("v4.0.0", c)
+	// a submodule cannot be +incompatible, lib/v2.0.0 is not a version of gitlab.com/wongidle/legacy/lib
+	c = legacy.Commit("main", foobarTime.Add(4*time.Hour), map[string]string{
+		"lib/go.mod": "module gitlab.com/wongidle/legacy/lib\n\ngo 1.22.0\n",
+		"lib/lib.go": "package lib\n",
+	})
+	legacy.Tag("lib/v1.0.0", c)
+	legacy.Tag("lib/v2.0.0", c)
+
+	// imported through the vanity path go.corp.example/payments/ledger
+	ledger := fg.AddProject("backend/payments/ledger")
+	c = ledger.Commit("main", foobarTime, map[string]string{
+		"go.mod":        "module go.corp.example/payments/ledger\n\ngo 1.22.0\n",
+		"ledger.go":     "package ledger\n",
+		"api/go.mod":    "module go.corp.example/payments/ledger/api\n\ngo 1.22.0\n",
+		"api/api.go":    "package api\n",
+		"internal/i.go": "package internal\n",
+	})
+	ledger.Tag("v1.0.0", c)
+	ledger.Tag("api/v1.0.0", c)
+	return fg
+}
+
+func newFixtureFetcher(t testing.TB) (*gitlabgoproxy.GitlabFetcher, *fakeGitLab) {
+	fg := newFixtureGitLab(t)
+	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint(), Mask: "gitlab.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.(*gitlabgoproxy.GitlabFetcher), fg
+}
@@ -12,73 +12,126 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-jimu/components/sloghelper"
 	"github.com/goproxy/goproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 	"golang.org/x/mod/zip"
 	"golang.org/x/sync/errgroup"
 )
 
 type (
 	GitlabFetcher struct {
-		gitlab GitLab
-		config GitlabFetcherConfig
+		gitlab    GitLab
+		config    GitlabFetcherConfig
+		lookups   *lookupCache
+		rewriters []*rewriter
 	}
 
 	Info struct {
 		Version string
 		Time    time.Time // commit time
+		Commit  string    `json:"-"` // full commit hash, not part of the .info response
 	}
 
 	Locator struct {
 		Repository string
 		SubPath    string
 		Ref        string
+		Version    string // module version being served, empty means derive it from Ref
 	}
 
 	GitLab interface {
 		ListTags(ctx context.Context, repository string, prefix string) ([]*Info, error)
 		GetTag(ctx context.Context, repository, tag string) (*Info, error)
 		GetFile(ctx context.Context, repository, path, ref string) ([]byte, error)
-		Download(ctx context.Context, repository, dir, ref string) (io.Reader, error) // https://go.dev/ref/mod#zip-files, TODO: The zip file of the main module does not contain any submodules, and the zip file of the submodule only contains its own files
+		Download(ctx context.Context, repository, dir, ref string, w io.Writer) error // https://go.dev/ref/mod#zip-files
 		IsProject(context.Context, string) (bool, error)
+		GetCommit(ctx context.Context, repository, ref string) (*Info, error)
+		IsAncestor(ctx context.Context, repository, ancestor, descendant string) (bool, error)
+		DefaultBranch(ctx context.Context, repository string) (string, error)
+		ListGroupProjects(ctx context.Context, group string) ([]string, error)
+		FindFiles(ctx context.Context, repository, ref, name string) ([]string, error)
+		TokenScopes(ctx context.Context) ([]string, error)
+		CanRead(ctx context.Context, repository, username, password string) (bool, error)
 	}
 
 	GitlabFetcherConfig struct {
 		Endpoint    string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
 		AccessToken string `json:"access_token" yaml:"access_token" toml:"access_token"`
-		Mask        string `json:"mask" yaml:"mask" toml:"mask"`
-	}
-
-	UpstreamConfig struct {
-		Proxy string `json:"proxy" yaml:"proxy" toml:"proxy"`
+		Mask        string `json:"mask" yaml:"mask" toml:"mask"` // comma-separated glob patterns of module path prefixes, as in GOPRIVATE
+		// Size limits in bytes, 0 means DefaultMaxArchiveSize / DefaultMaxExtractedSize
+		MaxArchiveSize   int64             `json:"max_archive_size" yaml:"max_archive_size" toml:"max_archive_size"`
+		MaxExtractedSize int64             `json:"max_extracted_size" yaml:"max_extracted_size" toml:"max_extracted_size"`
+		LookupCache      LookupCacheConfig `json:"lookup_cache" yaml:"lookup_cache" toml:"lookup_cache"`
+		// Rewrites map module paths below Mask to GitLab project paths, the first matching rule wins.
+		// Without a matching rule the module path without its host is the GitLab path.
+		Rewrites []RewriteRule `json:"rewrites" yaml:"rewrites" toml:"rewrites"`
+		// WebURL of the GitLab instance used in go-get responses, defaults to Endpoint without /api/v4
+		WebURL string `json:"web_url" yaml:"web_url" toml:"web_url"`
+		// CircuitBreaker of the GitLab host, shared by the masks of a MixedFetcher and configured by the first of them
+		CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker" yaml:"circuit_breaker" toml:"circuit_breaker"`
+		// Groups of GitLab, with their subgroups, whose modules are built ahead of time by the Crawler
+		Groups []string `json:"groups" yaml:"groups" toml:"groups"`
 	}
 
 	Config struct {
-		Masks    []GitlabFetcherConfig `json:"masks" yaml:"masks" toml:"masks"`
-		Upstream UpstreamConfig        `json:"upstream" yaml:"upstream" toml:"upstream"`
-		S3       S3Config              `json:"s3" yaml:"s3" toml:"s3"`
+		Server     ServerConfig          `json:"server" yaml:"server" toml:"server"`
+		Masks      []GitlabFetcherConfig `json:"masks" yaml:"masks" toml:"masks"`
+		Upstream   UpstreamConfig        `json:"upstream" yaml:"upstream" toml:"upstream"`
+		S3         S3Config              `json:"s3" yaml:"s3" toml:"s3"`
+		Cache      CacheConfig           `json:"cache" yaml:"cache" toml:"cache"`
+		Admin      AdminConfig           `json:"admin" yaml:"admin" toml:"admin"`
+		Webhook    WebhookConfig         `json:"webhook" yaml:"webhook" toml:"webhook"`
+		Crawl      CrawlConfig           `json:"crawl" yaml:"crawl" toml:"crawl"`
+		Metrics    MetricsConfig         `json:"metrics" yaml:"metrics" toml:"metrics"`
+		Tracing    TracingConfig         `json:"tracing" yaml:"tracing" toml:"tracing"`
+		ClientAuth ClientAuthConfig      `json:"client_auth" yaml:"client_auth" toml:"client_auth"`
+		GoGet      bool                  `json:"go_get" yaml:"go_get" toml:"go_get"` // answer ?go-get=1 requests for masked paths
 	}
 
 	MixedFetcher struct {
-		Masks    []*GitlabFetcher
+		Masks    []*GitlabFetcher // initial masks, replaced by Reload
 		Upstream goproxy.Fetcher
+		reloaded atomic.Pointer[[]*GitlabFetcher]
+		breakers *breakers // circuit breakers of the GitLab hosts, nil gives each mask its own
 	}
 )
 
 var (
 	_       goproxy.Fetcher = (*GitlabFetcher)(nil)
 	matcher                 = regexp.MustCompile(`^v[0-9]+$`)
+	// errNoVersions means that no tag of the project is a version of the module path
+	errNoVersions = errors.New("no matching versions")
+	// downloads counts the GitlabFetcher.Download calls running, including those of masks replaced by a reload
+	downloads atomic.Int64
+)
+
+const (
+	DefaultMaxArchiveSize   = int64(500 << 20)
+	DefaultMaxExtractedSize = int64(zip.MaxZipFile)
 )
 
 func NewGitlabFetcher(conf GitlabFetcherConfig) (goproxy.Fetcher, error) {
-	host, err := NewGitlabHost(conf)
+	return newGitlabFetcher(conf, nil)
+}
+
+// newGitlabFetcher returns a GitlabFetcher sharing the circuit breaker of its host in bs.
+func newGitlabFetcher(conf GitlabFetcherConfig, bs *breakers) (*GitlabFetcher, error) {
+	rewriters, err := newRewriters(conf.Rewrites)
 	if err != nil {
 		return nil, err
 	}
-	return &GitlabFetcher{gitlab: host, config: conf}, nil
+	host, err := newGitlabHost(conf, bs)
+	if err != nil {
+		return nil, err
+	}
+	return &GitlabFetcher{gitlab: host, config: conf, lookups: newLookupCache(conf.LookupCache), rewriters: rewriters}, nil
 }
 
 // Query:
@@ -86,20 +139,33 @@ func NewGitlabFetcher(conf GitlabFetcherConfig) (goproxy.Fetcher, error) {
 // - gitlab.com/wongidle/foobar/internal v0.1.1
 //   - good: wongidle/foobar | internal | internal/v0.1.1
 //   - bad: wongidle/foobar |
+//
+// Version queries (latest, v1.2, >=v1.2.0) are handled by QueryVersion,
+// revisions (branches, commit hashes) by Resolve.
 func (gf *GitlabFetcher) Query(ctx context.Context, path, query string) (string, time.Time, error) {
 	slog.Info("calling Query function", slog.String("path", path), slog.String("query", query))
-	if err := module.Check(path, query); err != nil {
-		slog.Warn("bad path-query pair", slog.String("path", path), slog.String("query", query), slog.String("error", err.Error()))
+	if err := module.CheckPath(path); err != nil {
+		slog.Warn("bad module path", slog.String("path", path), slog.String("error", err.Error()))
 		return "", time.Time{}, err
 	}
-	loc, err := gf.Extract(ctx, path, query)
+
+	var loc *Locator
+	var err error
+	switch {
+	case module.Check(path, query) == nil && isCanonical(query):
+		loc, err = gf.Extract(ctx, path, query)
+	case isVersionQuery(query):
+		loc, err = gf.QueryVersion(ctx, path, query)
+	default:
+		loc, err = gf.Resolve(ctx, path, query)
+	}
 	if err != nil {
 		return "", time.Time{}, err
 	}
-	slog.Info("fetch tag from remote host", slog.String("path", path), slog.String("query", query))
-	info, err := gf.gitlab.GetTag(ctx, loc.Repository, loc.Ref)
+	slog.Info("fetch version info from remote host", slog.String("path", path), slog.String("query", query), slog.String("ref", loc.Ref))
+	info, err := gf.Stat(ctx, loc)
 	if err != nil {
-		slog.Warn("failed to get tag info from gitlab host", slog.String("project", path), slog.String("ref", query), sloghelper.Error(err))
+		slog.Warn("failed to get version info from gitlab host", slog.String("project", path), slog.String("ref", query), sloghelper.Error(err))
 		return "", time.Time{}, err
 	}
 	return info.Version, info.Time, nil
@@ -108,49 +174,96 @@ func (gf *GitlabFetcher) Query(ctx context.Context, path, query string) (string,
 // Download ..
 func (gf *GitlabFetcher) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
 	slog.Info("start to download", slog.String("path", path), slog.String("version", version))
+	downloads.Add(1)
+	defer downloads.Add(-1)
 	if err = module.Check(path, version); err != nil {
 		slog.Warn("bad path-version pair", slog.String("path", path), slog.String("version", version), slog.String("error", err.Error()))
 		return nil, nil, nil, err
 	}
-	loc, err := gf.Extract(ctx, path, version)
+	extractCtx, span := startSpan(ctx, "GitlabFetcher.Extract")
+	loc, err := gf.Extract(extractCtx, path, version)
+	endSpan(span, err)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, notExist(err)
 	}
 
 	g, gCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
 		var errInfo error
-		info, errInfo = gf.SaveInfo(gCtx, ctx, loc)
-		return errInfo
+		spanCtx, span := startSpan(gCtx, "GitlabFetcher.SaveInfo")
+		info, errInfo = gf.SaveInfo(spanCtx, ctx, loc)
+		endSpan(span, errInfo)
+		if errInfo != nil {
+			return fmt.Errorf("info: %w", errInfo)
+		}
+		return nil
 	})
 
 	g.Go(func() error {
 		var errMod error
-		mod, errMod = gf.SaveGoMod(gCtx, ctx, loc)
-		return errMod
+		spanCtx, span := startSpan(gCtx, "GitlabFetcher.SaveGoMod")
+		mod, errMod = gf.SaveGoMod(spanCtx, ctx, loc, path)
+		endSpan(span, errMod)
+		if errMod != nil {
+			return fmt.Errorf("go.mod: %w", errMod)
+		}
+		return nil
 	})
 
 	g.Go(func() error {
 		var errZip error
-		zip, errZip = gf.Archive(gCtx, ctx, loc, path, version)
-		return errZip
+		spanCtx, span := startSpan(gCtx, "GitlabFetcher.Archive")
+		zip, errZip = gf.Archive(spanCtx, ctx, loc, path, version)
+		endSpan(span, errZip)
+		if errZip != nil {
+			return fmt.Errorf("zip: %w", errZip)
+		}
+		return nil
 	})
 
 	if err = g.Wait(); err != nil {
-		return
+		// release the files that were saved before the first failure
+		for _, f := range []io.ReadSeekCloser{info, mod, zip} {
+			if f != nil {
+				_ = f.Close()
+			}
+		}
+		slog.Warn("failed to download module", slog.String("path", path), slog.String("version", version), sloghelper.Error(err))
+		return nil, nil, nil, notExist(fmt.Errorf("download %s@%s: %w", path, version, err))
 	}
 	return
 }
 
-func (gf *GitlabFetcher) SaveInfo(fetchCtx, fileCtx context.Context, loc *Locator) (io.ReadSeekCloser, error) {
-	info, err := gf.gitlab.GetTag(fetchCtx, loc.Repository, loc.Ref)
+// Stat returns the version and commit time of the located module version.
+func (gf *GitlabFetcher) Stat(ctx context.Context, loc *Locator) (*Info, error) {
+	if module.IsPseudoVersion(loc.Version) {
+		info, err := gf.gitlab.GetCommit(ctx, loc.Repository, loc.Ref)
+		if err != nil {
+			return nil, err
+		}
+		info.Version = loc.Version
+		return info, nil
+	}
+
+	info, err := gf.gitlab.GetTag(ctx, loc.Repository, loc.Ref)
 	if err != nil {
 		return nil, err
 	}
-	if loc.SubPath != "" {
+	switch {
+	case loc.Version != "":
+		info.Version = loc.Version
+	case loc.SubPath != "":
 		info.Version = loc.Ref[strings.LastIndex(loc.Ref, "/")+1:]
 	}
+	return info, nil
+}
+
+func (gf *GitlabFetcher) SaveInfo(fetchCtx, fileCtx context.Context, loc *Locator) (io.ReadSeekCloser, error) {
+	info, err := gf.Stat(fetchCtx, loc)
+	if err != nil {
+		return nil, err
+	}
 
 	data, err := json.Marshal(info)
 	if err != nil {
@@ -160,39 +273,53 @@ func (gf *GitlabFetcher) SaveInfo(fetchCtx, fileCtx context.Context, loc *Locato
 	return r, err
 }
 
-func (gf *GitlabFetcher) SaveGoMod(fetchCtx, fileCtx context.Context, loc *Locator) (io.ReadSeekCloser, error) {
+// SaveGoMod saves the go.mod of the located module version. Like the go command, it synthesizes
+// "module <path>" when the version has no go.mod, e.g. a GOPATH-era library, and rejects a go.mod declaring
+// another module path.
+func (gf *GitlabFetcher) SaveGoMod(fetchCtx, fileCtx context.Context, loc *Locator, path string) (io.ReadSeekCloser, error) {
 	data, err := gf.gitlab.GetFile(fetchCtx, loc.Repository, filepath.Join(loc.SubPath, "go.mod"), loc.Ref)
-	if err != nil {
+	switch {
+	case isNotFound(err):
+		slog.Info("synthesize go.mod", slog.String("path", path), slog.String("ref", loc.Ref))
+		data = []byte("module " + modfile.AutoQuote(path) + "\n")
+	case err != nil:
 		return nil, err
+	case modfile.ModulePath(data) != path:
+		// e.g. the raw GitLab path of a module imported through a vanity path
+		return nil, notExistf("go.mod of %s@%s declares module %q", loc.Repository, loc.Ref, modfile.ModulePath(data))
 	}
 
 	r, _, err := Save(fileCtx, bytes.NewReader(data))
 	return r, err
 }
 
-func (gf *GitlabFetcher) Archive(fetchCtx, fileCtx context.Context, loc *Locator, path, version string) (io.ReadSeekCloser, error) {
+func (gf *GitlabFetcher) Archive(fetchCtx, fileCtx context.Context, loc *Locator, path, version string) (_ io.ReadSeekCloser, err error) {
+	start := time.Now()
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		zipBuildDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
 	dir, err := os.MkdirTemp(os.TempDir(), "gitlab-*")
 	if err != nil {
 		return nil, err
 	}
 	defer os.RemoveAll(dir)
 
-	reader, err := gf.gitlab.Download(fetchCtx, loc.Repository, loc.SubPath, loc.Ref)
-	if err != nil {
-		return nil, err
-	}
 	filename := "archive.zip"
 	fp := filepath.Join(dir, filename)
 	f, err := os.Create(fp)
 	if err != nil {
 		return nil, err
 	}
-	_, err = io.Copy(f, reader)
+	err = gf.gitlab.Download(fetchCtx, loc.Repository, loc.SubPath, loc.Ref, LimitWriter(f, gf.maxArchiveSize()))
+	f.Close()
 	if err != nil {
-		f.Close()
+		slog.Warn("failed to download archive", slog.String("project", loc.Repository), slog.String("ref", loc.Ref), sloghelper.Error(err))
 		return nil, err
 	}
-	f.Close()
 	// Finished saving archive file
 
 	// Unzip to the workspace directory
@@ -202,35 +329,61 @@ func (gf *GitlabFetcher) Archive(fetchCtx, fileCtx context.Context, loc *Locator
 	if loc.SubPath != "" {
 		depth = strings.Count(loc.SubPath, "/") + 1
 	}
-	err = UnzipArchiveFromGitlab(ws, depth, fp)
+	_, span := startSpan(fetchCtx, "UnzipArchiveFromGitlab", attribute.Int64("archive.max_extracted_size", gf.maxExtractedSize()))
+	err = UnzipArchiveFromGitlab(ws, depth, fp, gf.maxExtractedSize())
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
 
-	// x/mod processing
+	// x/mod processing, CreateFromDir leaves out the directories of nested modules: the zip of a module does
+	// not contain them, the zip of a submodule only its own files
 	sf, err := Create(fileCtx)
 	if err != nil {
 		return nil, err
 	}
 	slog.Info("created archived file", slog.String("path", path), slog.String("version", version), slog.String("output", sf.Name()))
-	if err = zip.CreateFromDir(sf, module.Version{Path: path, Version: version}, ws); err != nil {
+	_, span = startSpan(fetchCtx, "zip.CreateFromDir")
+	err = zip.CreateFromDir(sf, module.Version{Path: path, Version: version}, ws)
+	endSpan(span, err)
+	if err != nil {
+		_ = sf.Close()
 		return nil, err
 	}
 	return sf, nil
 }
 
+func (gf *GitlabFetcher) maxArchiveSize() int64 {
+	if gf.config.MaxArchiveSize > 0 {
+		return gf.config.MaxArchiveSize
+	}
+	return DefaultMaxArchiveSize
+}
+
+func (gf *GitlabFetcher) maxExtractedSize() int64 {
+	if gf.config.MaxExtractedSize > 0 {
+		return gf.config.MaxExtractedSize
+	}
+	return DefaultMaxExtractedSize
+}
+
 func (gf *GitlabFetcher) Extract(ctx context.Context, path, query string) (*Locator, error) {
 	if err := module.Check(path, query); err != nil {
 		return nil, err
 	}
-	ps := strings.Split(path, "/") // ["gitlab.com", "wongidle", "mutiples", "pkg", "srv", "v2"]
+	ps, err := gf.projectPath(path) // ["wongidle", "mutiples", "pkg", "srv", "v2"]
+	if err != nil {
+		return nil, err
+	}
 	// Simplest mode, host/group/proj v0/1 version, most cases
-	loc := &Locator{Ref: query}
+	// +incompatible versions are served from the plain tag
+	tagVersion := strings.TrimSuffix(query, "+incompatible")
+	loc := &Locator{Ref: tagVersion, Version: query}
 
 	tail := len(ps) - 1
-	for cursor := 2; cursor <= tail; cursor++ {
-		proj := strings.Join(ps[1:cursor+1], "/")
-		ok, err := gf.gitlab.IsProject(ctx, proj)
+	for cursor := 1; cursor <= tail; cursor++ {
+		proj := strings.Join(ps[:cursor+1], "/")
+		ok, err := gf.isProject(ctx, proj)
 		if err != nil {
 			return nil, err
 		}
@@ -238,11 +391,18 @@ func (gf *GitlabFetcher) Extract(ctx context.Context, path, query string) (*Loca
 			continue
 		}
 
-		// ["gitlab.com", "wongidle", "foobar", "pkg"]
+		// ["wongidle", "foobar", "pkg"]
 		loc.Repository = proj
+		// Pseudo-versions point at a commit rather than a tag
+		var commit *Info
+		if module.IsPseudoVersion(query) {
+			if commit, err = gf.resolvePseudoVersion(ctx, proj, query); err != nil {
+				return nil, err
+			}
+			loc.Ref = commit.Commit
+		}
 		if cursor == tail {
-			loc.Ref = query
-			return loc, nil
+			return gf.checkVersion(ctx, loc, commit, path)
 		}
 		if cursor < tail {
 			if isV2 := matcher.MatchString(ps[tail]); isV2 {
@@ -256,21 +416,24 @@ func (gf *GitlabFetcher) Extract(ctx context.Context, path, query string) (*Loca
 				// Recursion starts from the tail
 				for index := len(dirs); index > 0; index-- {
 					subPath := strings.Join(dirs[0:index], "/")
-					ref := subPath + "/" + query
-					_, err = gf.gitlab.GetFile(ctx, loc.Repository, subPath+"/go.mod", ref)
-					if err != nil {
+					ref := subPath + "/" + tagVersion
+					if commit != nil {
+						ref = commit.Commit
+					}
+					ok, err = gf.hasGoMod(ctx, loc.Repository, subPath, ref)
+					if err != nil || !ok {
 						slog.Warn("no go.mod found in subpath", slog.String("project", loc.Repository),
-							slog.String("subpath", subPath), slog.String("version", ref), slog.String("error", err.Error()))
+							slog.String("subpath", subPath), slog.String("version", ref), slog.Any("error", err))
 						continue
 					}
 					loc.SubPath = subPath
 					loc.Ref = ref
-					return loc, nil
+					return gf.checkVersion(ctx, loc, commit, path)
 				}
 				return nil, errors.New("invalid module path")
 			}
 		}
-		return loc, nil
+		return gf.checkVersion(ctx, loc, commit, path)
 	}
 	return nil, fmt.Errorf("cannot find gitlab project with path=%s  query=%s", path, query)
 }
@@ -288,11 +451,13 @@ func (gf *GitlabFetcher) List(ctx context.Context, path string) ([]string, error
 	}
 
 	prefixs := make([]string, 0)
+	dirs := make([]string, 0)
 	switch {
 	case verPrefix != "" && len(subs) > 0:
 		// Tail traversal
 		for tail := len(subs) - 1; tail >= 0; tail-- {
-			prefixs = append(prefixs, strings.Join(subs[:tail+1], "/")+"/"+verPrefix)
+			dirs = append(dirs, strings.Join(subs[:tail+1], "/"))
+			prefixs = append(prefixs, dirs[len(dirs)-1]+"/"+verPrefix)
 		}
 
 	case verPrefix != "" && len(subs) == 0:
@@ -300,51 +465,98 @@ func (gf *GitlabFetcher) List(ctx context.Context, path string) ([]string, error
 
 	case verPrefix == "" && len(subs) > 0:
 		for tail := len(subs) - 1; tail >= 0; tail-- {
-			prefixs = append(prefixs, strings.Join(subs[:tail+1], "/")+"/v")
+			dirs = append(dirs, strings.Join(subs[:tail+1], "/"))
+			prefixs = append(prefixs, dirs[len(dirs)-1]+"/v")
 		}
 
 	case verPrefix == "" && len(subs) == 0:
-		prefixs = append(prefixs, "v0.", "v1.")
-	}
-
-	ret := make([]string, 0)
-	for _, prefix := range prefixs {
+		prefixs = append(prefixs, "v")
+	}
+
+	head := ""
+	for i, prefix := range prefixs {
+		// The tags of an ancestor directory holding a go.mod belong to another module
+		if i > 0 {
+			if head == "" {
+				// looked up at the commit the default branch points to, the answers for a branch would be
+				// cached while it moves
+				branch, err := gf.gitlab.DefaultBranch(ctx, repo)
+				if err != nil {
+					return nil, err
+				}
+				commit, err := gf.gitlab.GetCommit(ctx, repo, branch)
+				if err != nil {
+					return nil, err
+				}
+				head = commit.Commit
+			}
+			ok, err := gf.hasGoMod(ctx, repo, dirs[i], head)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				break
+			}
+		}
 		tags, err := gf.gitlab.ListTags(ctx, repo, prefix)
 		if err != nil {
 			return nil, err
 		}
-		if len(tags) == 0 {
-			continue
-		}
 
+		dir := ""
+		if len(dirs) > 0 {
+			dir = dirs[i]
+		}
+		ret := make([]string, 0, len(tags))
 		for _, tag := range tags {
-			ret = append(ret, tag.Version[strings.LastIndex(tag.Version, "/")+1:])
+			// like filterTags, the prefix of v2 also matches v20 tags
+			version, ok := strings.CutPrefix(tag.Version, tagPrefix(dir))
+			if !ok || !semver.IsValid(version) || semver.Canonical(version) != version || module.IsPseudoVersion(version) {
+				continue
+			}
+			m := semver.Major(version)
+			if verPrefix != "" && m != verPrefix {
+				continue
+			}
+			// v2+ tags of a module path without major version suffix, only a module at the root of the
+			// repository can be +incompatible
+			if verPrefix == "" && m != "v0" && m != "v1" {
+				if len(subs) > 0 {
+					continue
+				}
+				ok, err := gf.isIncompatible(ctx, repo, tag.Version, path)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+				version += "+incompatible"
+			}
+			ret = append(ret, version)
 		}
-		// Traverse v0. Continue with v1.
-		if verPrefix == "" && len(subs) == 0 {
-			continue
+		if len(ret) > 0 {
+			return ret, nil
 		}
-		return ret, nil
-	}
-	if len(ret) > 0 {
-		return ret, nil
 	}
-	return nil, errors.New("no matching versions")
+	return nil, errNoVersions
 }
 
 func (gf *GitlabFetcher) ExtractSubPath(ctx context.Context, path string) (string, []string, string, error) {
 	verPrefix := ""
 
-	escaped, err := module.EscapePath(path)
+	if err := module.CheckPath(path); err != nil {
+		return "", nil, verPrefix, err
+	}
+	ps, err := gf.projectPath(path)
 	if err != nil {
 		return "", nil, verPrefix, err
 	}
-	ps := strings.Split(escaped, "/")
 	tail := len(ps) - 1
 
-	for cursor := 2; cursor <= tail; cursor++ {
-		proj := strings.Join(ps[1:cursor+1], "/")
-		ok, err := gf.gitlab.IsProject(ctx, proj)
+	for cursor := 1; cursor <= tail; cursor++ {
+		proj := strings.Join(ps[:cursor+1], "/")
+		ok, err := gf.isProject(ctx, proj)
 		if err != nil {
 			return "", nil, verPrefix, err
 		}
@@ -363,54 +575,150 @@ func (gf *GitlabFetcher) ExtractSubPath(ctx context.Context, path string) (strin
 		}
 		return proj, []string{}, verPrefix, nil
 	}
-	return "", nil, verPrefix, errors.New("no matching versions")
+	return "", nil, verPrefix, errNoVersions
 }
 
 func (gf *GitlabFetcher) NeedFetch(path string) bool {
-	return strings.HasPrefix(path, gf.config.Mask)
+	return gf.specificity(path) >= 0
+}
+
+// specificity scores how closely Mask matches path, -1 means no match. Patterns with more path elements
+// win, then patterns with more literal characters, e.g. gitlab.com/team-a > gitlab.com/* > gitlab.com.
+// Paths only matched by a rewrite rule score 0.
+func (gf *GitlabFetcher) specificity(path string) int {
+	best := -1
+	for _, pattern := range strings.Split(gf.config.Mask, ",") {
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if pattern == "" || !module.MatchPrefixPatterns(pattern, path) {
+			continue
+		}
+		literals := len(strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`*?[]\`, r) {
+				return -1
+			}
+			return r
+		}, pattern))
+		if score := (strings.Count(pattern, "/")+1)<<16 + literals; score > best {
+			best = score
+		}
+	}
+	if best < 0 && gf.rewritten(path) {
+		best = 0
+	}
+	return best
 }
 
 func NewMixedFetcher(conf Config) (*MixedFetcher, error) {
-	mf := &MixedFetcher{}
-	envs := os.Environ()
-	envs = append(envs, fmt.Sprintf("GOPROXY=%s,direct", conf.Upstream.Proxy))
-	mf.Upstream = &goproxy.GoFetcher{Env: envs}
-	for _, c := range conf.Masks {
-		f, err := NewGitlabFetcher(c)
+	mf := &MixedFetcher{breakers: newBreakers()}
+	upstream, err := NewUpstreams(conf.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	mf.Upstream = upstream
+	for i, c := range conf.Masks {
+		if err = validateMask(c); err != nil {
+			return nil, fmt.Errorf("mask %d: %w", i, err)
+		}
+		gf, err := newGitlabFetcher(c, mf.breakers)
 		if err != nil {
 			return nil, err
 		}
-		mf.Masks = append(mf.Masks, f.(*GitlabFetcher))
+		mf.Masks = append(mf.Masks, gf)
 	}
+	mf.breakers.configure(conf.Masks)
 	return mf, nil
 }
 
-func (mf *MixedFetcher) Download(ctx context.Context, path string, version string) (io.ReadSeekCloser, io.ReadSeekCloser, io.ReadSeekCloser, error) {
-	for _, gf := range mf.Masks {
-		if gf.NeedFetch(path) {
-			return gf.Download(ctx, path, version)
+// UpstreamStats returns which upstreams served the requests not routed to a mask, if Upstream is *Upstreams.
+func (mf *MixedFetcher) UpstreamStats() []UpstreamStats {
+	if us, ok := mf.Upstream.(*Upstreams); ok {
+		return us.Stats()
+	}
+	return nil
+}
+
+// Route returns the GitlabFetcher whose Mask matches path most specifically, or nil if path belongs upstream.
+// Among equally specific masks the first one wins.
+func (mf *MixedFetcher) Route(path string) *GitlabFetcher {
+	var ret *GitlabFetcher
+	best := -1
+	for _, gf := range mf.masks() {
+		if score := gf.specificity(path); score > best {
+			ret, best = gf, score
+		}
+	}
+	return ret
+}
+
+// Drain waits until no GitLab Download call is running, or until ctx is done.
+func (mf *MixedFetcher) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := downloads.Load()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d downloads still running: %w", n, ctx.Err())
+		case <-ticker.C:
 		}
 	}
+}
+
+func (mf *MixedFetcher) Download(ctx context.Context, path string, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	start, route := time.Now(), upstreamRoute
+	ctx, span := startSpan(ctx, "MixedFetcher.Download", attribute.String("module.path", path), attribute.String("module.version", version))
+	defer func() {
+		span.SetAttributes(attribute.String("route", route))
+		endSpan(span, err)
+		observeRequest("download", route, start, err)
+	}()
+	if gf := mf.Route(path); gf != nil {
+		route = gf.routeName()
+		return gf.Download(ctx, path, version)
+	}
 	slog.Info("redirect download request to upstream proxy", slog.String("path", path), slog.String("version", version))
 	return mf.Upstream.Download(ctx, path, version)
 }
 
-func (mf *MixedFetcher) List(ctx context.Context, path string) ([]string, error) {
-	for _, gf := range mf.Masks {
-		if gf.NeedFetch(path) {
-			return gf.List(ctx, path)
+func (mf *MixedFetcher) List(ctx context.Context, path string) (versions []string, err error) {
+	start, route := time.Now(), upstreamRoute
+	ctx, span := startSpan(ctx, "MixedFetcher.List", attribute.String("module.path", path))
+	defer func() {
+		span.SetAttributes(attribute.String("route", route))
+		endSpan(span, err)
+		observeRequest("list", route, start, err)
+	}()
+	if gf := mf.Route(path); gf != nil {
+		route = gf.routeName()
+		versions, err = gf.List(ctx, path)
+		if err != nil && isUnavailable(err) {
+			markStale(ctx)
 		}
+		return versions, err
 	}
 	slog.Info("redirect list request to upstream proxy", slog.String("path", path))
 	return mf.Upstream.List(ctx, path)
 }
 
-func (mf *MixedFetcher) Query(ctx context.Context, path string, query string) (string, time.Time, error) {
-	for _, gf := range mf.Masks {
-		if gf.NeedFetch(path) {
-			return gf.Query(ctx, path, query)
+func (mf *MixedFetcher) Query(ctx context.Context, path string, query string) (version string, t time.Time, err error) {
+	start, route := time.Now(), upstreamRoute
+	ctx, span := startSpan(ctx, "MixedFetcher.Query", attribute.String("module.path", path), attribute.String("module.query", query))
+	defer func() {
+		span.SetAttributes(attribute.String("route", route))
+		endSpan(span, err)
+		observeRequest("query", route, start, err)
+	}()
+	if gf := mf.Route(path); gf != nil {
+		route = gf.routeName()
+		version, t, err = gf.Query(ctx, path, query)
+		if err != nil && isUnavailable(err) {
+			markStale(ctx)
 		}
+		return version, t, err
 	}
 	slog.Info("redirect query request to upstream proxy", slog.String("path", path), slog.String("query", query))
 	return mf.Upstream.Query(ctx, path, query)
-}
\ No newline at end of file
+}
@@ -2,23 +2,29 @@ package gitlabgoproxy_test
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
 )
 
 func TestGitlabFetcher_Extract(t *testing.T) {
-	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
-	assert.NoError(t, err)
-	fetcher := f.(*gitlabgoproxy.GitlabFetcher)
+	fetcher, _ := newFixtureFetcher(t)
 	// simple
 	loc, err := fetcher.Extract(context.Background(), "gitlab.com/wongidle/foobar", "v0.2.0")
 	assert.NoError(t, err)
-	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", SubPath: "", Ref: "v0.2.0"}, loc)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", SubPath: "", Ref: "v0.2.0", Version: "v0.2.0"}, loc)
 
 	// invalid module path
 	_, err = fetcher.Extract(context.Background(), "gitlab.com/wongidle/foobar/internal/pkg", "v0.2.0")
@@ -27,28 +33,95 @@ func TestGitlabFetcher_Extract(t *testing.T) {
 	// submodule path
 	loc, err = fetcher.Extract(context.Background(), "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
 	assert.NoError(t, err)
-	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", SubPath: "pkg", Ref: "pkg/v0.2.1"}, loc)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", SubPath: "pkg", Ref: "pkg/v0.2.1", Version: "v0.2.1"}, loc)
 
 	// v2
 	loc, err = fetcher.Extract(context.Background(), "gitlab.com/wongidle/mutiples/v2", "v2.0.2")
 	assert.NoError(t, err)
-	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/mutiples", SubPath: "", Ref: "v2.0.2"}, loc)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/mutiples", SubPath: "", Ref: "v2.0.2", Version: "v2.0.2"}, loc)
 
 	// v2 submodule
 	loc, err = fetcher.Extract(context.Background(), "gitlab.com/wongidle/mutiples/pkg/str/v2", "v2.0.2")
 	assert.NoError(t, err)
-	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/mutiples", SubPath: "pkg/str", Ref: "pkg/str/v2.0.2"}, loc)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/mutiples", SubPath: "pkg/str", Ref: "pkg/str/v2.0.2", Version: "v2.0.2"}, loc)
 
 	// v2 invalid module
 	_, err = fetcher.Extract(context.Background(), "gitlab.com/wongidle/mutiples/internal/pkg/bytesconv/v2", "v2.0.2")
 	assert.Error(t, err)
 	_, err = fetcher.Extract(context.Background(), "gitlab.com/wongidle/mutiples/v2/internal/pkg/bytesconv", "v2.0.2")
 	assert.Error(t, err)
+
+	// project in a subgroup
+	loc, err = fetcher.Extract(context.Background(), "gitlab.com/group/sub/nested", "v1.0.0")
+	assert.NoError(t, err)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "group/sub/nested", SubPath: "", Ref: "v1.0.0", Version: "v1.0.0"}, loc)
 }
 
-func TestGitlabFetcher_List(t *testing.T) {
-	fetcher, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
+func TestGitlabFetcher_LookupCache(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	ctx := context.Background()
+
+	_, err := fetcher.Extract(ctx, "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
+	assert.NoError(t, err)
+	calls := fg.Calls("")
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
+	assert.NoError(t, err)
+	assert.EqualValues(t, calls, fg.Calls(""))
+
+	// negative results are cached too
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar/internal/pkg", "v0.2.0")
+	assert.Error(t, err)
+	calls = fg.Calls("")
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar/internal/pkg", "v0.2.0")
+	assert.Error(t, err)
+	assert.EqualValues(t, calls, fg.Calls(""))
+
+	stats := fetcher.LookupStats()
+	assert.EqualValues(t, 4, stats.Misses)
+	assert.EqualValues(t, 6, stats.Hits)
+	assert.EqualValues(t, 4, stats.Entries)
+
+	// ExtractSubPath shares the project lookups
+	_, _, _, err = fetcher.ExtractSubPath(ctx, "gitlab.com/wongidle/foobar/pkg")
 	assert.NoError(t, err)
+	assert.EqualValues(t, calls, fg.Calls(""))
+
+	fetcher.Invalidate("wongidle/foobar")
+	assert.EqualValues(t, 0, fetcher.LookupStats().Entries)
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
+	assert.NoError(t, err)
+	assert.Less(t, calls, fg.Calls(""))
+
+	// errors are not cached
+	fg.Inject(fault{Path: "/projects/wongidle%2Fmutiples", Status: http.StatusUnauthorized, Times: 1})
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/mutiples/v2", "v2.0.2")
+	assert.Error(t, err)
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/mutiples/v2", "v2.0.2")
+	assert.NoError(t, err)
+
+	// bounded
+	small, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), LookupCache: gitlabgoproxy.LookupCacheConfig{Size: 1}})
+	assert.NoError(t, err)
+	_, err = small.(*gitlabgoproxy.GitlabFetcher).Extract(ctx, "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, small.(*gitlabgoproxy.GitlabFetcher).LookupStats().Entries)
+	assert.EqualValues(t, 1, small.(*gitlabgoproxy.GitlabFetcher).LookupStats().Evictions)
+
+	// disabled
+	disabled, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), LookupCache: gitlabgoproxy.LookupCacheConfig{Size: -1}})
+	assert.NoError(t, err)
+	_, err = disabled.(*gitlabgoproxy.GitlabFetcher).Extract(ctx, "gitlab.com/wongidle/foobar", "v0.2.0")
+	assert.NoError(t, err)
+	calls = fg.Calls("")
+	_, err = disabled.(*gitlabgoproxy.GitlabFetcher).Extract(ctx, "gitlab.com/wongidle/foobar", "v0.2.0")
+	assert.NoError(t, err)
+	assert.Less(t, calls, fg.Calls(""))
+}
+
+func TestGitlabFetcher_List(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
 
 	// simple
 	versions, err := fetcher.List(context.Background(), "gitlab.com/wongidle/foobar")
@@ -69,6 +142,16 @@ func TestGitlabFetcher_List(t *testing.T) {
 	assert.NoError(t, err)
 	assert.EqualValues(t, versions, []string{"v2.0.1", "v2.0.2"})
 
+	// only the canonical release tags of the major version
+	mutiples := fg.projects["wongidle/mutiples"]
+	for _, tag := range []string{"v20.0.0", "v2.1", "v2.0.3+build", "v2.0.3-0.20240101000000-abcdefabcdef",
+		"pkg/str/v20.0.0", "pkg/str/v2.1"} {
+		mutiples.Tag(tag, fg.Resolve("wongidle/mutiples", "v2.0.2"))
+	}
+	versions, err = fetcher.List(context.Background(), "gitlab.com/wongidle/mutiples/v2")
+	assert.NoError(t, err)
+	assert.EqualValues(t, versions, []string{"v2.0.1", "v2.0.2"})
+
 	// v2 submodule
 	versions, err = fetcher.List(context.Background(), "gitlab.com/wongidle/mutiples/pkg/str/v2")
 	assert.NoError(t, err)
@@ -81,12 +164,289 @@ func TestGitlabFetcher_List(t *testing.T) {
 	versions, err = fetcher.List(context.Background(), "gitlab.com/wongidle/mutiples/v2/internal/pkg/bytesconv")
 	slog.Info("unexpected versions", slog.Any("versions", versions))
 	assert.Error(t, err)
+
+	// untagged nested modules do not list the tags of the module they are nested in
+	for _, path := range []string{"gitlab.com/wongidle/nested/lib/sub", "gitlab.com/wongidle/nested/lib/sub/x"} {
+		_, err = fetcher.List(context.Background(), path)
+		assert.Error(t, err, path)
+	}
+
+	// the go.mod of an ancestor is looked up at the head of the default branch, not cached by its name
+	moving := fg.AddProject("wongidle/moving")
+	moving.Tag("lib/v1.0.0", moving.Commit("main", foobarTime, map[string]string{
+		"go.mod":     "module gitlab.com/wongidle/moving\n\ngo 1.22.0\n",
+		"lib/api.go": "package lib\n",
+	}))
+	versions, err = fetcher.List(context.Background(), "gitlab.com/wongidle/moving/lib/api")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v1.0.0"}, versions)
+	moving.Commit("main", foobarTime.Add(time.Hour), map[string]string{"lib/go.mod": "module gitlab.com/wongidle/moving/lib\n\ngo 1.22.0\n"})
+	_, err = fetcher.List(context.Background(), "gitlab.com/wongidle/moving/lib/api")
+	assert.Error(t, err)
+
+	// mixed case project path
+	versions, err = fetcher.List(context.Background(), "gitlab.com/WhyNotHugo/darkman")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v1.5.3", "v1.5.4", "v2.0.0+incompatible"}, versions)
 }
 
-func TestGitlabFetcher_Download(t *testing.T) {
-	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
+func TestGitlabFetcher_Rewrite(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	for _, rule := range []gitlabgoproxy.RewriteRule{
+		{Prefix: "go.corp.example", Namespace: "backend"},
+		{Prefix: "go.corp.example/payments/", Namespace: "backend/payments"},
+		{Pattern: `go\.corp\.example/(\w+)`, Template: "backend/$1"},
+	} {
+		f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+			Endpoint: fg.Endpoint(), Mask: "go.corp.example", Rewrites: []gitlabgoproxy.RewriteRule{rule}})
+		assert.NoError(t, err)
+		fetcher := f.(*gitlabgoproxy.GitlabFetcher)
+
+		loc, err := fetcher.Extract(ctx, "go.corp.example/payments/ledger", "v1.0.0")
+		assert.NoError(t, err)
+		assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "backend/payments/ledger", Ref: "v1.0.0", Version: "v1.0.0"}, loc)
+
+		loc, err = fetcher.Extract(ctx, "go.corp.example/payments/ledger/api", "v1.0.0")
+		assert.NoError(t, err)
+		assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "backend/payments/ledger", SubPath: "api", Ref: "api/v1.0.0", Version: "v1.0.0"}, loc)
+
+		_, err = fetcher.Extract(ctx, "go.corp.example/payments/ledger/internal", "v1.0.0")
+		assert.Error(t, err)
+
+		versions, err := fetcher.List(ctx, "go.corp.example/payments/ledger/api")
+		assert.NoError(t, err)
+		assert.EqualValues(t, []string{"v1.0.0"}, versions)
+
+		version, _, err := fetcher.Query(ctx, "go.corp.example/payments/ledger", "latest")
+		assert.NoError(t, err)
+		assert.EqualValues(t, "v1.0.0", version)
+
+		_, mod, zip, err := fetcher.Download(ctx, "go.corp.example/payments/ledger", "v1.0.0")
+		assert.NoError(t, err)
+		data, err := io.ReadAll(mod)
+		assert.NoError(t, err)
+		assert.EqualValues(t, "module go.corp.example/payments/ledger\n\ngo 1.22.0\n", string(data))
+		assertZip(t, zip, "go.corp.example/payments/ledger", "v1.0.0", "go.mod", "ledger.go", "internal/i.go")
+	}
+
+	// paths without a matching rule keep the default layout
+	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "gitlab.com", Rewrites: []gitlabgoproxy.RewriteRule{{Prefix: "go.corp.example", Namespace: "backend"}}})
 	assert.NoError(t, err)
 	fetcher := f.(*gitlabgoproxy.GitlabFetcher)
+	versions, err := fetcher.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v0.1.0", "v0.1.1", "v0.2.0"}, versions)
+	assert.True(t, fetcher.NeedFetch("go.corp.example/payments/ledger"))
+	assert.False(t, fetcher.NeedFetch("go.corp.example.org/payments/ledger"))
+
+	// the module is only served under the path its go.mod declares
+	f, err = gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "gitlab.com", Rewrites: []gitlabgoproxy.RewriteRule{{Prefix: "go.corp.example/payments", Namespace: "backend/payments"}}})
+	assert.NoError(t, err)
+	fetcher = f.(*gitlabgoproxy.GitlabFetcher)
+	_, mod, _, err := fetcher.Download(ctx, "go.corp.example/payments/ledger", "v1.0.0")
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(mod)
+		assert.NoError(t, err)
+		assert.EqualValues(t, "module go.corp.example/payments/ledger\n\ngo 1.22.0\n", string(data))
+	}
+	_, _, _, err = fetcher.Download(ctx, "gitlab.com/backend/payments/ledger", "v1.0.0")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// a rule must not map a module path onto something that is not a project path
+	f, err = gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "go.corp.example", Rewrites: []gitlabgoproxy.RewriteRule{{Prefix: "go.corp.example/ledger"}}})
+	assert.NoError(t, err)
+	_, err = f.(*gitlabgoproxy.GitlabFetcher).Extract(ctx, "go.corp.example/ledger", "v1.0.0")
+	assert.Error(t, err)
+
+	for _, rule := range []gitlabgoproxy.RewriteRule{
+		{},
+		{Prefix: "go.corp.example", Pattern: "go.corp.example"},
+		{Pattern: "go.corp.example/(", Template: "backend"},
+	} {
+		_, err = gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint(), Rewrites: []gitlabgoproxy.RewriteRule{rule}})
+		assert.Error(t, err)
+	}
+}
+
+func TestGitlabFetcher_Incompatible(t *testing.T) {
+	fetcher, _ := newFixtureFetcher(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// v4.0.0 declares the /v4 suffix, so it is not +incompatible
+	versions, err := fetcher.List(ctx, "gitlab.com/wongidle/legacy")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v1.0.0", "v2.0.0+incompatible", "v3.1.0+incompatible"}, versions)
+
+	versions, err = fetcher.List(ctx, "gitlab.com/wongidle/legacy/v4")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v4.0.0"}, versions)
+
+	versions, err = fetcher.List(ctx, "gitlab.com/wongidle/legacy/lib")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v1.0.0"}, versions)
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/legacy/lib", "v2.0.0+incompatible")
+	assert.Error(t, err)
+
+	// v1.0.0 has no go.mod, so latest may pick an +incompatible version
+	version, _, err := fetcher.Query(ctx, "gitlab.com/wongidle/legacy", "latest")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v3.1.0+incompatible", version)
+
+	version, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/legacy", "v2")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v2.0.0+incompatible", version)
+
+	version, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/legacy", "v3.1.0+incompatible")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v3.1.0+incompatible", version)
+
+	loc, err := fetcher.Extract(ctx, "gitlab.com/wongidle/legacy", "v2.0.0+incompatible")
+	assert.NoError(t, err)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/legacy", Ref: "v2.0.0", Version: "v2.0.0+incompatible"}, loc)
+
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/legacy", "v4.0.0+incompatible")
+	assert.Error(t, err)
+
+	info, mod, zip, err := fetcher.Download(ctx, "gitlab.com/wongidle/legacy", "v3.1.0+incompatible")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(info)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"Version":"v3.1.0+incompatible"`)
+	data, err = io.ReadAll(mod)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "module gitlab.com/wongidle/legacy\n\ngo 1.22.0\n", string(data))
+	assertZip(t, zip, "gitlab.com/wongidle/legacy", "v3.1.0+incompatible", "go.mod", "legacy.go")
+
+	// no go.mod at the tag, the go.mod is synthesized
+	_, mod, zip, err = fetcher.Download(ctx, "gitlab.com/wongidle/legacy", "v2.0.0+incompatible")
+	assert.NoError(t, err)
+	data, err = io.ReadAll(mod)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "module gitlab.com/wongidle/legacy\n", string(data))
+	assertZip(t, zip, "gitlab.com/wongidle/legacy", "v2.0.0+incompatible", "legacy.go")
+}
+
+func TestGitlabFetcher_QueryRevision(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	head := fg.Resolve("wongidle/foobar", "main")
+
+	// branch
+	version, ts, err := fetcher.Query(ctx, "gitlab.com/wongidle/foobar", "main")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v0.2.1-0.20240701100000-"+head[:12], version)
+	assert.True(t, mainTime.Equal(ts))
+
+	// abbreviated commit hash
+	version, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/foobar", head[:7])
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v0.2.1-0.20240701100000-"+head[:12], version)
+
+	// tagged commit
+	version, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/foobar", fg.Resolve("wongidle/foobar", "v0.2.0"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v0.2.0", version)
+
+	// submodule
+	version, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/foobar/pkg", "main")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v0.2.2-0.20240701100000-"+head[:12], version)
+
+	// v2 submodule at a tagged commit
+	version, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/mutiples/pkg/str/v2", "main")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v2.0.2", version)
+
+	// unknown revision
+	_, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/foobar", "no-such-branch")
+	assert.Error(t, err)
+}
+
+func TestGitlabFetcher_DownloadPseudoVersion(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	head := fg.Resolve("wongidle/foobar", "main")
+
+	version := "v0.2.1-0.20240701100000-" + head[:12]
+	loc, err := fetcher.Extract(ctx, "gitlab.com/wongidle/foobar", version)
+	assert.NoError(t, err)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", Ref: head, Version: version}, loc)
+
+	info, mod, zip, err := fetcher.Download(ctx, "gitlab.com/wongidle/foobar", version)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(info)
+	assert.NoError(t, err)
+	assert.EqualValues(t, `{"Version":"`+version+`","Time":"2024-07-01T10:00:00Z"}`, string(data))
+	data, err = io.ReadAll(mod)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "module gitlab.com/wongidle/foobar\n\ngo 1.22.0\n", string(data))
+	assertZip(t, zip, "gitlab.com/wongidle/foobar", version, "go.mod", "foobar.go", "internal/pkg/pkg.go")
+
+	// submodule
+	version = "v0.2.2-0.20240701100000-" + head[:12]
+	loc, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar/pkg", version)
+	assert.NoError(t, err)
+	assert.EqualValues(t, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", SubPath: "pkg", Ref: head, Version: version}, loc)
+	_, _, zip, err = fetcher.Download(ctx, "gitlab.com/wongidle/foobar/pkg", version)
+	assert.NoError(t, err)
+	assertZip(t, zip, "gitlab.com/wongidle/foobar/pkg", version, "go.mod", "pkg.go")
+
+	// timestamp does not match the commit
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar", "v0.2.1-0.20240701100001-"+head[:12])
+	assert.Error(t, err)
+
+	// base tag does not exist
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar", "v0.3.1-0.20240701100000-"+head[:12])
+	assert.Error(t, err)
+
+	// base tag is not an ancestor
+	first := fg.Resolve("wongidle/foobar", "v0.1.0")
+	_, err = fetcher.Extract(ctx, "gitlab.com/wongidle/foobar", "v0.1.2-0.20240628070420-"+first[:12])
+	assert.Error(t, err)
+}
+
+func TestGitlabFetcher_QueryVersion(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	for _, c := range []struct {
+		path, query, expected string
+	}{
+		{"gitlab.com/wongidle/foobar", "latest", "v0.2.0"},
+		{"gitlab.com/wongidle/foobar", "upgrade", "v0.2.0"},
+		{"gitlab.com/wongidle/foobar", "v0.1", "v0.1.1"},
+		{"gitlab.com/wongidle/foobar", ">=v0.1.1", "v0.1.1"},
+		{"gitlab.com/wongidle/foobar", "<v0.2.0", "v0.1.1"},
+		{"gitlab.com/wongidle/foobar/pkg", "latest", "v0.2.1"},
+		{"gitlab.com/wongidle/mutiples/v2", "latest", "v2.0.2"},
+		{"gitlab.com/wongidle/mutiples/v2", "<v2.0.2", "v2.0.1"},
+		{"gitlab.com/wongidle/mutiples/pkg/str/v2", "latest", "v2.0.2"},
+		{"gitlab.com/wongidle/untagged", "latest", "v0.0.0-20240702083000-" + fg.Resolve("wongidle/untagged", "main")[:12]},
+		{"gitlab.com/group/sub/nested", "latest", "v1.0.0"},
+	} {
+		version, _, err := fetcher.Query(ctx, c.path, c.query)
+		assert.NoError(t, err, c.path+"@"+c.query)
+		assert.EqualValues(t, c.expected, version, c.path+"@"+c.query)
+	}
+
+	_, _, err := fetcher.Query(ctx, "gitlab.com/wongidle/foobar", ">v1.0.0")
+	assert.Error(t, err)
+	_, _, err = fetcher.Query(ctx, "gitlab.com/wongidle/foobar", ">=latest")
+	assert.Error(t, err)
+}
+
+func TestGitlabFetcher_Download(t *testing.T) {
+	fetcher, _ := newFixtureFetcher(t)
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer func() {
 		slog.Info("calling cancel")
@@ -112,14 +472,280 @@ func TestGitlabFetcher_Download(t *testing.T) {
 	slog.Info("read go.mod")
 	time.Sleep(1 * time.Second)
 
-	_, err = io.ReadAll(zip)
+	assertZip(t, zip, "gitlab.com/wongidle/foobar", "v0.2.0", "go.mod", "foobar.go", "internal/pkg/pkg.go")
+}
+
+func TestGitlabFetcher_ZipHash(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	for _, c := range []struct {
+		path, version, project, ref, subPath string
+		files                                []string
+	}{
+		{"gitlab.com/wongidle/foobar", "v0.2.0", "wongidle/foobar", "v0.2.0", "",
+			[]string{"go.mod", "foobar.go", "internal/pkg/pkg.go"}},
+		{"gitlab.com/wongidle/foobar/pkg", "v0.2.1", "wongidle/foobar", "pkg/v0.2.1", "pkg",
+			[]string{"go.mod", "pkg.go"}},
+		{"gitlab.com/wongidle/mutiples/v2", "v2.0.2", "wongidle/mutiples", "v2.0.2", "",
+			[]string{"go.mod", "mutiples.go", "internal/pkg/bytesconv/bytesconv.go"}},
+		{"gitlab.com/wongidle/mutiples/pkg/str/v2", "v2.0.2", "wongidle/mutiples", "pkg/str/v2.0.2", "pkg/str",
+			[]string{"go.mod", "str.go"}},
+		{"gitlab.com/wongidle/nested", "v1.0.0", "wongidle/nested", "v1.0.0", "",
+			[]string{"go.mod", "nested.go", "docs/README.md"}},
+		{"gitlab.com/wongidle/nested/lib", "v1.0.0", "wongidle/nested", "lib/v1.0.0", "lib",
+			[]string{"go.mod", "lib.go", "internal/i.go"}},
+	} {
+		_, _, zip, err := fetcher.Download(ctx, c.path, c.version)
+		if !assert.NoError(t, err, c.path) {
+			continue
+		}
+		assertZip(t, zip, c.path, c.version, c.files...)
+		h1, err := dirhash.HashZip(zip.(*gitlabgoproxy.SmartFile).Name(), dirhash.Hash1)
+		assert.NoError(t, err)
+		assert.EqualValues(t, goModDownloadHash(t, fg.Files(c.project, c.ref), c.subPath, c.path, c.version, c.files), h1, c.path)
+	}
+}
+
+// goModDownloadHash computes the h1: hash the go command records for a module version from the files the
+// module zip must hold, as listed by the test rather than derived from the tree.
+func goModDownloadHash(t *testing.T, tree map[string]string, subPath, path, version string, files []string) string {
+	t.Helper()
+	prefix := ""
+	if subPath != "" {
+		prefix = subPath + "/"
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = path + "@" + version + "/" + file
+	}
+	h1, err := dirhash.Hash1(names, func(name string) (io.ReadCloser, error) {
+		content, ok := tree[prefix+strings.TrimPrefix(name, path+"@"+version+"/")]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		return io.NopCloser(strings.NewReader(content)), nil
+	})
 	assert.NoError(t, err)
+	return h1
 }
 
-func TestGitlabFetcher_Info(t *testing.T) {
-	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
+func TestGitlabFetcher_DownloadFaults(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	fg.Inject(fault{Path: "/repository/archive", Status: http.StatusUnauthorized, Times: 1})
+	_, _, _, err := fetcher.Download(ctx, "gitlab.com/wongidle/foobar", "v0.2.0")
+	assert.Error(t, err)
+
+	fg.Inject(fault{Path: "/repository/archive", Truncate: true, Times: 1})
+	_, _, _, err = fetcher.Download(ctx, "gitlab.com/wongidle/foobar", "v0.2.0")
+	assert.Error(t, err)
+
+	// not found is reported as fs.ErrNotExist, so goproxy answers 404
+	_, _, _, err = fetcher.Download(ctx, "gitlab.com/wongidle/foobar", "v0.9.0")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// failures other than 404 while fetching go.mod are not hidden by a synthesized one. A submodule is
+	// used because the go.mod request of the truncated download above may still reach the server.
+	_, _, _, err = fetcher.Download(ctx, "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
 	assert.NoError(t, err)
-	fetcher := f.(*gitlabgoproxy.GitlabFetcher)
+	fg.Inject(fault{Path: "pkg%2Fgo%2Emod/raw", Status: http.StatusForbidden, Times: 1})
+	_, _, _, err = fetcher.Download(ctx, "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, fs.ErrNotExist)
+
+	_, _, _, err = fetcher.Download(ctx, "gitlab.com/wongidle/foobar/pkg", "v0.2.1")
+	assert.NoError(t, err)
+}
+
+func TestGitlabFetcher_DownloadLimits(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	addMonorepo(fg, 4, 64<<10)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	for _, c := range []struct {
+		conf gitlabgoproxy.GitlabFetcherConfig
+		err  error
+	}{
+		{gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint(), MaxArchiveSize: 128 << 10}, gitlabgoproxy.ErrTooLarge},
+		{gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint(), MaxExtractedSize: 128 << 10}, gitlabgoproxy.ErrTooLarge},
+		{gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint()}, nil},
+	} {
+		fetcher, err := gitlabgoproxy.NewGitlabFetcher(c.conf)
+		assert.NoError(t, err)
+		_, _, _, err = fetcher.Download(ctx, "gitlab.com/wongidle/monorepo", "v1.0.0")
+		if c.err == nil {
+			assert.NoError(t, err)
+			continue
+		}
+		assert.ErrorIs(t, err, c.err)
+	}
+}
+
+func TestGitlabFetcher_DownloadLimitStopsTransfer(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	addMonorepo(fg, 16, 64<<10)
+	fg.Inject(fault{Path: "archive.zip", Throttle: 5 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	fetcher, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint(), MaxArchiveSize: 128 << 10})
+	assert.NoError(t, err)
+	_, _, _, err = fetcher.Download(ctx, "gitlab.com/wongidle/monorepo", "v1.0.0")
+	assert.ErrorIs(t, err, gitlabgoproxy.ErrTooLarge)
+	// the archive is over 1 MiB, the fake server stops sending soon after the limit is hit
+	time.Sleep(100 * time.Millisecond)
+	sent := fg.Sent()
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, sent, fg.Sent())
+	assert.Less(t, sent, 512<<10)
+}
+
+// BenchmarkGitlabFetcher_Download reports the memory cost of building a zip from a 16 MiB archive.
+func BenchmarkGitlabFetcher_Download(b *testing.B) {
+	fetcher, fg := newFixtureFetcher(b)
+	addMonorepo(fg, 16, 1<<20)
+	download := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		info, mod, zip, err := fetcher.Download(ctx, "gitlab.com/wongidle/monorepo", "v1.0.0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		info.Close()
+		mod.Close()
+		zip.Close()
+	}
+	download() // let the fake server build and cache the archive
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		download()
+	}
+}
+
+// addMonorepo adds wongidle/monorepo tagged v1.0.0 with files of incompressible content.
+func addMonorepo(fg *fakeGitLab, files, size int) {
+	rnd := rand.New(rand.NewSource(1))
+	content := map[string]string{"go.mod": "module gitlab.com/wongidle/monorepo\n\ngo 1.22.0\n"}
+	for i := 0; i < files; i++ {
+		data := make([]byte, size)
+		rnd.Read(data)
+		content[fmt.Sprintf("assets/blob%02d.bin", i)] = string(data)
+	}
+	p := fg.AddProject("wongidle/monorepo")
+	p.Tag("v1.0.0", p.Commit("main", mainTime, content))
+}
+
+func TestMixedFetcher(t *testing.T) {
+	gf, _ := newFixtureFetcher(t)
+	upstream := &recordingFetcher{}
+	mf := &gitlabgoproxy.MixedFetcher{Masks: []*gitlabgoproxy.GitlabFetcher{gf}, Upstream: upstream}
+	ctx := context.Background()
+
+	versions, err := mf.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v0.1.0", "v0.1.1", "v0.2.0"}, versions)
+	version, _, err := mf.Query(ctx, "gitlab.com/wongidle/foobar", "latest")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v0.2.0", version)
+	_, _, zip, err := mf.Download(ctx, "gitlab.com/wongidle/foobar", "v0.2.0")
+	assert.NoError(t, err)
+	assert.NotNil(t, zip)
+	assert.Empty(t, upstream.calls)
+
+	_, _ = mf.List(ctx, "github.com/stretchr/testify")
+	_, _, _ = mf.Query(ctx, "github.com/stretchr/testify", "latest")
+	_, _, _, _ = mf.Download(ctx, "github.com/stretchr/testify", "v1.11.1")
+	assert.EqualValues(t, []string{"List github.com/stretchr/testify", "Query github.com/stretchr/testify latest",
+		"Download github.com/stretchr/testify v1.11.1"}, upstream.calls)
+}
+
+func TestMixedFetcher_Route(t *testing.T) {
+	masks := []string{
+		"gitlab.com",
+		"gitlab.com/team-a",
+		"gitlab.com/*/internal, git.corp.example",
+		"*.corp.example",
+		"gitlab.com",
+	}
+	mf := &gitlabgoproxy.MixedFetcher{}
+	for _, mask := range masks {
+		f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "http://127.0.0.1/api/v4", Mask: mask})
+		assert.NoError(t, err)
+		mf.Masks = append(mf.Masks, f.(*gitlabgoproxy.GitlabFetcher))
+	}
+
+	for _, c := range []struct {
+		path     string
+		expected int // index of the mask, -1 means upstream
+	}{
+		{"gitlab.com", 0},
+		{"gitlab.com/wongidle/foobar", 0},
+		{"gitlab.com.evil/x", -1},
+		{"gitlab.community/x", -1},
+		{"gitlab.com/team-a", 1},
+		{"gitlab.com/team-a/svc/v2", 1},
+		{"gitlab.com/team-ab/svc", 0},
+		{"gitlab.com/team-b/internal/x", 2},
+		{"gitlab.com/team-a/internal", 2},
+		{"gitlab.com/team-a/internals", 1},
+		{"git.corp.example/x", 2},
+		{"go.corp.example/x", 3},
+		{"corp.example/x", -1},
+		{"github.com/stretchr/testify", -1},
+	} {
+		gf := mf.Route(c.path)
+		if c.expected < 0 {
+			assert.Nil(t, gf, c.path)
+			continue
+		}
+		assert.Same(t, mf.Masks[c.expected], gf, c.path)
+	}
+}
+
+type recordingFetcher struct {
+	calls []string
+}
+
+func (rf *recordingFetcher) Query(_ context.Context, path, query string) (string, time.Time, error) {
+	rf.calls = append(rf.calls, "Query "+path+" "+query)
+	return "", time.Time{}, fs.ErrNotExist
+}
+
+func (rf *recordingFetcher) List(_ context.Context, path string) ([]string, error) {
+	rf.calls = append(rf.calls, "List "+path)
+	return nil, fs.ErrNotExist
+}
+
+func (rf *recordingFetcher) Download(_ context.Context, path, version string) (io.ReadSeekCloser, io.ReadSeekCloser, io.ReadSeekCloser, error) {
+	rf.calls = append(rf.calls, "Download "+path+" "+version)
+	return nil, nil, nil, fs.ErrNotExist
+}
+
+// assertZip checks that zip is a valid module zip holding exactly files.
+func assertZip(t *testing.T, zip io.ReadSeekCloser, path, version string, files ...string) {
+	t.Helper()
+	f, ok := zip.(*gitlabgoproxy.SmartFile)
+	if !assert.True(t, ok) {
+		return
+	}
+	checked, err := modzip.CheckZip(module.Version{Path: path, Version: version}, f.Name())
+	assert.NoError(t, err)
+	want := make([]string, len(files))
+	for i, file := range files {
+		want[i] = path + "@" + version + "/" + file
+	}
+	assert.ElementsMatch(t, want, checked.Valid)
+}
+
+func TestGitlabFetcher_Info(t *testing.T) {
+	fetcher, _ := newFixtureFetcher(t)
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
@@ -154,12 +780,10 @@ func TestGitlabFetcher_Info(t *testing.T) {
 }
 
 func TestGitlabFetcher_GoMod(t *testing.T) {
-	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
-	assert.NoError(t, err)
-	fetcher := f.(*gitlabgoproxy.GitlabFetcher)
+	fetcher, _ := newFixtureFetcher(t)
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	reader, err := fetcher.SaveGoMod(ctx, ctx, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", Ref: "v0.2.0"})
+	reader, err := fetcher.SaveGoMod(ctx, ctx, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", Ref: "v0.2.0"}, "gitlab.com/wongidle/foobar")
 	assert.NoError(t, err)
 	data, err := io.ReadAll(reader)
 	assert.NoError(t, err)
@@ -167,4 +791,15 @@ func TestGitlabFetcher_GoMod(t *testing.T) {
 
 go 1.22.0
 `))
+
+	// no go.mod at the tag
+	reader, err = fetcher.SaveGoMod(ctx, ctx, &gitlabgoproxy.Locator{Repository: "wongidle/legacy", Ref: "v1.0.0"}, "gitlab.com/wongidle/legacy")
+	assert.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "module gitlab.com/wongidle/legacy\n", string(data))
+
+	// a go.mod declaring another module path
+	_, err = fetcher.SaveGoMod(ctx, ctx, &gitlabgoproxy.Locator{Repository: "wongidle/foobar", Ref: "v0.2.0"}, "gitlab.com/wongidle/foobar/v2")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
 }
@@ -1,42 +1,177 @@
 package gitlabgoproxy
 
 import (
-	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 
 	"github.com/xanzy/go-gitlab"
 )
 
 type GitlabHost struct {
-	conf   GitlabFetcherConfig
-	client *gitlab.Client
+	conf    GitlabFetcherConfig
+	client  *gitlab.Client
+	http    *http.Client // calls to the web UI, through the same transport as client
+	breaker *circuitBreaker
 }
 
 var _ GitLab = (*GitlabHost)(nil)
 
 func NewGitlabHost(conf GitlabFetcherConfig) (*GitlabHost, error) {
-	client, err := gitlab.NewClient(conf.AccessToken, gitlab.WithBaseURL(conf.Endpoint))
+	return newGitlabHost(conf, nil)
+}
+
+// newGitlabHost returns a GitlabHost using the circuit breaker of its host in bs.
+func newGitlabHost(conf GitlabFetcherConfig, bs *breakers) (*GitlabHost, error) {
+	opts := []gitlab.ClientOptionFunc{gitlab.WithBaseURL(conf.Endpoint)}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &metricsTransport{base: http.DefaultTransport, host: u.Host}
+	transport = &tracingTransport{base: transport, host: u.Host}
+	hc := &http.Client{Transport: transport}
+	opts = append(opts, gitlab.WithHTTPClient(hc))
+	client, err := gitlab.NewClient(conf.AccessToken, opts...)
 	if err != nil {
 		return nil, err
 	}
-	gh := &GitlabHost{client: client, conf: conf}
+	gh := &GitlabHost{client: client, conf: conf, http: hc, breaker: bs.host(u.Host, conf.CircuitBreaker)}
 	return gh, nil
 }
 
+// call runs a go-gitlab call, with its retries, as one request of the circuit breaker of the host. Calls failed
+// by an open circuit do not reach GitLab and are not recorded.
+func call[T any](gh *GitlabHost, f func() (T, *gitlab.Response, error)) (T, error) {
+	var ret T
+	err := gh.breaker.do(func() error {
+		var err error
+		ret, _, err = f()
+		return err
+	})
+	return ret, err
+}
+
 func (gh *GitlabHost) IsProject(ctx context.Context, repo string) (bool, error) {
-	_, _, err := gh.client.Projects.GetProject(repo, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+	_, err := call(gh, func() (*gitlab.Project, *gitlab.Response, error) {
+		return gh.client.Projects.GetProject(repo, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+	})
 	if err == nil {
 		return true, nil
 	}
-	er, ok := err.(*gitlab.ErrorResponse)
-	if ok && er.Response.StatusCode == http.StatusNotFound {
+	if isNotFound(err) {
 		return false, nil
 	}
 	return false, err
 }
 
+// TokenScopes returns the scopes of the access token, or an error if GitLab rejects it or it is not active.
+func (gh *GitlabHost) TokenScopes(ctx context.Context) ([]string, error) {
+	t, err := call(gh, func() (*gitlab.PersonalAccessToken, *gitlab.Response, error) {
+		return gh.client.PersonalAccessTokens.GetSinglePersonalAccessToken(gitlab.WithContext(ctx))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t.Revoked || !t.Active {
+		return nil, fmt.Errorf("access token %s is not active", t.Name)
+	}
+	return t.Scopes, nil
+}
+
+// ErrInvalidCredentials is returned by CanRead when GitLab does not accept the credentials at all.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// CanRead reports whether the credentials of a git client may clone repo, by asking for its refs over HTTP as
+// git does. Personal, project, group and deploy tokens are accepted, only deploy tokens need their username.
+// Credentials GitLab rejects return ErrInvalidCredentials.
+func (gh *GitlabHost) CanRead(ctx context.Context, repo, username, password string) (bool, error) {
+	u := webURL(gh.conf) + "/" + repo + ".git/info/refs?service=git-upload-pack"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+	if username == "" {
+		username = "gitlab-goproxy"
+	}
+	req.SetBasicAuth(username, password)
+	var resp *http.Response
+	err = gh.breaker.do(func() error {
+		if resp, err = gh.http.Do(req); err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return &gitlab.ErrorResponse{Response: resp, Message: resp.Status}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized:
+		return false, ErrInvalidCredentials
+	case http.StatusForbidden, http.StatusNotFound:
+		// GitLab does not tell apart a missing project and one the credentials cannot see
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: %s", u, resp.Status)
+}
+
+// isNotFound reports whether err is a 404 response from GitLab.
+func isNotFound(err error) bool {
+	if errors.Is(err, gitlab.ErrNotFound) {
+		return true
+	}
+	var er *gitlab.ErrorResponse
+	return errors.As(err, &er) && er.Response != nil && er.Response.StatusCode == http.StatusNotFound
+}
+
+// isUnavailable reports whether err means GitLab could not be reached or failed on its side: a network error,
+// a timeout, a 5xx response or an open circuit breaker.
+func isUnavailable(err error) bool {
+	var er *gitlab.ErrorResponse
+	var ue *url.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &er):
+		return er.Response != nil && er.Response.StatusCode >= http.StatusInternalServerError
+	default:
+		return errors.As(err, &ue)
+	}
+}
+
+// notExist marks GitLab 404 errors with fs.ErrNotExist, which goproxy serves as 404 instead of 500.
+func notExist(err error) error {
+	if isNotFound(err) && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+func (gh *GitlabHost) DefaultBranch(ctx context.Context, repo string) (string, error) {
+	p, err := call(gh, func() (*gitlab.Project, *gitlab.Response, error) {
+		return gh.client.Projects.GetProject(repo, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+	})
+	if err != nil {
+		return "", err
+	}
+	if p.DefaultBranch == "" {
+		return "", fmt.Errorf("project %s has no default branch", repo)
+	}
+	return p.DefaultBranch, nil
+}
+
 func (gh *GitlabHost) ListTags(ctx context.Context, repo string, prefix string) ([]*Info, error) {
 	o := "name"
 	s := "asc"
@@ -54,12 +189,14 @@ func (gh *GitlabHost) ListTags(ctx context.Context, repo string, prefix string)
 	ret := make([]*Info, 0)
 
 	for {
-		tags, _, err := gh.client.Tags.ListTags(repo, opt, gitlab.WithContext(ctx))
+		tags, err := call(gh, func() ([]*gitlab.Tag, *gitlab.Response, error) {
+			return gh.client.Tags.ListTags(repo, opt, gitlab.WithContext(ctx))
+		})
 		if err != nil {
 			return nil, err
 		}
 		for _, tag := range tags {
-			ret = append(ret, &Info{Version: tag.Name, Time: *tag.Commit.CreatedAt})
+			ret = append(ret, &Info{Version: tag.Name, Time: *tag.Commit.CreatedAt, Commit: tag.Commit.ID})
 		}
 		if len(tags) < 100 {
 			return ret, nil
@@ -69,33 +206,137 @@ func (gh *GitlabHost) ListTags(ctx context.Context, repo string, prefix string)
 }
 
 func (gh *GitlabHost) GetTag(ctx context.Context, repo, tag string) (*Info, error) {
-	t, _, err := gh.client.Tags.GetTag(repo, tag, gitlab.WithContext(ctx))
+	t, err := call(gh, func() (*gitlab.Tag, *gitlab.Response, error) {
+		return gh.client.Tags.GetTag(repo, tag, gitlab.WithContext(ctx))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Info{Version: t.Name, Time: *t.Commit.CreatedAt, Commit: t.Commit.ID}, nil
+}
+
+// GetCommit resolves a branch, tag or (short) commit hash to the commit it points to.
+// The returned Info carries the committer time, which is what pseudo-versions are built from.
+func (gh *GitlabHost) GetCommit(ctx context.Context, repo, ref string) (*Info, error) {
+	c, err := call(gh, func() (*gitlab.Commit, *gitlab.Response, error) {
+		return gh.client.Commits.GetCommit(repo, ref, nil, gitlab.WithContext(ctx))
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &Info{Version: t.Name, Time: *t.Commit.CreatedAt}, nil
+	t := c.CommittedDate
+	if t == nil {
+		t = c.CreatedAt
+	}
+	return &Info{Time: t.UTC(), Commit: c.ID}, nil
+}
+
+// IsAncestor reports whether commit ancestor is reachable from commit descendant.
+func (gh *GitlabHost) IsAncestor(ctx context.Context, repo, ancestor, descendant string) (bool, error) {
+	refs := []string{ancestor, descendant}
+	base, err := call(gh, func() (*gitlab.Commit, *gitlab.Response, error) {
+		return gh.client.Repositories.MergeBase(repo, &gitlab.MergeBaseOptions{Ref: &refs}, gitlab.WithContext(ctx))
+	})
+	if err != nil {
+		return false, err
+	}
+	return base.ID == ancestor, nil
 }
 
 func (gh *GitlabHost) GetFile(ctx context.Context, repo, path, ref string) ([]byte, error) {
 	opt := &gitlab.GetRawFileOptions{Ref: &ref}
-	data, _, err := gh.client.RepositoryFiles.GetRawFile(repo, path, opt, gitlab.WithContext(ctx))
-	return data, err
+	return call(gh, func() ([]byte, *gitlab.Response, error) {
+		return gh.client.RepositoryFiles.GetRawFile(repo, path, opt, gitlab.WithContext(ctx))
+	})
 }
 
-func (gh *GitlabHost) Download(ctx context.Context, repo, dir, ref string) (io.Reader, error) {
+// Download streams the zip archive of ref, restricted to dir when it is not empty, into w. The request is
+// canceled as soon as w fails, e.g. with ErrTooLarge, instead of reading the rest of the archive.
+func (gh *GitlabHost) Download(ctx context.Context, repo, dir, ref string, w io.Writer) error {
 	format := "zip"
 	opt := &gitlab.ArchiveOptions{Format: &format, SHA: &ref}
 	if dir != "" {
 		opt.Path = &dir
 	}
-	data, _, err := gh.client.Repositories.Archive(
-		repo,
-		opt,
-		gitlab.WithContext(ctx),
-	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return gh.breaker.do(func() error {
+		_, err := gh.client.Repositories.StreamArchive(
+			repo,
+			&cancelWriter{w: w, cancel: cancel},
+			opt,
+			gitlab.WithContext(ctx),
+		)
+		return err
+	})
+}
+
+// cancelWriter cancels a request once writing its response body fails: go-gitlab drains the body of every
+// response, which would otherwise download the whole archive anyway.
+type cancelWriter struct {
+	w      io.Writer
+	cancel context.CancelFunc
+}
+
+func (cw *cancelWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
 	if err != nil {
-		return nil, err
+		cw.cancel()
+	}
+	return n, err
+}
+
+// ListGroupProjects returns the paths of the projects in group and its subgroups, archived projects excluded.
+func (gh *GitlabHost) ListGroupProjects(ctx context.Context, group string) ([]string, error) {
+	opt := &gitlab.ListGroupProjectsOptions{
+		ListOptions:      gitlab.ListOptions{Page: 1, PerPage: 100},
+		Archived:         gitlab.Ptr(false),
+		IncludeSubGroups: gitlab.Ptr(true),
+		Simple:           gitlab.Ptr(true),
+	}
+
+	ret := make([]string, 0)
+	for {
+		projects, err := call(gh, func() ([]*gitlab.Project, *gitlab.Response, error) {
+			return gh.client.Groups.ListGroupProjects(group, opt, gitlab.WithContext(ctx))
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range projects {
+			ret = append(ret, p.PathWithNamespace)
+		}
+		if len(projects) < 100 {
+			return ret, nil
+		}
+		opt.ListOptions.Page += 1
+	}
+}
+
+// FindFiles returns the paths of the files named name in the tree of ref.
+func (gh *GitlabHost) FindFiles(ctx context.Context, repo, ref, name string) ([]string, error) {
+	opt := &gitlab.ListTreeOptions{
+		ListOptions: gitlab.ListOptions{Page: 1, PerPage: 100},
+		Ref:         &ref,
+		Recursive:   gitlab.Ptr(true),
+	}
+
+	ret := make([]string, 0)
+	for {
+		nodes, err := call(gh, func() ([]*gitlab.TreeNode, *gitlab.Response, error) {
+			return gh.client.Repositories.ListTree(repo, opt, gitlab.WithContext(ctx))
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodes {
+			if n.Type == "blob" && n.Name == name {
+				ret = append(ret, n.Path)
+			}
+		}
+		if len(nodes) < 100 {
+			return ret, nil
+		}
+		opt.ListOptions.Page += 1
 	}
-	buf := bytes.NewReader(data)
-	return buf, nil
 }
@@ -1,10 +1,13 @@
 package gitlabgoproxy_test
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	"io"
-	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -13,46 +16,168 @@ import (
 )
 
 func TestGitHost(t *testing.T) {
-	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
+	fg := newFixtureGitLab(t)
+	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint()})
 	assert.NoError(t, err)
 	tags, err := git.ListTags(context.Background(), "WhyNotHugo/darkman", "v1")
 	assert.NoError(t, err)
-
+	versions := make([]string, 0, len(tags))
 	for _, tag := range tags {
-		log.Println(tag)
+		versions = append(versions, tag.Version)
 	}
+	assert.EqualValues(t, []string{"v1.5.3", "v1.5.4"}, versions)
 
-	_, err = git.GetTag(context.Background(), "WhyNotHugo/darkman", "v1.5.4")
+	tag, err := git.GetTag(context.Background(), "WhyNotHugo/darkman", "v1.5.4")
 	assert.NoError(t, err)
+	assert.EqualValues(t, "v1.5.4", tag.Version)
+	assert.NotEmpty(t, tag.Commit)
 
 	data, err := git.GetFile(context.Background(), "wongidle/mutiples", "pkg/str/go.mod", "pkg/str/v2.0.2")
 	assert.NoError(t, err)
-	log.Println(string(data))
+	assert.EqualValues(t, "module gitlab.com/wongidle/mutiples/pkg/str/v2\n\ngo 1.22.0\n", string(data))
+
+	_, err = git.GetFile(context.Background(), "wongidle/mutiples", "pkg/str/go.mod", "v2.0.1")
+	assert.Error(t, err)
 }
 
 func TestGitHostIsProject(t *testing.T) {
-	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
+	fg := newFixtureGitLab(t)
+	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint()})
 	assert.NoError(t, err)
 	exists, err := git.IsProject(context.Background(), "wongidle/mutiples")
 	assert.NoError(t, err)
-	log.Println(exists)
+	assert.True(t, exists)
+
+	exists, err = git.IsProject(context.Background(), "wongidle/nothing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = git.IsProject(context.Background(), "group/sub/nested")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestGitHostCommit(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint()})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	head, err := git.GetCommit(ctx, "wongidle/foobar", "main")
+	assert.NoError(t, err)
+	assert.True(t, mainTime.Equal(head.Time))
+
+	short, err := git.GetCommit(ctx, "wongidle/foobar", head.Commit[:12])
+	assert.NoError(t, err)
+	assert.EqualValues(t, head.Commit, short.Commit)
+
+	tag, err := git.GetTag(ctx, "wongidle/foobar", "v0.1.0")
+	assert.NoError(t, err)
+	ok, err := git.IsAncestor(ctx, "wongidle/foobar", tag.Commit, head.Commit)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = git.IsAncestor(ctx, "wongidle/foobar", head.Commit, tag.Commit)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	branch, err := git.DefaultBranch(ctx, "wongidle/foobar")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "main", branch)
 }
 
 func TestDownload(t *testing.T) {
-	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: "https://gitlab.com/api/v4"})
+	fg := newFixtureGitLab(t)
+	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint()})
 	assert.NoError(t, err)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	reader, err := git.Download(ctx, "wongidle/mutiples", "pkg/str", "pkg/str/v2.0.2")
+	fp := filepath.Join(t.TempDir(), "temp.zip")
+	file, err := os.Create(fp)
 	assert.NoError(t, err)
+	defer file.Close()
 
-	file, err := os.Create("temp.zip")
+	err = git.Download(ctx, "wongidle/mutiples", "pkg/str", "pkg/str/v2.0.2", file)
 	assert.NoError(t, err)
 
-	defer os.Remove("temp.zip")
-	defer file.Close()
+	zr, err := zip.OpenReader(fp)
+	assert.NoError(t, err)
+	defer zr.Close()
+	names := make([]string, 0, len(zr.File))
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.Len(t, names, 3)
+	assert.Contains(t, names[1], "/pkg/str/go.mod")
+}
 
-	_, err = io.Copy(file, reader)
+func TestGitHostFaults(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint()})
 	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// rate limited once, the client retries
+	fg.Inject(fault{Path: "/repository/tags/v2.0.2", Status: http.StatusTooManyRequests, Times: 1})
+	_, err = git.GetTag(ctx, "wongidle/mutiples", "v2.0.2")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, fg.Calls("/repository/tags/v2.0.2"))
+
+	// unauthorized
+	fg.Inject(fault{Path: "/repository/tags/v2.0.1", Status: http.StatusUnauthorized, Times: 1})
+	_, err = git.GetTag(ctx, "wongidle/mutiples", "v2.0.1")
+	assert.Error(t, err)
+
+	// not found
+	_, err = git.GetTag(ctx, "wongidle/mutiples", "v9.9.9")
+	assert.Error(t, err)
+
+	// truncated archive
+	fg.Inject(fault{Path: "/repository/archive", Truncate: true, Times: 1})
+	buf := new(bytes.Buffer)
+	err = git.Download(ctx, "wongidle/foobar", "", "v0.2.0", buf)
+	if err == nil {
+		_, err = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	}
+	assert.Error(t, err)
+
+	// slow response
+	fg.Inject(fault{Path: "/repository/archive", Delay: 2 * time.Second, Times: 1})
+	timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	err = git.Download(timeout, "wongidle/foobar", "", "v0.2.0", io.Discard)
+	assert.Error(t, err)
+
+	// token required
+	fg.RequireToken("secret")
+	_, err = git.IsProject(ctx, "wongidle/foobar")
+	assert.Error(t, err)
+	authed, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint(), AccessToken: "secret"})
+	assert.NoError(t, err)
+	exists, err := authed.IsProject(ctx, "wongidle/foobar")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestGitHostCircuitBreaker(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	git, err := gitlabgoproxy.NewGitlabHost(gitlabgoproxy.GitlabFetcherConfig{Endpoint: fg.Endpoint()})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// the retries of a call count once: five failed attempts do not open the breaker nor stop the retries
+	fg.Inject(fault{Path: "/repository/tags/v2.0.2", Status: http.StatusServiceUnavailable, Times: 5})
+	_, err = git.GetTag(ctx, "wongidle/mutiples", "v2.0.2")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 6, fg.Calls("/repository/tags/v2.0.2"))
+
+	// five failed calls do
+	for range 5 {
+		_, err = git.GetTag(fg.Unavailable(t), "wongidle/mutiples", "v2.0.2")
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, gitlabgoproxy.ErrCircuitOpen)
+	}
+	_, err = git.GetTag(ctx, "wongidle/mutiples", "v2.0.2")
+	assert.ErrorIs(t, err, gitlabgoproxy.ErrCircuitOpen)
+	assert.EqualValues(t, 11, fg.Calls("/repository/tags/v2.0.2"))
 }
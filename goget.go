@@ -0,0 +1,124 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-jimu/components/sloghelper"
+)
+
+type (
+	// GoImport describes the repository of an import path, see https://go.dev/ref/mod#vcs-find
+	GoImport struct {
+		Prefix  string // import path of the repository root, e.g. gitlab.com/group/sub/project
+		Project string // GitLab project path
+		RepoURL string // git clone URL
+		WebURL  string // project home page
+		Branch  string // default branch, used by the go-source templates
+	}
+
+	// GoGetHandler answers ?go-get=1 requests for masked paths with go-import and go-source meta tags
+	// and hands every other request to Next.
+	GoGetHandler struct {
+		Fetcher *MixedFetcher
+		Next    http.Handler
+	}
+)
+
+var goGetTemplate = template.Must(template.New("go-get").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="{{.Prefix}} git {{.RepoURL}}">
+<meta name="go-source" content="{{.Prefix}} {{.WebURL}} {{.WebURL}}/-/tree/{{.Branch}}{/dir} {{.WebURL}}/-/blob/{{.Branch}}{/dir}/{file}#L{line}">
+</head>
+<body>
+go get {{.Prefix}}
+</body>
+</html>
+`))
+
+// GoImport resolves the GitLab project of an import path the same way as ExtractSubPath, e.g.
+//
+//	gitlab.com/wongidle/mutiples/pkg/str/v2 -> gitlab.com/wongidle/mutiples git https://gitlab.com/wongidle/mutiples.git
+func (gf *GitlabFetcher) GoImport(ctx context.Context, path string) (*GoImport, error) {
+	repo, subs, verPrefix, err := gf.ExtractSubPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	branch, err := gf.gitlab.DefaultBranch(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	// the segments below the project are kept as is by the rewrite rules
+	ps := strings.Split(path, "/")
+	below := len(subs)
+	if verPrefix != "" {
+		below++
+	}
+	web := gf.webURL() + "/" + repo
+	return &GoImport{
+		Prefix:  strings.Join(ps[:len(ps)-below], "/"),
+		Project: repo,
+		RepoURL: web + ".git",
+		WebURL:  web,
+		Branch:  branch,
+	}, nil
+}
+
+// webURL returns the address of the GitLab web UI of the mask, see webURL.
+func (gf *GitlabFetcher) webURL() string {
+	return webURL(gf.config)
+}
+
+// webURL returns the address of the GitLab web UI, WebURL or Endpoint without the API path.
+func webURL(conf GitlabFetcherConfig) string {
+	if conf.WebURL != "" {
+		return strings.TrimSuffix(conf.WebURL, "/")
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(conf.Endpoint, "/"), "/api/v4")
+}
+
+func (h *GoGetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isGoGet(r) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	path := goGetPath(r)
+
+	gf := h.Fetcher.Route(path)
+	if gf == nil {
+		http.Error(w, "not found: "+path, http.StatusNotFound)
+		return
+	}
+
+	imp, err := gf.GoImport(r.Context(), path)
+	if err != nil {
+		slog.Warn("failed to resolve go-get request", slog.String("path", path), sloghelper.Error(err))
+		http.Error(w, "not found: "+path, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = goGetTemplate.Execute(w, imp); err != nil {
+		slog.Warn("failed to write go-get response", slog.String("path", path), sloghelper.Error(err))
+	}
+}
+
+// isGoGet reports whether r is the ?go-get=1 request of the go command resolving an import path.
+func isGoGet(r *http.Request) bool {
+	return r.URL.Query().Get("go-get") == "1" && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// goGetPath returns the import path of a go-get request, its host without port followed by its path.
+func goGetPath(r *http.Request) string {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return host + strings.TrimSuffix(r.URL.Path, "/")
+}
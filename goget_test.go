@@ -0,0 +1,93 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitlabFetcher_GoImport(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	ctx := context.Background()
+	web := strings.TrimSuffix(fg.Endpoint(), "/api/v4")
+
+	for _, c := range []struct {
+		path, prefix, project string
+	}{
+		{"gitlab.com/wongidle/foobar", "gitlab.com/wongidle/foobar", "wongidle/foobar"},
+		{"gitlab.com/wongidle/foobar/internal/pkg", "gitlab.com/wongidle/foobar", "wongidle/foobar"},
+		{"gitlab.com/wongidle/mutiples/pkg/str/v2", "gitlab.com/wongidle/mutiples", "wongidle/mutiples"},
+		{"gitlab.com/group/sub/nested", "gitlab.com/group/sub/nested", "group/sub/nested"},
+	} {
+		imp, err := fetcher.GoImport(ctx, c.path)
+		assert.NoError(t, err, c.path)
+		assert.EqualValues(t, &gitlabgoproxy.GoImport{
+			Prefix:  c.prefix,
+			Project: c.project,
+			RepoURL: web + "/" + c.project + ".git",
+			WebURL:  web + "/" + c.project,
+			Branch:  "main",
+		}, imp, c.path)
+	}
+
+	_, err := fetcher.GoImport(ctx, "gitlab.com/wongidle/nothing")
+	assert.Error(t, err)
+
+	// vanity paths keep the vanity prefix
+	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "go.corp.example", WebURL: "https://gitlab.corp.internal/",
+		Rewrites: []gitlabgoproxy.RewriteRule{{Prefix: "go.corp.example", Namespace: "backend"}}})
+	assert.NoError(t, err)
+	imp, err := f.(*gitlabgoproxy.GitlabFetcher).GoImport(ctx, "go.corp.example/payments/ledger/api")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "go.corp.example/payments/ledger", imp.Prefix)
+	assert.EqualValues(t, "https://gitlab.corp.internal/backend/payments/ledger.git", imp.RepoURL)
+}
+
+func TestGoGetHandler(t *testing.T) {
+	fetcher, fg := newFixtureFetcher(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	web := strings.TrimSuffix(fg.Endpoint(), "/api/v4")
+	srv := httptest.NewServer(&gitlabgoproxy.GoGetHandler{Fetcher: &gitlabgoproxy.MixedFetcher{Masks: []*gitlabgoproxy.GitlabFetcher{fetcher}}, Next: next})
+	defer srv.Close()
+
+	get := func(host, target string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+target, nil)
+		assert.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	code, body := get("gitlab.com", "/group/sub/nested/pkg?go-get=1")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Contains(t, body, `<meta name="go-import" content="gitlab.com/group/sub/nested git `+web+`/group/sub/nested.git">`)
+	assert.Contains(t, body, `<meta name="go-source" content="gitlab.com/group/sub/nested `+web+`/group/sub/nested `+
+		web+`/group/sub/nested/-/tree/main{/dir} `+web+`/group/sub/nested/-/blob/main{/dir}/{file}#L{line}">`)
+
+	// unknown project
+	code, _ = get("gitlab.com", "/wongidle/nothing?go-get=1")
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// not masked
+	code, _ = get("github.com", "/foo/bar?go-get=1")
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// GOPROXY protocol requests are passed through
+	code, _ = get("gitlab.com", "/gitlab.com/wongidle/foobar/@v/list")
+	assert.EqualValues(t, http.StatusTeapot, code)
+}
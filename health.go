@@ -0,0 +1,215 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jimu/components/sloghelper"
+)
+
+type (
+	// HealthHandler serves the probes of an orchestrator and hands every other request to Next. HealthzPath
+	// answers as long as the process serves requests, ReadyzPath checks the dependencies of the proxy:
+	//
+	//   - the access token of each mask is accepted by GitLab and has the api or read_api scope
+	//   - each cache tier can be written to, which for s3 means reaching the bucket
+	//   - each upstream proxy answers, "direct" is not checked
+	//
+	// The result of the checks is kept for TTL so that frequent probes do not load GitLab. It is served as JSON,
+	// with status 503 if a check failed. The checks name the masks, cache tiers and upstreams and carry the
+	// errors of GitLab and S3, so they are left out unless ShowChecks is set or the client sends Token as bearer
+	// token.
+	HealthHandler struct {
+		Fetcher    *MixedFetcher
+		Cache      *TieredCache
+		TTL        time.Duration // 0 means DefaultReadyTTL
+		Token      string        // bearer token required to get the checks, empty means they are never served
+		ShowChecks bool          // serve the checks to every client, e.g. on a private metrics address
+		Next       http.Handler
+
+		mu        sync.Mutex
+		readiness *Readiness
+	}
+
+	// Readiness is the response of ReadyzPath.
+	Readiness struct {
+		Ready     bool         `json:"ready"`
+		CheckedAt time.Time    `json:"checked_at"`
+		Checks    []ReadyCheck `json:"checks"`
+	}
+
+	// ReadyCheck is the result of checking a dependency.
+	ReadyCheck struct {
+		Name       string `json:"name"` // "gitlab <mask>", "cache <tier>" or "upstream <url>"
+		OK         bool   `json:"ok"`
+		Error      string `json:"error,omitempty"`
+		DurationMS int64  `json:"duration_ms"`
+	}
+
+	readyProbe struct {
+		name  string
+		check func(context.Context) error
+	}
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+
+	DefaultReadyTTL = 10 * time.Second
+	// readyTimeout bounds each check, a dependency that does not answer in time is not ready
+	readyTimeout = 5 * time.Second
+	// readyProbeName is the cache entry written to check the cache tiers, module paths do not start with a dash
+	readyProbeName = "-/readyz"
+)
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case HealthzPath:
+		writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+	case ReadyzPath:
+		readiness := h.Ready(r.Context())
+		status := http.StatusOK
+		if !readiness.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		if !h.ShowChecks && (h.Token == "" || !bearerAuthorized(r, h.Token)) {
+			writeHealth(w, status, map[string]bool{"ready": readiness.Ready})
+			return
+		}
+		writeHealth(w, status, readiness)
+	default:
+		h.Next.ServeHTTP(w, r)
+	}
+}
+
+// Ready returns the result of the last checks, or checks the dependencies again if it is older than TTL.
+// Concurrent callers wait for the same checks.
+func (h *HealthHandler) Ready(ctx context.Context) Readiness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ttl := h.TTL
+	if ttl == 0 {
+		ttl = DefaultReadyTTL
+	}
+	if h.readiness != nil && time.Since(h.readiness.CheckedAt) < ttl {
+		return *h.readiness
+	}
+
+	// a probe canceled by its client still refreshes the result for the next ones
+	ctx = context.WithoutCancel(ctx)
+	probes := h.probes()
+	readiness := &Readiness{Ready: true, CheckedAt: time.Now(), Checks: make([]ReadyCheck, len(probes))}
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+			defer cancel()
+			start := time.Now()
+			err := p.check(pCtx)
+			readiness.Checks[i] = ReadyCheck{Name: p.name, OK: err == nil, DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				readiness.Checks[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, c := range readiness.Checks {
+		if !c.OK {
+			readiness.Ready = false
+			slog.Warn("readiness check failed", slog.String("check", c.Name), slog.String("error", c.Error))
+		}
+	}
+	h.readiness = readiness
+	return *readiness
+}
+
+func (h *HealthHandler) probes() []readyProbe {
+	var ret []readyProbe
+	if h.Fetcher != nil {
+		for _, gf := range h.Fetcher.masks() {
+			ret = append(ret, readyProbe{name: "gitlab " + gf.routeName(), check: gf.checkToken})
+		}
+	}
+	if h.Cache != nil {
+		for _, t := range h.Cache.tiers {
+			ret = append(ret, readyProbe{name: "cache " + t.name, check: t.check})
+		}
+	}
+	if h.Fetcher != nil {
+		if us, ok := h.Fetcher.Upstream.(*Upstreams); ok {
+			for _, u := range us.upstreams {
+				if u.probe != nil {
+					ret = append(ret, readyProbe{name: "upstream " + u.name, check: u.probe})
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// checkToken makes sure that GitLab accepts the access token of the mask and that it can read the API.
+// Without an access token only public projects are served, there is nothing to check.
+func (gf *GitlabFetcher) checkToken(ctx context.Context) error {
+	if gf.config.AccessToken == "" {
+		return nil
+	}
+	scopes, err := gf.gitlab.TokenScopes(ctx)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(scopes, "api") && !slices.Contains(scopes, "read_api") {
+		return fmt.Errorf("access token lacks the api or read_api scope, it has %s", strings.Join(scopes, ","))
+	}
+	return nil
+}
+
+// check writes readyProbeName to the tier and removes it again.
+func (t *cacheTier) check(ctx context.Context) error {
+	if err := t.cacher.Put(ctx, readyProbeName, strings.NewReader(time.Now().UTC().Format(time.RFC3339))); err != nil {
+		return err
+	}
+	if ca, ok := t.cacher.(CacheAdmin); ok {
+		return ca.Delete(ctx, readyProbeName)
+	}
+	return nil
+}
+
+// newUpstreamProbe returns a check that the proxy at base answers with anything but a server error.
+func newUpstreamProbe(base string, transport http.RoundTripper) func(context.Context) error {
+	client := &http.Client{Transport: transport}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write health response", sloghelper.Error(err))
+	}
+}
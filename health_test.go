@@ -0,0 +1,116 @@
+package gitlabgoproxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	fg.RequireToken("service-token")
+	fg.AddToken("narrow-token", "read_repository")
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer proxy.Close()
+	conf := gitlabgoproxy.Config{
+		Upstream: gitlabgoproxy.UpstreamConfig{Proxies: []gitlabgoproxy.UpstreamProxy{{URL: proxy.URL}, {URL: "direct"}}},
+		Masks:    []gitlabgoproxy.GitlabFetcherConfig{{Endpoint: fg.Endpoint(), Mask: "gitlab.com", AccessToken: "service-token"}},
+		Cache:    gitlabgoproxy.CacheConfig{Tiers: []gitlabgoproxy.CacheTierConfig{{Type: "memory"}, {Type: "dir", Dir: t.TempDir()}}},
+	}
+	fetcher, err := gitlabgoproxy.NewMixedFetcher(conf)
+	assert.NoError(t, err)
+	cache, err := gitlabgoproxy.NewCache(conf)
+	assert.NoError(t, err)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	srv := httptest.NewServer(&gitlabgoproxy.HealthHandler{Fetcher: fetcher, Cache: cache, TTL: time.Hour, Token: "health-token", Next: next})
+	defer srv.Close()
+	uncached := httptest.NewServer(&gitlabgoproxy.HealthHandler{Fetcher: fetcher, Cache: cache, TTL: time.Nanosecond, ShowChecks: true, Next: next})
+	defer uncached.Close()
+
+	get := func(srv *httptest.Server, path string) (int, gitlabgoproxy.Readiness) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer health-token")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var readiness gitlabgoproxy.Readiness
+		if resp.StatusCode != http.StatusTeapot {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&readiness))
+		}
+		return resp.StatusCode, readiness
+	}
+
+	status, _ := get(srv, gitlabgoproxy.HealthzPath)
+	assert.EqualValues(t, http.StatusOK, status)
+	status, _ = get(srv, "/gitlab.com/wongidle/foobar/@v/list")
+	assert.EqualValues(t, http.StatusTeapot, status)
+
+	status, readiness := get(srv, gitlabgoproxy.ReadyzPath)
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.True(t, readiness.Ready)
+	var names []string
+	for _, c := range readiness.Checks {
+		names = append(names, c.Name)
+		assert.True(t, c.OK, c.Name)
+	}
+	assert.EqualValues(t, []string{"gitlab gitlab.com", "cache memory", "cache dir:" + conf.Cache.Tiers[1].Dir, "upstream " + proxy.URL}, names)
+	entries, err := cache.Entries(t.Context(), "-/")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// without the token only the readiness is served
+	for _, token := range []string{"", "wrong-token"} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+gitlabgoproxy.ReadyzPath, nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		resp.Body.Close()
+		assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+		assert.EqualValues(t, map[string]any{"ready": true}, body)
+	}
+
+	// the result is kept for TTL
+	calls := fg.Calls("personal_access_tokens")
+	proxy.Close()
+	status, _ = get(srv, gitlabgoproxy.ReadyzPath)
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.EqualValues(t, calls, fg.Calls("personal_access_tokens"))
+
+	// a token without API scope and an unreachable upstream are not ready
+	conf.Masks[0].AccessToken = "narrow-token"
+	assert.NoError(t, fetcher.Reload(conf))
+	status, readiness = get(uncached, gitlabgoproxy.ReadyzPath)
+	assert.EqualValues(t, http.StatusServiceUnavailable, status)
+	assert.False(t, readiness.Ready)
+	failed := make(map[string]string)
+	for _, c := range readiness.Checks {
+		if !c.OK {
+			failed[c.Name] = c.Error
+		}
+	}
+	assert.Len(t, failed, 2)
+	assert.Contains(t, failed["gitlab gitlab.com"], "read_api")
+	assert.Contains(t, failed, "upstream "+proxy.URL)
+
+	// a rejected token is not ready
+	conf.Masks[0].AccessToken = "revoked-token"
+	assert.NoError(t, fetcher.Reload(conf))
+	_, readiness = get(uncached, gitlabgoproxy.ReadyzPath)
+	assert.False(t, readiness.Checks[0].OK)
+	assert.Contains(t, readiness.Checks[0].Error, "401")
+}
@@ -2,16 +2,22 @@ package gitlabgoproxy
 
 import (
 	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	az "archive/zip"
 )
 
+// ErrTooLarge is returned when an archive or its extracted content exceeds the configured size limit.
+var ErrTooLarge = errors.New("archive exceeds the size limit")
+
 type SmartFile struct {
 	*os.File
 	Ctx    context.Context
@@ -20,6 +26,9 @@ type SmartFile struct {
 
 var _ io.ReadSeekCloser = (*SmartFile)(nil)
 
+// tempFiles holds the names of the SmartFiles that are not closed yet, see RemoveTempFiles.
+var tempFiles sync.Map
+
 func Save(ctx context.Context, input io.Reader) (io.ReadSeekCloser, int64, error) {
 	file, err := os.CreateTemp(os.TempDir(), "gitlab-*")
 	if err != nil {
@@ -37,6 +46,7 @@ func Save(ctx context.Context, input io.Reader) (io.ReadSeekCloser, int64, error
 		return nil, 0, err
 	}
 	cf := &SmartFile{File: f2, Ctx: ctx}
+	tempFiles.Store(cf.Name(), struct{}{})
 	go cf.run()
 	return cf, size, nil
 }
@@ -47,6 +57,7 @@ func Create(ctx context.Context) (*SmartFile, error) {
 		return nil, err
 	}
 	cf := &SmartFile{File: file, Ctx: ctx}
+	tempFiles.Store(cf.Name(), struct{}{})
 	go cf.run()
 	return cf, nil
 }
@@ -55,6 +66,7 @@ func (cf *SmartFile) Close() error {
 	defer func() {
 		if atomic.CompareAndSwapInt32(&cf.closed, 0, 1) {
 			os.Remove(cf.File.Name())
+			tempFiles.Delete(cf.File.Name())
 		}
 	}()
 	err := cf.File.Close()
@@ -68,7 +80,43 @@ func (cf *SmartFile) run() {
 	cf.Close()
 }
 
-func UnzipArchiveFromGitlab(workspace string, depth int, archive string) error {
+// RemoveTempFiles removes the files of the SmartFiles that are not closed yet and returns how many there were.
+// It is meant for shutdown, once nothing reads them anymore: a SmartFile is removed when its context is done,
+// but not if the process exits first.
+func RemoveTempFiles() int {
+	n := 0
+	tempFiles.Range(func(name, _ any) bool {
+		if err := os.Remove(name.(string)); err == nil || errors.Is(err, fs.ErrNotExist) {
+			tempFiles.Delete(name)
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+// LimitWriter returns a Writer that writes to w but fails with ErrTooLarge once more than n bytes are written.
+func LimitWriter(w io.Writer, n int64) io.Writer {
+	return &limitedWriter{w: w, n: n}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.n {
+		return 0, ErrTooLarge
+	}
+	n, err := lw.w.Write(p)
+	lw.n -= int64(n)
+	return n, err
+}
+
+// UnzipArchiveFromGitlab extracts archive into workspace, dropping the top-level directory GitLab adds
+// plus depth more path segments. It fails with ErrTooLarge once more than maxSize bytes are extracted.
+func UnzipArchiveFromGitlab(workspace string, depth int, archive string, maxSize int64) error {
 	reader, err := az.OpenReader(archive)
 	if err != nil {
 		return err
@@ -116,12 +164,15 @@ func UnzipArchiveFromGitlab(workspace string, depth int, archive string) error {
 			dst.Close()
 			return err
 		}
-		_, err = io.Copy(dst, src)
+		n, err := io.Copy(dst, io.LimitReader(src, maxSize+1))
 		src.Close()
 		dst.Close()
 		if err != nil {
 			return err
 		}
+		if maxSize -= n; maxSize < 0 {
+			return ErrTooLarge
+		}
 	}
 	return nil
 }
@@ -3,6 +3,8 @@ package gitlabgoproxy_test
 import (
 	"bytes"
 	"context"
+	"io/fs"
+	"os"
 	"testing"
 	"time"
 
@@ -19,3 +21,12 @@ func TestAutoClean(t *testing.T) {
 	time.Sleep(5 * time.Second)
 	reader.Close()
 }
+
+func TestRemoveTempFiles(t *testing.T) {
+	f, err := gitlabgoproxy.Create(context.Background())
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.GreaterOrEqual(t, gitlabgoproxy.RemoveTempFiles(), 1)
+	_, err = os.Stat(f.Name())
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,207 @@
+package gitlabgoproxy
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+)
+
+type (
+	// LookupCacheConfig bounds the cache of project and submodule lookups done while resolving module paths.
+	LookupCacheConfig struct {
+		Size        int           `json:"size" yaml:"size" toml:"size"`                         // max entries, 0 means 4096, negative disables the cache
+		TTL         time.Duration `json:"ttl" yaml:"ttl" toml:"ttl"`                            // lifetime of positive results, 0 means 10m
+		NegativeTTL time.Duration `json:"negative_ttl" yaml:"negative_ttl" toml:"negative_ttl"` // lifetime of negative results, 0 means 1m
+	}
+
+	// LookupStats is a snapshot of the lookup cache counters.
+	LookupStats struct {
+		Hits      uint64
+		Misses    uint64
+		Evictions uint64
+		Entries   int
+	}
+
+	lookupCache struct {
+		mu          sync.Mutex
+		size        int
+		ttl         time.Duration
+		negativeTTL time.Duration
+		ll          *list.List
+		entries     map[string]*list.Element
+		stats       LookupStats
+	}
+
+	lookupEntry struct {
+		key     string
+		ok      bool
+		expires time.Time
+	}
+)
+
+func newLookupCache(conf LookupCacheConfig) *lookupCache {
+	if conf.Size < 0 {
+		return nil
+	}
+	lc := &lookupCache{size: conf.Size, ttl: conf.TTL, negativeTTL: conf.NegativeTTL, ll: list.New(), entries: make(map[string]*list.Element)}
+	if lc.size == 0 {
+		lc.size = 4096
+	}
+	if lc.ttl == 0 {
+		lc.ttl = 10 * time.Minute
+	}
+	if lc.negativeTTL == 0 {
+		lc.negativeTTL = time.Minute
+	}
+	return lc
+}
+
+// lookup returns the cached result of key, calling fn on a miss. Errors are not cached.
+// A nil cache always calls fn.
+func (lc *lookupCache) lookup(key string, fn func() (bool, error)) (bool, error) {
+	if ok, found := lc.get(key); found {
+		return ok, nil
+	}
+	ok, err := fn()
+	if err != nil {
+		return ok, err
+	}
+	lc.store(key, ok)
+	return ok, nil
+}
+
+// get returns the cached result of key, found is false on a miss.
+func (lc *lookupCache) get(key string) (ok, found bool) {
+	if lc == nil {
+		return false, false
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if el, exists := lc.entries[key]; exists {
+		e := el.Value.(*lookupEntry)
+		if time.Now().Before(e.expires) {
+			lc.ll.MoveToFront(el)
+			lc.stats.Hits++
+			return e.ok, true
+		}
+		lc.remove(el)
+	}
+	lc.stats.Misses++
+	return false, false
+}
+
+// store caches the result of key for the TTL, or the negative TTL if ok is false.
+func (lc *lookupCache) store(key string, ok bool) {
+	if lc == nil {
+		return
+	}
+	ttl := lc.ttl
+	if !ok {
+		ttl = lc.negativeTTL
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if el, exists := lc.entries[key]; exists {
+		lc.remove(el)
+	}
+	lc.entries[key] = lc.ll.PushFront(&lookupEntry{key: key, ok: ok, expires: time.Now().Add(ttl)})
+	for lc.ll.Len() > lc.size {
+		lc.remove(lc.ll.Back())
+		lc.stats.Evictions++
+	}
+}
+
+func (lc *lookupCache) remove(el *list.Element) {
+	lc.ll.Remove(el)
+	delete(lc.entries, el.Value.(*lookupEntry).key)
+}
+
+// invalidate drops every entry whose key is matched.
+func (lc *lookupCache) invalidate(match func(key string) bool) int {
+	if lc == nil {
+		return 0
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	n := 0
+	for key, el := range lc.entries {
+		if match(key) {
+			lc.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+func (lc *lookupCache) snapshot() LookupStats {
+	if lc == nil {
+		return LookupStats{}
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	stats := lc.stats
+	stats.Entries = lc.ll.Len()
+	return stats
+}
+
+// isProject reports whether repo is a GitLab project, consulting the lookup cache first.
+func (gf *GitlabFetcher) isProject(ctx context.Context, repo string) (bool, error) {
+	return gf.lookups.lookup("project:"+repo, func() (bool, error) {
+		return gf.gitlab.IsProject(ctx, repo)
+	})
+}
+
+// hasGoMod reports whether subPath of repo holds a go.mod at ref, consulting the lookup cache first. The answer
+// is cached by ref, which must be a tag or a commit rather than a branch.
+func (gf *GitlabFetcher) hasGoMod(ctx context.Context, repo, subPath, ref string) (bool, error) {
+	return gf.lookups.lookup("gomod:"+repo+":"+ref+":"+subPath, func() (bool, error) {
+		_, err := gf.gitlab.GetFile(ctx, repo, path.Join(subPath, "go.mod"), ref)
+		if isNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// isIncompatible reports whether tag, a v2+ tag of a module whose path modPath has no major version suffix,
+// can be served as +incompatible: its go.mod is missing or declares modPath without the suffix. Like the go
+// command, only the module at the root of the repository can be +incompatible, never one in a subdirectory.
+func (gf *GitlabFetcher) isIncompatible(ctx context.Context, repo, tag, modPath string) (bool, error) {
+	if strings.Contains(tag, "/") {
+		return false, nil
+	}
+	return gf.lookups.lookup("incompatible:"+repo+":"+tag+":"+modPath, func() (bool, error) {
+		data, err := gf.gitlab.GetFile(ctx, repo, "go.mod", tag)
+		if isNotFound(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return modfile.ModulePath(data) == modPath, nil
+	})
+}
+
+// Invalidate drops the cached lookups of project and the projects below it, or of every project
+// when project is empty, e.g. after a project has been created, renamed or transferred.
+func (gf *GitlabFetcher) Invalidate(project string) {
+	n := gf.lookups.invalidate(func(key string) bool {
+		if project == "" {
+			return true
+		}
+		_, repo, _ := strings.Cut(key, ":")
+		return repo == project || strings.HasPrefix(repo, project+"/") || strings.HasPrefix(repo, project+":")
+	})
+	slog.Info("invalidated cached lookups", slog.String("project", project), slog.Int("entries", n))
+}
+
+// LookupStats returns the counters of the project and submodule lookup cache.
+func (gf *GitlabFetcher) LookupStats() LookupStats {
+	return gf.lookups.snapshot()
+}
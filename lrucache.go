@@ -0,0 +1,337 @@
+package gitlabgoproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy"
+)
+
+type (
+	// MemoryCache keeps the most recently used files in memory, up to a total size.
+	MemoryCache struct {
+		mu  sync.Mutex
+		lru *lru
+	}
+
+	// DirCache keeps files below a local directory, evicting the least recently used ones once the total
+	// size exceeds its limit. Files already in the directory are indexed on startup.
+	DirCache struct {
+		root *os.Root
+
+		mu  sync.Mutex
+		lru *lru
+	}
+
+	// lru tracks the entries of a size bounded cache in least recently used order, its owner locks it.
+	lru struct {
+		maxSize   int64 // 0 means no limit
+		size      int64
+		ll        *list.List
+		entries   map[string]*list.Element
+		evictions uint64
+	}
+
+	lruEntry struct {
+		name    string
+		size    int64
+		modTime time.Time
+		data    []byte // content of memory entries
+	}
+
+	// cachedContent is returned by MemoryCache.Get and DirCache.Get, goproxy uses its modification time
+	// as Last-Modified.
+	cachedContent struct {
+		io.ReadSeeker
+		io.Closer
+		modTime time.Time
+	}
+)
+
+var (
+	_ goproxy.Cacher = (*MemoryCache)(nil)
+	_ goproxy.Cacher = (*DirCache)(nil)
+	_ CacheAdmin     = (*MemoryCache)(nil)
+	_ CacheAdmin     = (*DirCache)(nil)
+)
+
+const (
+	DefaultMemoryCacheSize = int64(256 << 20)
+	// dirCacheTempPrefix marks the files being written to a DirCache, they are removed on startup
+	dirCacheTempPrefix = ".tmp-"
+)
+
+func newLRU(maxSize int64) *lru {
+	return &lru{maxSize: maxSize, ll: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the entry of name and marks it as recently used.
+func (l *lru) get(name string) *lruEntry {
+	el, ok := l.entries[name]
+	if !ok {
+		return nil
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruEntry)
+}
+
+// add inserts or replaces an entry and returns the entries evicted to make room for it.
+func (l *lru) add(e *lruEntry) []*lruEntry {
+	l.remove(e.name)
+	l.entries[e.name] = l.ll.PushFront(e)
+	l.size += e.size
+	var evicted []*lruEntry
+	for l.maxSize > 0 && l.size > l.maxSize && l.ll.Len() > 1 {
+		oldest := l.ll.Back().Value.(*lruEntry)
+		l.remove(oldest.name)
+		l.evictions++
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+func (l *lru) remove(name string) {
+	if el, ok := l.entries[name]; ok {
+		l.size -= el.Value.(*lruEntry).size
+		l.ll.Remove(el)
+		delete(l.entries, name)
+	}
+}
+
+// list returns the entries whose name starts with prefix, sorted by name.
+func (l *lru) list(prefix string) []CacheEntry {
+	var ret []CacheEntry
+	for name, el := range l.entries {
+		if strings.HasPrefix(name, prefix) {
+			e := el.Value.(*lruEntry)
+			ret = append(ret, CacheEntry{Name: name, Size: e.size, LastModified: e.modTime})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (l *lru) stats() (entries int, size int64, evictions uint64) {
+	return l.ll.Len(), l.size, l.evictions
+}
+
+// NewMemoryCache returns a MemoryCache holding up to maxSize bytes, 0 means DefaultMemoryCacheSize.
+func NewMemoryCache(maxSize int64) *MemoryCache {
+	if maxSize <= 0 {
+		maxSize = DefaultMemoryCacheSize
+	}
+	return &MemoryCache{lru: newLRU(maxSize)}
+}
+
+func (mc *MemoryCache) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	e := mc.lru.get(name)
+	if e == nil {
+		return nil, fs.ErrNotExist
+	}
+	r := bytes.NewReader(e.data)
+	return &cachedContent{ReadSeeker: r, Closer: io.NopCloser(r), modTime: e.modTime}, nil
+}
+
+// Put keeps a copy of content, files larger than the whole cache are skipped.
+func (mc *MemoryCache) Put(_ context.Context, name string, content io.ReadSeeker) error {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size > mc.lru.maxSize {
+		return nil
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.lru.add(&lruEntry{name: name, size: int64(len(data)), modTime: time.Now(), data: data})
+	return nil
+}
+
+func (mc *MemoryCache) Entries(_ context.Context, prefix string) ([]CacheEntry, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.lru.list(prefix), nil
+}
+
+func (mc *MemoryCache) Delete(_ context.Context, name string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.lru.remove(name)
+	return nil
+}
+
+func (mc *MemoryCache) stats() (int, int64, uint64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.lru.stats()
+}
+
+// NewDirCache returns a DirCache storing files below dir and holding up to maxSize bytes, 0 means no limit.
+func NewDirCache(dir string, maxSize int64) (*DirCache, error) {
+	if dir == "" {
+		return nil, errors.New("cache directory is required")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	dc := &DirCache{root: root, lru: newLRU(max(maxSize, 0))}
+	if err = dc.index(); err != nil {
+		_ = root.Close()
+		return nil, err
+	}
+	return dc, nil
+}
+
+// index adds the files already in the directory, the least recently modified ones are evicted first.
+func (dc *DirCache) index() error {
+	var entries []*lruEntry
+	err := fs.WalkDir(dc.root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), dirCacheTempPrefix) {
+			return dc.root.Remove(name)
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &lruEntry{name: name, size: fi.Size(), modTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		dc.evict(dc.lru.add(e))
+	}
+	return nil
+}
+
+func (dc *DirCache) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrNotExist
+	}
+	f, err := dc.root.Open(filepath.FromSlash(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			dc.mu.Lock()
+			dc.lru.remove(name)
+			dc.mu.Unlock()
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	dc.mu.Lock()
+	if dc.lru.get(name) == nil {
+		// written by another process sharing the directory
+		dc.evict(dc.lru.add(&lruEntry{name: name, size: fi.Size(), modTime: fi.ModTime()}))
+	}
+	dc.mu.Unlock()
+	return &cachedContent{ReadSeeker: f, Closer: f, modTime: fi.ModTime()}, nil
+}
+
+// Put writes content to a temporary file and renames it, so that readers never see partial files.
+func (dc *DirCache) Put(_ context.Context, name string, content io.ReadSeeker) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "put", Path: name, Err: fs.ErrInvalid}
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dir := filepath.FromSlash(path.Dir(name))
+	if err := dc.root.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, dirCacheTempPrefix+strconv.FormatUint(rand.Uint64(), 36))
+	f, err := dc.root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(f, content)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = dc.root.Rename(tmp, filepath.FromSlash(name))
+	}
+	if err != nil {
+		_ = dc.root.Remove(tmp)
+		return err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.evict(dc.lru.add(&lruEntry{name: name, size: size, modTime: time.Now()}))
+	return nil
+}
+
+// evict removes the files of evicted entries, dc.mu is held.
+func (dc *DirCache) evict(evicted []*lruEntry) {
+	for _, e := range evicted {
+		_ = dc.root.Remove(filepath.FromSlash(e.name))
+	}
+}
+
+func (dc *DirCache) Entries(_ context.Context, prefix string) ([]CacheEntry, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.lru.list(prefix), nil
+}
+
+func (dc *DirCache) Delete(_ context.Context, name string) error {
+	if !fs.ValidPath(name) {
+		return nil
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.lru.remove(name)
+	if err := dc.root.Remove(filepath.FromSlash(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (dc *DirCache) stats() (int, int64, uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.lru.stats()
+}
+
+// LastModified implements [github.com/goproxy/goproxy.Cacher.Get].
+func (cc *cachedContent) LastModified() time.Time {
+	return cc.modTime
+}
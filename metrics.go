@@ -0,0 +1,278 @@
+package gitlabgoproxy
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type (
+	// MetricsConfig keeps the metrics, which name the masks, GitLab hosts and cache directories, off the public
+	// port of the proxy. Without Address and Token the metrics are not served.
+	MetricsConfig struct {
+		Address string `json:"address" yaml:"address" toml:"address"` // separate listen address, e.g. 127.0.0.1:9090
+		Token   string `json:"token" yaml:"token" toml:"token"`       // bearer token required to scrape, on the proxy port or Address
+	}
+
+	// MetricsHandler serves the Prometheus metrics of the proxy at MetricsPath and hands every other request to
+	// Next. The counters of Fetcher and Cache are read when scraped, see MixedFetcher.UpstreamStats,
+	// GitlabFetcher.LookupStats and TieredCache.Stats. A non-empty Token is required as bearer token.
+	MetricsHandler struct {
+		Fetcher *MixedFetcher
+		Cache   *TieredCache
+		Token   string
+		Next    http.Handler
+		once    sync.Once
+		handler http.Handler
+	}
+
+	// statsCollector exports the counters kept by the fetcher and the cache.
+	statsCollector struct {
+		fetcher *MixedFetcher
+		cache   *TieredCache
+	}
+
+	// metricsTransport records the GitLab API calls of a host.
+	metricsTransport struct {
+		base http.RoundTripper
+		host string
+	}
+)
+
+// MetricsPath is where Prometheus scrapes the metrics, module paths have a dot in their first element.
+const MetricsPath = "/metrics"
+
+const (
+	metricsNamespace = "gitlab_goproxy"
+	upstreamRoute    = "upstream" // route label of the requests not routed to a mask
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Fetcher operations by operation, route (mask or upstream) and result.",
+	}, []string{"operation", "route", "result"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the fetcher operations by operation and route.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"operation", "route"})
+	gitlabRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_requests_total",
+		Help:      "GitLab API calls by host, endpoint and status code, \"error\" if no response was received.",
+	}, []string{"host", "endpoint", "code"})
+	gitlabRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "gitlab_request_duration_seconds",
+		Help:      "Latency of the GitLab API calls until the response headers, by host and endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "endpoint"})
+	zipBuildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "zip_build_duration_seconds",
+		Help:      "Time to download a GitLab archive and build the module zip from it, by result.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"result"})
+)
+
+var (
+	cacheOpsDesc = prometheus.NewDesc(metricsNamespace+"_cache_operations_total",
+		"Cache operations by tier: hit, miss (including failed reads), error (failed reads and writes) or put.",
+		[]string{"tier", "operation"}, nil)
+	cacheBytesDesc = prometheus.NewDesc(metricsNamespace+"_cache_bytes_total",
+		"Bytes read from cache hits and written by puts, by tier and operation.", []string{"tier", "operation"}, nil)
+	cacheEntriesDesc = prometheus.NewDesc(metricsNamespace+"_cache_entries",
+		"Files held by a memory or dir cache tier.", []string{"tier"}, nil)
+	cacheSizeDesc = prometheus.NewDesc(metricsNamespace+"_cache_size_bytes",
+		"Bytes held by a memory or dir cache tier.", []string{"tier"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc(metricsNamespace+"_cache_evictions_total",
+		"Files evicted from a memory or dir cache tier.", []string{"tier"}, nil)
+	upstreamDesc = prometheus.NewDesc(metricsNamespace+"_upstream_requests_total",
+		"Requests not routed to a mask by upstream and result: served or failed.", []string{"upstream", "result"}, nil)
+	lookupDesc = prometheus.NewDesc(metricsNamespace+"_lookup_cache_operations_total",
+		"Project and submodule lookups by mask and result: hit, miss or eviction.", []string{"mask", "result"}, nil)
+	lookupEntriesDesc = prometheus.NewDesc(metricsNamespace+"_lookup_cache_entries",
+		"Project and submodule lookups cached by mask.", []string{"mask"}, nil)
+	tempFilesDesc = prometheus.NewDesc(metricsNamespace+"_temp_files",
+		"Temporary files of the downloads that are not closed yet.", nil, nil)
+	tempFileBytesDesc = prometheus.NewDesc(metricsNamespace+"_temp_file_bytes",
+		"Disk usage of the temporary files of the downloads that are not closed yet.", nil, nil)
+)
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != MetricsPath {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	if h.Token != "" && !bearerAuthorized(r, h.Token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gitlab-goproxy metrics"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.once.Do(func() {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+			requestsTotal, requestDuration, gitlabRequestsTotal, gitlabRequestDuration, zipBuildDuration,
+			&statsCollector{fetcher: h.Fetcher, cache: h.Cache},
+		)
+		h.handler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	})
+	h.handler.ServeHTTP(w, r)
+}
+
+func (sc *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{cacheOpsDesc, cacheBytesDesc, cacheEntriesDesc, cacheSizeDesc, cacheEvictionsDesc,
+		upstreamDesc, lookupDesc, lookupEntriesDesc, tempFilesDesc, tempFileBytesDesc} {
+		ch <- d
+	}
+}
+
+func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+	gauge := func(desc *prometheus.Desc, v int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v), labels...)
+	}
+
+	if sc.cache != nil {
+		for i, s := range sc.cache.Stats() {
+			counter(cacheOpsDesc, s.Hits, s.Tier, "hit")
+			counter(cacheOpsDesc, s.Misses, s.Tier, "miss")
+			counter(cacheOpsDesc, s.Errors, s.Tier, "error")
+			counter(cacheOpsDesc, s.Puts, s.Tier, "put")
+			counter(cacheBytesDesc, s.ReadBytes, s.Tier, "hit")
+			counter(cacheBytesDesc, s.WrittenBytes, s.Tier, "put")
+			if _, ok := sc.cache.tiers[i].cacher.(sizedCache); ok {
+				gauge(cacheEntriesDesc, int64(s.Entries), s.Tier)
+				gauge(cacheSizeDesc, s.Size, s.Tier)
+				counter(cacheEvictionsDesc, s.Evictions, s.Tier)
+			}
+		}
+	}
+
+	if sc.fetcher != nil {
+		for _, s := range sc.fetcher.UpstreamStats() {
+			counter(upstreamDesc, s.Served, s.Name, "served")
+			counter(upstreamDesc, s.Failed, s.Name, "failed")
+		}
+		// masks sharing a name are summed, a metric cannot be exported twice
+		lookups := make(map[string]LookupStats)
+		var names []string
+		for _, gf := range sc.fetcher.masks() {
+			name := gf.routeName()
+			s, ok := lookups[name]
+			if !ok {
+				names = append(names, name)
+			}
+			ls := gf.LookupStats()
+			s.Hits, s.Misses, s.Evictions, s.Entries = s.Hits+ls.Hits, s.Misses+ls.Misses, s.Evictions+ls.Evictions, s.Entries+ls.Entries
+			lookups[name] = s
+		}
+		for _, name := range names {
+			s := lookups[name]
+			counter(lookupDesc, s.Hits, name, "hit")
+			counter(lookupDesc, s.Misses, name, "miss")
+			counter(lookupDesc, s.Evictions, name, "eviction")
+			gauge(lookupEntriesDesc, int64(s.Entries), name)
+		}
+	}
+
+	files, size := tempFileUsage()
+	gauge(tempFilesDesc, int64(files))
+	gauge(tempFileBytesDesc, size)
+}
+
+// tempFileUsage returns the number and size of the SmartFiles that are not closed yet.
+func tempFileUsage() (files int, size int64) {
+	tempFiles.Range(func(name, _ any) bool {
+		if fi, err := os.Stat(name.(string)); err == nil {
+			files++
+			size += fi.Size()
+		}
+		return true
+	})
+	return files, size
+}
+
+// observeRequest records a fetcher operation that started at start.
+func observeRequest(operation, route string, start time.Time, err error) {
+	result := "ok"
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, errNoVersions):
+		result = "not_found"
+	case err != nil:
+		result = "error"
+	}
+	requestsTotal.WithLabelValues(operation, route, result).Inc()
+	requestDuration.WithLabelValues(operation, route).Observe(time.Since(start).Seconds())
+}
+
+// routeName labels the requests routed to the mask: its patterns, or the prefixes of its rewrite rules when it
+// has none.
+func (gf *GitlabFetcher) routeName() string {
+	if mask := strings.Trim(gf.config.Mask, ", "); mask != "" {
+		return mask
+	}
+	prefixes := make([]string, 0, len(gf.config.Rewrites))
+	for _, r := range gf.config.Rewrites {
+		if r.Prefix != "" {
+			prefixes = append(prefixes, r.Prefix)
+		} else {
+			prefixes = append(prefixes, r.Pattern)
+		}
+	}
+	return strings.Join(prefixes, ",")
+}
+
+func (mt *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := mt.base.RoundTrip(req)
+	endpoint := gitlabEndpoint(req.URL)
+	gitlabRequestDuration.WithLabelValues(mt.host, endpoint).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	gitlabRequestsTotal.WithLabelValues(mt.host, endpoint, code).Inc()
+	return resp, err
+}
+
+// gitlabEndpoint returns the path of a GitLab API call below /api/v4 with the project, group, tag, commit and file
+// names replaced by placeholders, e.g. /projects/:id/repository/files/:file/raw. Calls to a git repository
+// become /:project.git/info/refs.
+func gitlabEndpoint(u *url.URL) string {
+	p := u.EscapedPath()
+	if i := strings.Index(p, "/api/v4/"); i >= 0 {
+		p = p[i+len("/api/v4"):]
+	} else if i = strings.Index(p, ".git/"); i >= 0 {
+		return "/:project.git/" + p[i+len(".git/"):]
+	}
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		switch segments[i-1] {
+		case "projects", "groups":
+			segments[i] = ":id"
+		case "tags", "commits", "branches":
+			segments[i] = ":ref"
+		case "files":
+			segments[i] = ":file"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
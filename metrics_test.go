@@ -0,0 +1,100 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	gf, fg := newFixtureFetcher(t)
+	upstream, err := gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{
+		Proxies: []gitlabgoproxy.UpstreamProxy{{URL: "http://127.0.0.1:1"}}, SumDB: "off"})
+	assert.NoError(t, err)
+	fetcher := &gitlabgoproxy.MixedFetcher{Masks: []*gitlabgoproxy.GitlabFetcher{gf}, Upstream: upstream}
+	cache, err := gitlabgoproxy.NewCache(gitlabgoproxy.Config{})
+	assert.NoError(t, err)
+
+	info, mod, zip, err := fetcher.Download(ctx, "gitlab.com/wongidle/foobar", "v0.1.0")
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Put(ctx, "gitlab.com/wongidle/foobar/@v/v0.1.0.zip", zip))
+	for _, f := range []io.Closer{info, mod, zip} {
+		f.Close()
+	}
+	_, err = readCache(t, cache, "gitlab.com/wongidle/foobar/@v/v0.1.0.zip")
+	assert.NoError(t, err)
+	_, err = readCache(t, cache, "gitlab.com/wongidle/foobar/@v/v0.1.1.zip")
+	assert.Error(t, err)
+	_, err = fetcher.List(ctx, "gitlab.com/wongidle/missing")
+	assert.Error(t, err)
+	_, err = fetcher.List(ctx, "github.com/pkg/errors")
+	assert.Error(t, err)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	srv := httptest.NewServer(&gitlabgoproxy.MetricsHandler{Fetcher: fetcher, Cache: cache, Next: next})
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + gitlabgoproxy.MetricsPath)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	metrics := string(data)
+
+	u, err := url.Parse(fg.Endpoint())
+	assert.NoError(t, err)
+	for _, line := range []string{
+		`gitlab_goproxy_requests_total{operation="download",result="ok",route="gitlab.com"}`,
+		`gitlab_goproxy_requests_total{operation="list",result="not_found",route="gitlab.com"}`,
+		`gitlab_goproxy_requests_total{operation="list",result="error",route="upstream"}`,
+		`gitlab_goproxy_request_duration_seconds_count{operation="download",route="gitlab.com"}`,
+		`gitlab_goproxy_gitlab_requests_total{code="200",endpoint="/projects/:id/repository/tags/:ref",host="` + u.Host + `"}`,
+		`gitlab_goproxy_gitlab_requests_total{code="200",endpoint="/projects/:id/repository/files/:file/raw",host="` + u.Host + `"}`,
+		`gitlab_goproxy_gitlab_request_duration_seconds_count{endpoint="/projects/:id",host="` + u.Host + `"}`,
+		`gitlab_goproxy_zip_build_duration_seconds_count{result="ok"}`,
+		`gitlab_goproxy_cache_operations_total{operation="hit",tier="memory"} 1`,
+		`gitlab_goproxy_cache_operations_total{operation="miss",tier="memory"} 1`,
+		`gitlab_goproxy_cache_operations_total{operation="put",tier="memory"} 1`,
+		`gitlab_goproxy_cache_entries{tier="memory"} 1`,
+		`gitlab_goproxy_upstream_requests_total{result="failed",upstream="http://127.0.0.1:1"} 1`,
+		`gitlab_goproxy_lookup_cache_operations_total{mask="gitlab.com",result="miss"}`,
+		`gitlab_goproxy_temp_file_bytes`,
+		`go_goroutines`,
+	} {
+		assert.Contains(t, metrics, line)
+	}
+	assert.Contains(t, metrics, `gitlab_goproxy_cache_bytes_total{operation="hit",tier="memory"} `)
+	assert.NotContains(t, metrics, "wongidle")
+
+	// other paths are handed to Next
+	resp, err = http.Get(srv.URL + "/gitlab.com/wongidle/foobar/@v/list")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, http.StatusTeapot, resp.StatusCode)
+
+	// a token keeps the metrics private on the proxy port
+	private := httptest.NewServer(&gitlabgoproxy.MetricsHandler{Fetcher: fetcher, Cache: cache, Token: "scrape", Next: next})
+	defer private.Close()
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "scrape": http.StatusOK} {
+		req, err := http.NewRequest(http.MethodGet, private.URL+gitlabgoproxy.MetricsPath, nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.EqualValues(t, status, resp.StatusCode, token)
+	}
+}
@@ -0,0 +1,281 @@
+package gitlabgoproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+type (
+	// proxyFetcher talks the GOPROXY protocol to a single upstream proxy, without the go command.
+	// The responses of mutable endpoints (list, latest, non-canonical queries) are revalidated
+	// with conditional requests.
+	proxyFetcher struct {
+		url     *url.URL
+		client  *http.Client
+		timeout time.Duration // per request, the downloaded files outlive it
+		sumdb   *checksumDB   // nil disables verification
+
+		mu        sync.Mutex
+		responses map[string]*cachedResponse
+	}
+
+	cachedResponse struct {
+		etag         string
+		lastModified string
+		body         []byte
+	}
+)
+
+var _ goproxy.Fetcher = (*proxyFetcher)(nil)
+
+const (
+	proxyMaxRetries = 3
+	// proxyCacheSize bounds the responses kept for revalidation, the cache is dropped when it is full
+	proxyCacheSize = 1024
+)
+
+func newProxyFetcher(u *url.URL, transport http.RoundTripper, timeout time.Duration, db *checksumDB) *proxyFetcher {
+	return &proxyFetcher{
+		url:       u,
+		client:    &http.Client{Transport: transport},
+		timeout:   timeout,
+		sumdb:     db,
+		responses: make(map[string]*cachedResponse),
+	}
+}
+
+func (pf *proxyFetcher) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return "", time.Time{}, notExistf("%w", err)
+	}
+	escapedQuery, err := module.EscapeVersion(query)
+	if err != nil {
+		return "", time.Time{}, notExistf("%w", err)
+	}
+	endpoint := escapedPath + "/@v/" + escapedQuery + ".info"
+	if query == "latest" {
+		endpoint = escapedPath + "/@latest"
+	}
+
+	ctx, cancel := pf.withTimeout(ctx)
+	defer cancel()
+	data, err := pf.get(ctx, endpoint, semver.Canonical(query) != query)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	info := new(Info)
+	if err = json.Unmarshal(data, info); err != nil || !semver.IsValid(info.Version) {
+		return "", time.Time{}, notExistf("invalid info response for %s@%s: %q", path, query, data)
+	}
+	return info.Version, info.Time, nil
+}
+
+func (pf *proxyFetcher) List(ctx context.Context, path string) ([]string, error) {
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return nil, notExistf("%w", err)
+	}
+
+	ctx, cancel := pf.withTimeout(ctx)
+	defer cancel()
+	data, err := pf.get(ctx, escapedPath+"/@v/list", true)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		// older proxies append the commit time to each version
+		if v, _, _ := strings.Cut(strings.TrimSpace(line), " "); semver.IsValid(v) {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// Download streams the module files to temporary files that live as long as ctx, and verifies them
+// against the checksum database.
+func (pf *proxyFetcher) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	if err = module.Check(path, version); err != nil {
+		return nil, nil, nil, notExistf("%w", err)
+	}
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return nil, nil, nil, notExistf("%w", err)
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, nil, nil, notExistf("%w", err)
+	}
+	endpoint := escapedPath + "/@v/" + escapedVersion
+
+	fetchCtx, cancel := pf.withTimeout(ctx)
+	defer cancel()
+	files := make([]*SmartFile, 0, 3)
+	defer func() {
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+		}
+	}()
+	// the limits of the go command, the info file is bounded like go.mod
+	for _, file := range []struct {
+		ext   string
+		limit int64
+	}{{".info", modzip.MaxGoMod}, {".mod", modzip.MaxGoMod}, {".zip", modzip.MaxZipFile}} {
+		var f *SmartFile
+		if f, err = Create(ctx); err != nil {
+			return nil, nil, nil, err
+		}
+		files = append(files, f)
+		if err = pf.download(fetchCtx, endpoint+file.ext, f, file.limit); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// the checksum database is disabled or skips private modules, the zip gets at least the checks of the go command
+	if _, err = modzip.CheckZip(module.Version{Path: path, Version: version}, files[2].Name()); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid zip for %s@%s: %w", path, version, err)
+	}
+	if pf.sumdb != nil {
+		if err = pf.sumdb.verify(path, version, files[1].Name(), files[2].Name()); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return files[0], files[1], files[2], nil
+}
+
+func (pf *proxyFetcher) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if pf.timeout > 0 {
+		return context.WithTimeout(ctx, pf.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// get returns the body of endpoint. Conditional responses are cached and revalidated with
+// If-None-Match or If-Modified-Since.
+func (pf *proxyFetcher) get(ctx context.Context, endpoint string, conditional bool) ([]byte, error) {
+	header := http.Header{}
+	var cached *cachedResponse
+	if conditional {
+		pf.mu.Lock()
+		cached = pf.responses[endpoint]
+		pf.mu.Unlock()
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := pf.do(ctx, endpoint, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.body, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if conditional && (etag != "" || lastModified != "") {
+		pf.mu.Lock()
+		if len(pf.responses) >= proxyCacheSize {
+			clear(pf.responses)
+		}
+		pf.responses[endpoint] = &cachedResponse{etag: etag, lastModified: lastModified, body: body}
+		pf.mu.Unlock()
+	}
+	return body, nil
+}
+
+// download streams the body of endpoint into f and rewinds it. A body larger than limit fails with ErrTooLarge.
+func (pf *proxyFetcher) download(ctx context.Context, endpoint string, f *SmartFile, limit int64) error {
+	resp, err := pf.do(ctx, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err = io.Copy(LimitWriter(f, limit), resp.Body); err != nil {
+		return fmt.Errorf("GET %s: %w", pf.url.JoinPath(endpoint).Redacted(), err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// do requests endpoint, retrying rate limited and unavailable upstreams. It returns a response with
+// status 200 or 304; 404 and 410 are reported as fs.ErrNotExist.
+func (pf *proxyFetcher) do(ctx context.Context, endpoint string, header http.Header) (*http.Response, error) {
+	u := pf.url.JoinPath(endpoint)
+	var lastErr error
+	for attempt := range proxyMaxRetries {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * 200 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, errors.Join(lastErr, ctx.Err())
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := pf.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNotModified:
+			return resp, nil
+		}
+
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		err = fmt.Errorf("GET %s: %s: %s", u.Redacted(), resp.Status, bytes.TrimSpace(body))
+		switch resp.StatusCode {
+		case http.StatusNotFound, http.StatusGone:
+			return nil, notExistf("%w", err)
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			lastErr = err
+		default:
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+// notExistf formats an error matching fs.ErrNotExist, which goproxy serves as 404.
+func notExistf(format string, a ...any) error {
+	return fmt.Errorf("%w: %w", fs.ErrNotExist, fmt.Errorf(format, a...))
+}
@@ -0,0 +1,206 @@
+package gitlabgoproxy_test
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+	modzip "golang.org/x/mod/zip"
+)
+
+// fakeProxy serves the GOPROXY protocol for modules built from in-memory files.
+type fakeProxy struct {
+	*httptest.Server
+	mu          sync.Mutex
+	files       map[string][]byte // escaped path below the proxy URL -> content
+	notModified int
+	unavailable int // number of 503 responses before serving
+}
+
+func newFakeProxyServer(t *testing.T) *fakeProxy {
+	fp := &fakeProxy{files: make(map[string][]byte)}
+	fp.Server = httptest.NewServer(http.HandlerFunc(fp.serve))
+	t.Cleanup(fp.Close)
+	return fp
+}
+
+func (fp *fakeProxy) serve(w http.ResponseWriter, r *http.Request) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.unavailable > 0 {
+		fp.unavailable--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/gone/") {
+		http.Error(w, "gone", http.StatusGone)
+		return
+	}
+	data, ok := fp.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	etag := `"` + strconv.Itoa(len(data)) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		fp.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	_, _ = w.Write(data)
+}
+
+// addModule publishes path@version holding files and returns its go.sum lines.
+func (fp *fakeProxy) addModule(t *testing.T, path, version string, files map[string]string) []byte {
+	dir := t.TempDir()
+	for name, content := range files {
+		fn := filepath.Join(dir, "src", name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(fn), 0o755))
+		assert.NoError(t, os.WriteFile(fn, []byte(content), 0o644))
+	}
+	zf, err := os.Create(filepath.Join(dir, "module.zip"))
+	assert.NoError(t, err)
+	assert.NoError(t, modzip.CreateFromDir(zf, module.Version{Path: path, Version: version}, filepath.Join(dir, "src")))
+	assert.NoError(t, zf.Close())
+	data, err := os.ReadFile(zf.Name())
+	assert.NoError(t, err)
+
+	zipHash, err := dirhash.HashZip(zf.Name(), dirhash.Hash1)
+	assert.NoError(t, err)
+	modHash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(files["go.mod"])), nil
+	})
+	assert.NoError(t, err)
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	prefix := "/" + path + "/@v/"
+	fp.files[prefix+version+".info"] = []byte(`{"Version":"` + version + `","Time":"2024-06-28T09:04:20Z"}`)
+	fp.files[prefix+version+".mod"] = []byte(files["go.mod"])
+	fp.files[prefix+version+".zip"] = data
+	fp.files[prefix+"list"] = append(fp.files[prefix+"list"], version+"\n"...)
+	fp.files["/"+path+"/@latest"] = fp.files[prefix+version+".info"]
+	return []byte(path + " " + version + " " + zipHash + "\n" + path + " " + version + "/go.mod " + modHash + "\n")
+}
+
+func TestProxyFetcher(t *testing.T) {
+	ctx := context.Background()
+	fp := newFakeProxyServer(t)
+
+	sums := map[string][]byte{}
+	sums["example.com/foo@v1.0.0"] = fp.addModule(t, "example.com/foo", "v1.0.0", map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.22.0\n",
+		"foo.go": "package foo\n",
+	})
+	sums["example.com/foo@v1.1.0"] = fp.addModule(t, "example.com/foo", "v1.1.0", map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.22.0\n",
+		"foo.go": "package foo\n\nconst V = 1\n",
+	})
+	// the checksum database knows different content for v1.2.0
+	fp.addModule(t, "example.com/foo", "v1.2.0", map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.22.0\n",
+		"foo.go": "package foo\n\nconst V = 2\n",
+	})
+	sums["example.com/foo@v1.2.0"] = sums["example.com/foo@v1.1.0"]
+
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.example")
+	assert.NoError(t, err)
+	db := httptest.NewServer(sumdb.NewServer(sumdb.NewTestServer(skey, func(path, version string) ([]byte, error) {
+		if data, ok := sums[path+"@"+version]; ok {
+			return []byte(strings.ReplaceAll(string(data), "v1.1.0", version)), nil
+		}
+		return nil, errors.New("not found")
+	})))
+	defer db.Close()
+
+	us, err := gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{
+		Proxies: []gitlabgoproxy.UpstreamProxy{{URL: fp.URL}},
+		SumDB:   vkey + " " + db.URL,
+		NoSumDB: "example.com/private",
+	})
+	assert.NoError(t, err)
+
+	// list and latest are revalidated
+	for range 2 {
+		versions, err := us.List(ctx, "example.com/foo")
+		assert.NoError(t, err)
+		assert.EqualValues(t, []string{"v1.0.0", "v1.1.0", "v1.2.0"}, versions)
+	}
+	assert.EqualValues(t, 1, fp.notModified)
+
+	version, _, err := us.Query(ctx, "example.com/foo", "latest")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v1.2.0", version)
+
+	info, mod, zip, err := us.Download(ctx, "example.com/foo", "v1.0.0")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(info)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"Version":"v1.0.0"`)
+	data, err = io.ReadAll(mod)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "module example.com/foo\n\ngo 1.22.0\n", string(data))
+	assertZip(t, zip, "example.com/foo", "v1.0.0", "go.mod", "foo.go")
+
+	// checksum mismatch
+	_, _, _, err = us.Download(ctx, "example.com/foo", "v1.2.0")
+	assert.ErrorContains(t, err, "checksum mismatch")
+
+	// not verified
+	fp.addModule(t, "example.com/private/bar", "v0.1.0", map[string]string{"go.mod": "module example.com/private/bar\n"})
+	_, _, _, err = us.Download(ctx, "example.com/private/bar", "v0.1.0")
+	assert.NoError(t, err)
+
+	// unverified zips are still checked, and the files are bounded like in the go command
+	fp.addModule(t, "example.com/private/baz", "v0.1.0", map[string]string{"go.mod": "module example.com/private/baz\n"})
+	buf := new(bytes.Buffer)
+	zw := stdzip.NewWriter(buf)
+	w, err := zw.Create("example.com/private/baz@v0.1.0/../escape.go")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("package escape\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	fp.mu.Lock()
+	fp.files["/example.com/private/baz/@v/v0.1.0.zip"] = buf.Bytes()
+	fp.mu.Unlock()
+	_, _, _, err = us.Download(ctx, "example.com/private/baz", "v0.1.0")
+	assert.ErrorContains(t, err, "invalid zip")
+
+	fp.mu.Lock()
+	fp.files["/example.com/private/baz/@v/v0.1.0.mod"] = bytes.Repeat([]byte("/"), modzip.MaxGoMod+1)
+	fp.mu.Unlock()
+	_, _, _, err = us.Download(ctx, "example.com/private/baz", "v0.1.0")
+	assert.ErrorIs(t, err, gitlabgoproxy.ErrTooLarge)
+
+	// not found and gone
+	_, _, _, err = us.Download(ctx, "example.com/foo", "v9.0.0")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = us.List(ctx, "gone/module")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// unavailable upstreams are retried
+	fp.mu.Lock()
+	fp.unavailable = 1
+	fp.mu.Unlock()
+	_, _, err = us.Query(ctx, "example.com/foo", "v1.0.0")
+	assert.NoError(t, err)
+}
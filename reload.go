@@ -0,0 +1,160 @@
+package gitlabgoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/go-jimu/components/sloghelper"
+)
+
+// Reloader applies a changed configuration to a running MixedFetcher. Only the masks are reloaded, changes to
+// the other sections are logged and need a restart.
+type Reloader struct {
+	fetcher *MixedFetcher
+	mu      sync.Mutex
+	current Config
+}
+
+func NewReloader(conf Config, fetcher *MixedFetcher) *Reloader {
+	return &Reloader{fetcher: fetcher, current: conf}
+}
+
+// Apply swaps the masks of conf into the fetcher. A configuration whose masks cannot be built is rejected with
+// its difference to the current one logged, and the current masks stay in place.
+func (r *Reloader) Apply(conf Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	diff := diffLines(describeMasks(r.current.Masks), describeMasks(conf.Masks))
+	if err := r.fetcher.Reload(conf); err != nil {
+		slog.Error("rejected config", sloghelper.Error(err), slog.String("diff", diff))
+		return err
+	}
+
+	for _, section := range restartRequired(r.current, conf) {
+		slog.Warn("config change needs a restart", slog.String("section", section))
+	}
+	r.current = conf
+	if diff == "" {
+		slog.Info("config reloaded without changes to the masks")
+		return nil
+	}
+	slog.Info("reloaded masks", slog.String("diff", diff))
+	return nil
+}
+
+// Reload builds the masks of conf and swaps them in. A mask whose configuration did not change is kept along
+// with its lookup cache. Requests already routed to a replaced mask finish on it.
+func (mf *MixedFetcher) Reload(conf Config) error {
+	current := mf.masks()
+	masks := make([]*GitlabFetcher, 0, len(conf.Masks))
+	for i, c := range conf.Masks {
+		if err := validateMask(c); err != nil {
+			return fmt.Errorf("mask %d: %w", i, err)
+		}
+		var gf *GitlabFetcher
+		for _, m := range current {
+			if reflect.DeepEqual(m.config, c) {
+				gf = m
+				break
+			}
+		}
+		if gf == nil {
+			f, err := newGitlabFetcher(c, mf.breakers)
+			if err != nil {
+				return fmt.Errorf("mask %s: %w", c.Mask, err)
+			}
+			gf = f
+		}
+		masks = append(masks, gf)
+	}
+	// the breakers of the hosts kept are reconfigured in place, shared by the new and the kept masks
+	mf.breakers.configure(conf.Masks)
+	mf.reloaded.Store(&masks)
+	return nil
+}
+
+// masks returns the masks in use, see Reload.
+func (mf *MixedFetcher) masks() []*GitlabFetcher {
+	if masks := mf.reloaded.Load(); masks != nil {
+		return *masks
+	}
+	return mf.Masks
+}
+
+func validateMask(c GitlabFetcherConfig) error {
+	switch {
+	case c.Endpoint == "":
+		return errors.New("endpoint is required")
+	case strings.Trim(c.Mask, ", ") == "" && len(c.Rewrites) == 0:
+		return errors.New("mask or rewrites are required")
+	}
+	return nil
+}
+
+// restartRequired returns the sections other than the masks that differ between old and new.
+func restartRequired(old, new Config) []string {
+	var ret []string
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < ov.NumField(); i++ {
+		field := ov.Type().Field(i)
+		if field.Name != "Masks" && !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// describeMasks renders the masks one field per line, with the access tokens replaced by a digest so that a
+// rotation shows in a diff without leaking them.
+func describeMasks(masks []GitlabFetcherConfig) []string {
+	data, _ := json.MarshalIndent(redactMasks(masks), "", "  ")
+	return strings.Split(string(data), "\n")
+}
+
+// diffLines returns b with the lines removed from a prefixed by "-", those added prefixed by "+" and the others
+// by a space, or an empty string if a and b are equal.
+func diffLines(a, b []string) string {
+	// longest common subsequence, the configurations are small
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString(" " + a[i] + "\n")
+			i, j = i+1, j+1
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			sb.WriteString("+" + b[j] + "\n")
+			j++
+			changed = true
+		default:
+			sb.WriteString("-" + a[i] + "\n")
+			i++
+			changed = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return sb.String()
+}
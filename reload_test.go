@@ -0,0 +1,145 @@
+package gitlabgoproxy_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer collects the logs of a test, written from several goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestReloader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	logs := new(syncBuffer)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+
+	fg := newFixtureGitLab(t)
+	fg.RequireToken("old-token")
+	conf := gitlabgoproxy.Config{
+		Upstream: gitlabgoproxy.UpstreamConfig{Proxies: []gitlabgoproxy.UpstreamProxy{{URL: "http://127.0.0.1:1"}}},
+		Masks: []gitlabgoproxy.GitlabFetcherConfig{
+			{Endpoint: fg.Endpoint(), Mask: "gitlab.com", AccessToken: "old-token"},
+			{Endpoint: fg.Endpoint(), Mask: "go.corp.example", AccessToken: "old-token", Rewrites: []gitlabgoproxy.RewriteRule{
+				{Prefix: "go.corp.example/payments", Namespace: "backend/payments"}}},
+		},
+	}
+	fetcher, err := gitlabgoproxy.NewMixedFetcher(conf)
+	assert.NoError(t, err)
+	reloader := gitlabgoproxy.NewReloader(conf, fetcher)
+	_, err = fetcher.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.NoError(t, err)
+	foobar, ledger := fetcher.Route("gitlab.com/wongidle/foobar"), fetcher.Route("go.corp.example/payments/ledger")
+
+	// a rotated token replaces the mask, the unchanged one is kept
+	fg.RequireToken("new-token")
+	_, err = fetcher.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.Error(t, err)
+	rotated := conf
+	rotated.Masks = []gitlabgoproxy.GitlabFetcherConfig{conf.Masks[0], conf.Masks[1]}
+	rotated.Masks[0].AccessToken = "new-token"
+	rotated.GoGet = true
+	assert.NoError(t, reloader.Apply(rotated))
+	versions, err := fetcher.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"v0.1.0", "v0.1.1", "v0.2.0"}, versions)
+	assert.NotSame(t, foobar, fetcher.Route("gitlab.com/wongidle/foobar"))
+	assert.Same(t, ledger, fetcher.Route("go.corp.example/payments/ledger"))
+	assert.Contains(t, logs.String(), "reloaded masks")
+	assert.Contains(t, logs.String(), "redacted:")
+	assert.Contains(t, logs.String(), "section=go_get")
+	assert.NotContains(t, logs.String(), "new-token")
+
+	// a bad config is rejected and the masks stay in place
+	for _, masks := range [][]gitlabgoproxy.GitlabFetcherConfig{
+		{{Endpoint: fg.Endpoint(), Mask: "gitlab.com", Rewrites: []gitlabgoproxy.RewriteRule{{Pattern: "("}}}},
+		{{Mask: "gitlab.com"}},
+	} {
+		bad := rotated
+		bad.Masks = masks
+		assert.Error(t, reloader.Apply(bad))
+	}
+	assert.Contains(t, logs.String(), "rejected config")
+	assert.Same(t, ledger, fetcher.Route("go.corp.example/payments/ledger"))
+	_, err = fetcher.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.NoError(t, err)
+
+	// masks can be added and removed
+	assert.NoError(t, reloader.Apply(gitlabgoproxy.Config{Masks: rotated.Masks[:1]}))
+	assert.Nil(t, fetcher.Route("go.corp.example/payments/ledger"))
+}
+
+func TestReloader_CircuitBreaker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	logs := new(syncBuffer)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+
+	fg := newFixtureGitLab(t)
+	conf := gitlabgoproxy.Config{
+		Masks: []gitlabgoproxy.GitlabFetcherConfig{
+			{Endpoint: fg.Endpoint(), Mask: "gitlab.com", CircuitBreaker: gitlabgoproxy.CircuitBreakerConfig{Failures: 1, Cooldown: time.Hour}},
+			{Endpoint: fg.Endpoint(), Mask: "go.corp.example", CircuitBreaker: gitlabgoproxy.CircuitBreakerConfig{Failures: 3},
+				Rewrites: []gitlabgoproxy.RewriteRule{{Prefix: "go.corp.example/payments", Namespace: "backend/payments"}}},
+		},
+	}
+	fetcher, err := gitlabgoproxy.NewMixedFetcher(conf)
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), "ignored circuit breaker config")
+	reloader := gitlabgoproxy.NewReloader(conf, fetcher)
+
+	// the masks of a host share the breaker of the first one
+	_, err = fetcher.List(fg.Unavailable(t), "gitlab.com/wongidle/foobar")
+	assert.Error(t, err)
+	_, err = fetcher.List(ctx, "go.corp.example/payments/ledger")
+	assert.ErrorIs(t, err, gitlabgoproxy.ErrCircuitOpen)
+
+	// a reload reconfigures the breaker of the host, the kept mask included
+	conf.Masks = []gitlabgoproxy.GitlabFetcherConfig{conf.Masks[0], conf.Masks[1]}
+	conf.Masks[0].CircuitBreaker = gitlabgoproxy.CircuitBreakerConfig{Failures: -1}
+	conf.Masks[1].CircuitBreaker = conf.Masks[0].CircuitBreaker
+	assert.NoError(t, reloader.Apply(conf))
+	assert.Contains(t, logs.String(), "circuit breaker reconfigured")
+	_, err = fetcher.List(ctx, "go.corp.example/payments/ledger")
+	assert.NoError(t, err)
+	// the retry of the client is not stopped by the disabled breaker
+	fg.Inject(fault{Status: http.StatusServiceUnavailable, Times: 1})
+	_, err = fetcher.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.NoError(t, err)
+
+	// a separate fetcher does not share the breaker of the host
+	conf.Masks[0].CircuitBreaker = gitlabgoproxy.CircuitBreakerConfig{Failures: 1, Cooldown: time.Hour}
+	conf.Masks[1].CircuitBreaker = conf.Masks[0].CircuitBreaker
+	assert.NoError(t, reloader.Apply(conf))
+	other, err := gitlabgoproxy.NewMixedFetcher(conf)
+	assert.NoError(t, err)
+	_, err = fetcher.List(fg.Unavailable(t), "gitlab.com/wongidle/foobar")
+	assert.Error(t, err)
+	_, err = other.List(ctx, "gitlab.com/wongidle/foobar")
+	assert.NoError(t, err)
+}
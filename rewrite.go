@@ -0,0 +1,148 @@
+package gitlabgoproxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type (
+	// RewriteRule maps module paths to GitLab project paths, either by prefix:
+	//
+	//	prefix: go.corp.example/payments, namespace: backend/payments
+	//
+	// or by a regexp matched against the beginning of the module path:
+	//
+	//	pattern: go\.corp\.example/(\w+), template: backend/$1
+	//
+	// The rest of the module path (project, subdirectories, major version) is kept as is.
+	RewriteRule struct {
+		Prefix    string `json:"prefix" yaml:"prefix" toml:"prefix"`
+		Namespace string `json:"namespace" yaml:"namespace" toml:"namespace"`
+		Pattern   string `json:"pattern" yaml:"pattern" toml:"pattern"`
+		Template  string `json:"template" yaml:"template" toml:"template"` // $1 or ${name} refer to submatches of Pattern
+	}
+
+	rewriter struct {
+		rule RewriteRule
+		re   *regexp.Regexp
+	}
+)
+
+func newRewriters(rules []RewriteRule) ([]*rewriter, error) {
+	ret := make([]*rewriter, 0, len(rules))
+	for _, rule := range rules {
+		rw := &rewriter{rule: rule}
+		switch {
+		case rule.Prefix != "" && rule.Pattern != "":
+			return nil, fmt.Errorf("rewrite rule %q: prefix and pattern are mutually exclusive", rule.Prefix)
+		case rule.Prefix != "":
+			rw.rule.Prefix = strings.TrimSuffix(rule.Prefix, "/")
+		case rule.Pattern != "":
+			re, err := regexp.Compile("^(?:" + rule.Pattern + ")")
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule %q: %w", rule.Pattern, err)
+			}
+			rw.re = re
+		default:
+			return nil, errors.New("rewrite rule without prefix or pattern")
+		}
+		ret = append(ret, rw)
+	}
+	return ret, nil
+}
+
+// rewrite returns the GitLab path of the module path, or false if the rule does not apply.
+func (rw *rewriter) rewrite(path string) (string, bool) {
+	if rw.re == nil {
+		rest, ok := strings.CutPrefix(path, rw.rule.Prefix)
+		if !ok || (rest != "" && rest[0] != '/') {
+			return "", false
+		}
+		return strings.Trim(rw.rule.Namespace+rest, "/"), true
+	}
+
+	m := rw.re.FindStringSubmatchIndex(path)
+	if m == nil || (m[1] < len(path) && path[m[1]] != '/') {
+		return "", false
+	}
+	expanded := rw.re.ExpandString(nil, rw.rule.Template, path, m)
+	return strings.Trim(string(expanded)+path[m[1]:], "/"), true
+}
+
+// projectPath splits the GitLab path of a module path, e.g.
+//
+//	gitlab.com/wongidle/mutiples/pkg/str/v2 -> [wongidle mutiples pkg str v2]
+//	go.corp.example/payments/ledger -> [backend payments ledger] with the rule go.corp.example -> backend
+//
+// Without a matching rewrite rule the host is stripped.
+func (gf *GitlabFetcher) projectPath(path string) ([]string, error) {
+	gp := ""
+	matched := false
+	for _, rw := range gf.rewriters {
+		if gp, matched = rw.rewrite(path); matched {
+			break
+		}
+	}
+	if !matched {
+		_, gp, _ = strings.Cut(path, "/")
+	}
+
+	ps := strings.Split(gp, "/")
+	if len(ps) < 2 {
+		return nil, fmt.Errorf("module path %s maps to %q, which is not a GitLab project path", path, gp)
+	}
+	for _, p := range ps {
+		if p == "" || p == "." || p == ".." {
+			return nil, fmt.Errorf("module path %s maps to %q, which is not a GitLab project path", path, gp)
+		}
+	}
+	return ps, nil
+}
+
+// rewritten reports whether a rewrite rule applies to the module path.
+func (gf *GitlabFetcher) rewritten(path string) bool {
+	for _, rw := range gf.rewriters {
+		if _, ok := rw.rewrite(path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// modulePaths returns the module paths whose GitLab path is project, the reverse of projectPath. Prefix rules
+// and literal mask hosts are reversed, pattern rules cannot be and are skipped.
+func (gf *GitlabFetcher) modulePaths(project string) []string {
+	var ret []string
+	add := func(path string) {
+		ps, err := gf.projectPath(path)
+		if err != nil || strings.Join(ps, "/") != project {
+			return
+		}
+		for _, p := range ret {
+			if p == path {
+				return
+			}
+		}
+		ret = append(ret, path)
+	}
+	for _, rw := range gf.rewriters {
+		if rw.re != nil {
+			continue
+		}
+		ns := strings.Trim(rw.rule.Namespace, "/")
+		if ns == "" {
+			add(rw.rule.Prefix + "/" + project)
+		} else if rest, ok := strings.CutPrefix(project, ns); ok && (rest == "" || rest[0] == '/') {
+			add(rw.rule.Prefix + rest)
+		}
+	}
+	for _, pattern := range strings.Split(gf.config.Mask, ",") {
+		host, _, _ := strings.Cut(strings.Trim(strings.TrimSpace(pattern), "/"), "/")
+		if host != "" && !strings.ContainsAny(host, `*?[]\`) {
+			add(host + "/" + project)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,174 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jimu/components/sloghelper"
+)
+
+type (
+	ServerConfig struct {
+		Address string `json:"address" yaml:"address" toml:"address"` // defaults to DefaultServerAddress
+		// PathPrefix serves the proxy and its endpoints below a path, e.g. /goproxy behind a shared host
+		PathPrefix string    `json:"path_prefix" yaml:"path_prefix" toml:"path_prefix"`
+		TLS        TLSConfig `json:"tls" yaml:"tls" toml:"tls"`
+		// Timeouts of http.Server, 0 means the defaults below. WriteTimeout has no default: building the zip
+		// of a large project may take minutes.
+		ReadTimeout  time.Duration `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`
+		WriteTimeout time.Duration `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`
+		IdleTimeout  time.Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+		// ShutdownTimeout bounds how long a SIGTERM waits for the requests and downloads in flight
+		ShutdownTimeout time.Duration `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	}
+
+	// TLSConfig enables HTTPS. The PEM files are loaded again when they change, e.g. when cert-manager renews them.
+	TLSConfig struct {
+		Cert string `json:"cert" yaml:"cert" toml:"cert"`
+		Key  string `json:"key" yaml:"key" toml:"key"`
+	}
+
+	// Server is the http.Server of the proxy, configured by ServerConfig.
+	Server struct {
+		http *http.Server
+		conf ServerConfig
+	}
+
+	// certReloader serves the certificate of a TLSConfig, loading it again when one of its files is modified.
+	certReloader struct {
+		conf    TLSConfig
+		mu      sync.Mutex
+		cert    *tls.Certificate
+		modTime time.Time
+	}
+)
+
+const (
+	DefaultServerAddress   = ":8080"
+	DefaultReadTimeout     = 30 * time.Second
+	DefaultIdleTimeout     = 2 * time.Minute
+	DefaultShutdownTimeout = 5 * time.Minute
+)
+
+func NewServer(conf ServerConfig, handler http.Handler) (*Server, error) {
+	if conf.Address == "" {
+		conf.Address = DefaultServerAddress
+	}
+	if conf.ReadTimeout == 0 {
+		conf.ReadTimeout = DefaultReadTimeout
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = DefaultIdleTimeout
+	}
+	if conf.ShutdownTimeout == 0 {
+		conf.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if prefix := strings.Trim(conf.PathPrefix, "/"); prefix != "" {
+		conf.PathPrefix = "/" + prefix
+		handler = http.StripPrefix(conf.PathPrefix, handler)
+	}
+
+	srv := &http.Server{
+		Addr:         conf.Address,
+		Handler:      handler,
+		ReadTimeout:  conf.ReadTimeout,
+		WriteTimeout: conf.WriteTimeout,
+		IdleTimeout:  conf.IdleTimeout,
+	}
+	switch {
+	case conf.TLS.Cert == "" && conf.TLS.Key == "":
+	case conf.TLS.Cert == "" || conf.TLS.Key == "":
+		return nil, errors.New("tls: cert and key are both required")
+	default:
+		cr := &certReloader{conf: conf.TLS}
+		// fail at startup rather than at the first handshake
+		if _, err := cr.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: cr.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+	return &Server{http: srv, conf: conf}, nil
+}
+
+// ListenAndServe listens on the configured address, see Serve.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.conf.Address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, over TLS if configured, until Shutdown. It returns http.ErrServerClosed
+// after a Shutdown.
+func (s *Server) Serve(l net.Listener) error {
+	slog.Info("start to serve", slog.String("address", l.Addr().String()), slog.Bool("tls", s.http.TLSConfig != nil),
+		slog.String("path_prefix", s.conf.PathPrefix))
+	if s.http.TLSConfig != nil {
+		return s.http.ServeTLS(l, "", "")
+	}
+	return s.http.Serve(l)
+}
+
+// Shutdown stops accepting connections and waits for the requests in flight until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// ShutdownTimeout returns the configured or default ShutdownTimeout, to bound the ctx of Shutdown.
+func (s *Server) ShutdownTimeout() time.Duration {
+	return s.conf.ShutdownTimeout
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var modTime time.Time
+	for _, name := range []string{cr.conf.Cert, cr.conf.Key} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return cr.fallback(fmt.Errorf("tls: %w", err))
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.cert != nil && modTime.Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.conf.Cert, cr.conf.Key)
+	if err != nil {
+		// the files may be written one after the other, keep serving the previous pair meanwhile
+		if cr.cert != nil {
+			slog.Warn("failed to reload TLS certificate", slog.String("cert", cr.conf.Cert), sloghelper.Error(err))
+			return cr.cert, nil
+		}
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	if cr.cert != nil {
+		slog.Info("reloaded TLS certificate", slog.String("cert", cr.conf.Cert))
+	}
+	cr.cert, cr.modTime = &cert, modTime
+	return cr.cert, nil
+}
+
+// fallback returns the loaded certificate, if any, instead of err.
+func (cr *certReloader) fallback(err error) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.cert == nil {
+		return nil, err
+	}
+	slog.Warn("failed to reload TLS certificate", slog.String("cert", cr.conf.Cert), sloghelper.Error(err))
+	return cr.cert, nil
+}
@@ -0,0 +1,129 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a self-signed certificate for name and its key, modified at mtime.
+func writeCert(t *testing.T, certFile, keyFile, name string, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	for _, f := range []string{certFile, keyFile} {
+		assert.NoError(t, os.Chtimes(f, mtime, mtime))
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "first", time.Now().Add(-time.Minute))
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-release
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	})
+	srv, err := gitlabgoproxy.NewServer(gitlabgoproxy.ServerConfig{
+		PathPrefix: "goproxy/",
+		TLS:        gitlabgoproxy.TLSConfig{Cert: certFile, Key: keyFile},
+	}, handler)
+	assert.NoError(t, err)
+	assert.EqualValues(t, gitlabgoproxy.DefaultShutdownTimeout, srv.ShutdownTimeout())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get("https://" + l.Addr().String() + path)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(data)
+	}
+
+	// requests are served below the prefix
+	resp, body := get("/goproxy/gitlab.com/wongidle/foobar/@v/list")
+	assert.EqualValues(t, http.StatusOK, resp.StatusCode)
+	assert.EqualValues(t, "/gitlab.com/wongidle/foobar/@v/list", body)
+	assert.EqualValues(t, "first", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	resp, _ = get("/gitlab.com/wongidle/foobar/@v/list")
+	assert.EqualValues(t, http.StatusNotFound, resp.StatusCode)
+
+	// a renewed certificate is picked up by the next handshake
+	writeCert(t, certFile, keyFile, "second", time.Now())
+	resp, _ = get("/goproxy/")
+	assert.EqualValues(t, "second", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	assert.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	resp, _ = get("/goproxy/")
+	assert.EqualValues(t, "second", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// shutdown waits for the requests in flight
+	slow := make(chan string, 1)
+	go func() {
+		_, body := get("/goproxy/slow")
+		slow <- body
+	}()
+	<-entered
+	shut := make(chan error, 1)
+	go func() { shut <- srv.Shutdown(context.Background()) }()
+	select {
+	case <-shut:
+		t.Fatal("shutdown returned before the request in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-shut)
+	assert.EqualValues(t, "/slow", <-slow)
+	assert.True(t, errors.Is(<-served, http.ErrServerClosed))
+
+	for _, conf := range []gitlabgoproxy.ServerConfig{
+		{TLS: gitlabgoproxy.TLSConfig{Cert: certFile}},
+		{TLS: gitlabgoproxy.TLSConfig{Cert: certFile, Key: filepath.Join(dir, "missing.key")}},
+	} {
+		_, err = gitlabgoproxy.NewServer(conf, handler)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,64 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+type (
+	// StaleHandler marks the list and query responses that goproxy served from its cache because GitLab was
+	// unavailable. goproxy already falls back to the cached @v/list, @latest and .info responses when
+	// the fetcher fails, and serves the .info, .mod and .zip files of canonical versions from the cache
+	// without asking GitLab at all; StaleHandler only makes the fallback visible to clients.
+	StaleHandler struct {
+		Next http.Handler
+	}
+
+	staleKey struct{}
+
+	staleResponseWriter struct {
+		http.ResponseWriter
+		stale       *atomic.Bool
+		wroteHeader bool
+	}
+)
+
+// StaleHeader is set on responses served from the cache after GitLab failed.
+const StaleHeader = "X-Goproxy-Stale"
+
+func (h *StaleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stale := new(atomic.Bool)
+	ctx := context.WithValue(r.Context(), staleKey{}, stale)
+	h.Next.ServeHTTP(&staleResponseWriter{ResponseWriter: w, stale: stale}, r.WithContext(ctx))
+}
+
+// markStale records that the request failed because GitLab was unavailable, so that a successful
+// response can only come from the cache.
+func markStale(ctx context.Context) {
+	if stale, ok := ctx.Value(staleKey{}).(*atomic.Bool); ok {
+		stale.Store(true)
+	}
+}
+
+func (sw *staleResponseWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		if code < http.StatusBadRequest && sw.stale.Load() {
+			sw.Header().Set(StaleHeader, "true")
+			sw.Header().Set("Warning", `110 - "Response is Stale"`)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *staleResponseWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *staleResponseWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
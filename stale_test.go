@@ -0,0 +1,72 @@
+package gitlabgoproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goproxy/goproxy"
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleHandler(t *testing.T) {
+	fg := newFixtureGitLab(t)
+	f, err := gitlabgoproxy.NewGitlabFetcher(gitlabgoproxy.GitlabFetcherConfig{
+		Endpoint: fg.Endpoint(), Mask: "gitlab.com",
+		CircuitBreaker: gitlabgoproxy.CircuitBreakerConfig{Failures: 1, Cooldown: 2 * time.Second}})
+	assert.NoError(t, err)
+	srv := httptest.NewServer(&gitlabgoproxy.StaleHandler{Next: &goproxy.Goproxy{
+		Fetcher: &gitlabgoproxy.MixedFetcher{Masks: []*gitlabgoproxy.GitlabFetcher{f.(*gitlabgoproxy.GitlabFetcher)}},
+		Cacher:  goproxy.DirCacher(t.TempDir()),
+	}})
+	defer srv.Close()
+
+	get := func(target string) (int, string, http.Header) {
+		resp, err := http.Get(srv.URL + "/gitlab.com/wongidle/foobar/" + target)
+		assert.NoError(t, err, target)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err, target)
+		return resp.StatusCode, string(body), resp.Header
+	}
+
+	status, list, header := get("@v/list")
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.EqualValues(t, "v0.1.0\nv0.1.1\nv0.2.0", list)
+	assert.Empty(t, header.Get(gitlabgoproxy.StaleHeader))
+	status, mod, _ := get("@v/v0.1.0.mod")
+	assert.EqualValues(t, http.StatusOK, status)
+
+	// GitLab goes down: the breaker opens after the first failure, the cached list is served and marked
+	calls := fg.Calls("")
+	_, err = f.List(fg.Unavailable(t), "gitlab.com/wongidle/foobar")
+	assert.Error(t, err)
+	for range 2 {
+		status, body, header := get("@v/list")
+		assert.EqualValues(t, http.StatusOK, status)
+		assert.EqualValues(t, list, body)
+		assert.EqualValues(t, "true", header.Get(gitlabgoproxy.StaleHeader))
+	}
+	assert.EqualValues(t, calls+1, fg.Calls(""))
+
+	// immutable files come from the cache as usual, uncached responses fail
+	status, body, header := get("@v/v0.1.0.mod")
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.EqualValues(t, mod, body)
+	assert.Empty(t, header.Get(gitlabgoproxy.StaleHeader))
+	status, _, header = get("@latest")
+	assert.NotEqualValues(t, http.StatusOK, status)
+	assert.Empty(t, header.Get(gitlabgoproxy.StaleHeader))
+	assert.EqualValues(t, calls+1, fg.Calls(""))
+
+	// a probe after the cooldown closes the breaker
+	time.Sleep(2 * time.Second)
+	status, body, header = get("@v/list")
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.EqualValues(t, list, body)
+	assert.Empty(t, header.Get(gitlabgoproxy.StaleHeader))
+	assert.Greater(t, fg.Calls(""), calls+1)
+}
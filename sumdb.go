@@ -0,0 +1,180 @@
+package gitlabgoproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+type (
+	// checksumDB verifies downloaded modules against a checksum database, like GOSUMDB does for the go command.
+	checksumDB struct {
+		client *sumdb.Client
+	}
+
+	// sumdbOps keeps the state of the sumdb client in memory.
+	sumdbOps struct {
+		name   string
+		key    string
+		url    string
+		client *http.Client
+
+		mu     sync.Mutex
+		config map[string][]byte
+		cache  map[string][]byte
+	}
+)
+
+const (
+	sumGolangOrgKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"
+	// sumdbTimeout bounds a request to the checksum database, the sumdb client passes no context
+	sumdbTimeout = 30 * time.Second
+	// sumdbCacheSize bounds the cached lookups and tiles, the cache is dropped when it is full
+	sumdbCacheSize = 4096
+)
+
+// newChecksumDB parses a GOSUMDB value: "off", "sum.golang.org", or "<verifier key> [<url>]".
+// Modules matching the GONOSUMDB-style patterns noSumDB are not verified. Off returns nil.
+func newChecksumDB(gosumdb, noSumDB string, transport http.RoundTripper) (*checksumDB, error) {
+	if gosumdb == "" {
+		gosumdb = "sum.golang.org"
+	}
+	if gosumdb == "off" {
+		return nil, nil
+	}
+
+	fields := strings.Fields(gosumdb)
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("invalid sumdb %q", gosumdb)
+	}
+	key := fields[0]
+	if key == "sum.golang.org" {
+		key = sumGolangOrgKey
+	}
+	name, _, _ := strings.Cut(key, "+")
+	if name == "" || !strings.Contains(key, "+") {
+		return nil, fmt.Errorf("invalid sumdb key %q", key)
+	}
+	u := "https://" + name
+	if len(fields) == 2 {
+		u = strings.TrimSuffix(fields[1], "/")
+	}
+
+	ops := &sumdbOps{
+		name:   name,
+		key:    key,
+		url:    u,
+		client: &http.Client{Transport: transport, Timeout: sumdbTimeout},
+		config: make(map[string][]byte),
+		cache:  make(map[string][]byte),
+	}
+	c := sumdb.NewClient(ops)
+	c.SetGONOSUMDB(noSumDB)
+	return &checksumDB{client: c}, nil
+}
+
+// verify checks the go.mod and zip files of path@version against the checksum database.
+func (db *checksumDB) verify(path, version, mod, zip string) error {
+	modHash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) { return os.Open(mod) })
+	if err != nil {
+		return err
+	}
+	zipHash, err := dirhash.HashZip(zip, dirhash.Hash1)
+	if err != nil {
+		return err
+	}
+	if err = db.check(path, version+"/go.mod", modHash); err != nil {
+		return err
+	}
+	return db.check(path, version, zipHash)
+}
+
+// check reports an error unless the checksum database holds hash for path@version.
+func (db *checksumDB) check(path, version, hash string) error {
+	lines, err := db.client.Lookup(path, version)
+	if errors.Is(err, sumdb.ErrGONOSUMDB) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("verifying %s@%s: %w", path, version, err)
+	}
+	want := path + " " + version + " " + hash
+	for _, line := range lines {
+		if line == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("verifying %s@%s: checksum mismatch, %s is not in the checksum database", path, version, hash)
+}
+
+func (ops *sumdbOps) ReadRemote(path string) ([]byte, error) {
+	resp, err := ops.client.Get(ops.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s%s: %s: %s", ops.url, path, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+func (ops *sumdbOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(ops.key), nil
+	}
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	return ops.config[file], nil
+}
+
+func (ops *sumdbOps) WriteConfig(file string, old, new []byte) error {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if !bytes.Equal(ops.config[file], old) {
+		return sumdb.ErrWriteConflict
+	}
+	ops.config[file] = new
+	return nil
+}
+
+func (ops *sumdbOps) ReadCache(file string) ([]byte, error) {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	data, ok := ops.cache[file]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (ops *sumdbOps) WriteCache(file string, data []byte) {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if len(ops.cache) >= sumdbCacheSize {
+		clear(ops.cache)
+	}
+	ops.cache[file] = data
+}
+
+func (ops *sumdbOps) Log(msg string) {
+	slog.Debug(msg, slog.String("sumdb", ops.name))
+}
+
+func (ops *sumdbOps) SecurityError(msg string) {
+	slog.Error(msg, slog.String("sumdb", ops.name))
+}
@@ -0,0 +1,183 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// TracingConfig exports OpenTelemetry traces of the requests: the fetcher operations, the GitLab API calls,
+	// the steps of a download and the cache lookups and writes. The OTEL_* environment variables of the OTLP
+	// exporter and of the resource, e.g. OTEL_SERVICE_NAME, are honored.
+	TracingConfig struct {
+		Exporter string `json:"exporter" yaml:"exporter" toml:"exporter"` // "otlp" (over HTTP) or "stdout", empty disables tracing
+		// Endpoint of the OTLP collector as host:port, defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318
+		Endpoint string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+		Insecure bool   `json:"insecure" yaml:"insecure" toml:"insecure"` // send over HTTP instead of HTTPS
+		// SampleRatio of the traces started by the proxy, 0 means 1. Traces propagated by the client keep their decision.
+		SampleRatio float64 `json:"sample_ratio" yaml:"sample_ratio" toml:"sample_ratio"`
+	}
+
+	// TracingHandler starts the span of each request, continuing the trace of the client if it sent one.
+	TracingHandler struct {
+		Next http.Handler
+	}
+
+	// tracingTransport traces the GitLab API calls of a host. A span ends once the response body is closed, so
+	// that it covers the streaming of an archive.
+	tracingTransport struct {
+		base http.RoundTripper
+		host string
+	}
+
+	// statusWriter records the status code of a response.
+	statusWriter struct {
+		http.ResponseWriter
+		status int
+	}
+
+	tracedBody struct {
+		io.ReadCloser
+		span trace.Span
+		once sync.Once
+	}
+)
+
+const tracerName = "github.com/jacexh/gitlab-goproxy"
+
+// SetupTracing installs the tracer provider of conf and returns the function flushing the spans left at
+// shutdown. Without an exporter the spans are dropped.
+func SetupTracing(ctx context.Context, conf TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", conf.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName("gitlab-goproxy")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	ratio := conf.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// startSpan starts a span of the proxy. The tracer is looked up every time, so that a provider installed
+// later, e.g. by a test, is used.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err unless it only means that a module or file does not exist.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errNoVersions) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (h *TracingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method+" goproxy", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)))
+	defer span.End()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	h.Next.ServeHTTP(sw, r.WithContext(ctx))
+	span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+	if sw.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(sw.status))
+	}
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := gitlabEndpoint(req.URL)
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), "GitLab "+req.Method+" "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(req.Method), semconv.ServerAddress(tt.host),
+			attribute.String("gitlab.endpoint", endpoint)))
+	resp, err := tt.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+func (tb *tracedBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		tb.span.RecordError(err)
+		tb.span.SetStatus(codes.Error, err.Error())
+	}
+	return n, err
+}
+
+func (tb *tracedBody) Close() error {
+	err := tb.ReadCloser.Close()
+	tb.once.Do(func() { tb.span.End() })
+	return err
+}
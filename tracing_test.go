@@ -0,0 +1,104 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	gf, _ := newFixtureFetcher(t)
+	fetcher := &gitlabgoproxy.MixedFetcher{Masks: []*gitlabgoproxy.GitlabFetcher{gf}}
+	cache, err := gitlabgoproxy.NewCache(gitlabgoproxy.Config{})
+	assert.NoError(t, err)
+	handler := &gitlabgoproxy.TracingHandler{Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, mod, zip, err := fetcher.Download(r.Context(), "gitlab.com/wongidle/foobar", "v0.1.0")
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		assert.NoError(t, cache.Put(r.Context(), "gitlab.com/wongidle/foobar/@v/v0.1.0.zip", zip))
+		for _, f := range []io.Closer{info, mod, zip} {
+			f.Close()
+		}
+		_, err = readCache(t, cache, "gitlab.com/wongidle/foobar/@v/v0.1.1.zip")
+		assert.Error(t, err)
+		_, err = fetcher.List(r.Context(), "gitlab.com/wongidle/missing")
+		assert.Error(t, err)
+		w.WriteHeader(http.StatusNotFound)
+	})}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// the trace of the client is continued
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/gitlab.com/wongidle/foobar/@v/v0.1.0.zip", nil)
+	assert.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, http.StatusNotFound, resp.StatusCode)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		if _, ok := spans[s.Name()]; !ok {
+			spans[s.Name()] = s
+		}
+	}
+	parent := func(child, parent string) {
+		c, p := spans[child], spans[parent]
+		if assert.NotNil(t, c, child) && assert.NotNil(t, p, parent) {
+			assert.Equal(t, p.SpanContext().SpanID(), c.Parent().SpanID(), "parent of %s", child)
+		}
+	}
+	root := spans["GET goproxy"]
+	if assert.NotNil(t, root) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", root.Parent().SpanID().String())
+	}
+	parent("MixedFetcher.Download", "GET goproxy")
+	parent("MixedFetcher.List", "GET goproxy")
+	for _, step := range []string{"GitlabFetcher.Extract", "GitlabFetcher.SaveInfo", "GitlabFetcher.SaveGoMod", "GitlabFetcher.Archive"} {
+		parent(step, "MixedFetcher.Download")
+	}
+	parent("GitLab GET /projects/:id/repository/archive.zip", "GitlabFetcher.Archive")
+	parent("GitLab GET /projects/:id/repository/files/:file/raw", "GitlabFetcher.SaveGoMod")
+	parent("UnzipArchiveFromGitlab", "GitlabFetcher.Archive")
+	parent("zip.CreateFromDir", "GitlabFetcher.Archive")
+	parent("cache.Put", "GET goproxy")
+	if s := spans["cache.Get"]; assert.NotNil(t, s) {
+		assert.Contains(t, s.Attributes(), attribute.String("cache.tier", "memory"))
+	}
+	// a module that does not exist is not an error
+	if s := spans["MixedFetcher.List"]; assert.NotNil(t, s) {
+		assert.NotEqual(t, codes.Error, s.Status().Code)
+	}
+
+	for _, exporter := range []string{"", "stdout", "otlp"} {
+		flush, err := gitlabgoproxy.SetupTracing(ctx, gitlabgoproxy.TracingConfig{Exporter: exporter, Endpoint: "127.0.0.1:1"})
+		assert.NoError(t, err, exporter)
+		assert.NoError(t, flush(ctx), exporter)
+	}
+	_, err = gitlabgoproxy.SetupTracing(ctx, gitlabgoproxy.TracingConfig{Exporter: "jaeger"})
+	assert.Error(t, err)
+}
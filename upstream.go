@@ -0,0 +1,244 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jimu/components/sloghelper"
+	"github.com/goproxy/goproxy"
+)
+
+type (
+	UpstreamConfig struct {
+		// Proxy is a single upstream proxy followed by direct, kept for older configs. Direct needs the go
+		// command, which the runtime image does not have. Use Proxies instead.
+		Proxy   string          `json:"proxy" yaml:"proxy" toml:"proxy"`
+		Proxies []UpstreamProxy `json:"proxies" yaml:"proxies" toml:"proxies"`
+		// SumDB verifies the downloads like GOSUMDB: "sum.golang.org" (default), "off",
+		// or "<verifier key> [<url>]". NoSumDB lists module path patterns that are not verified, like GONOSUMDB.
+		SumDB   string `json:"sumdb" yaml:"sumdb" toml:"sumdb"`
+		NoSumDB string `json:"no_sumdb" yaml:"no_sumdb" toml:"no_sumdb"`
+	}
+
+	// UpstreamProxy is one entry of the upstream list, tried in order like the entries of GOPROXY.
+	UpstreamProxy struct {
+		URL string `json:"url" yaml:"url" toml:"url"` // proxy URL, or "direct" to fetch from the origin with the go command
+		// Fallback is "," (default) to try the next upstream only if this one does not have the module,
+		// or "|" to try it after any error, as in GOPROXY.
+		Fallback string        `json:"fallback" yaml:"fallback" toml:"fallback"`
+		Timeout  time.Duration `json:"timeout" yaml:"timeout" toml:"timeout"` // per request, 0 means no limit
+		Username string        `json:"username" yaml:"username" toml:"username"`
+		Password string        `json:"password" yaml:"password" toml:"password"`
+		Token    string        `json:"token" yaml:"token" toml:"token"` // sent as bearer token instead of username and password
+	}
+
+	// UpstreamStats counts the requests an upstream served and failed.
+	UpstreamStats struct {
+		Name   string
+		Served uint64
+		Failed uint64
+	}
+
+	// Upstreams fetches modules from a list of upstreams in order and records which one served each request.
+	Upstreams struct {
+		upstreams []*upstream
+	}
+
+	upstream struct {
+		name            string
+		fetcher         goproxy.Fetcher
+		fallbackOnError bool
+		timeout         time.Duration
+		served          atomic.Uint64
+		failed          atomic.Uint64
+		probe           func(context.Context) error // readiness check, nil for direct
+	}
+
+	authTransport struct {
+		base               http.RoundTripper
+		username, password string
+		token              string
+	}
+)
+
+var (
+	_ goproxy.Fetcher = (*Upstreams)(nil)
+
+	// defaultUpstreams is the default GOPROXY of the go command, direct is added by withDirect
+	defaultUpstreams = []UpstreamProxy{{URL: "https://proxy.golang.org"}}
+)
+
+func NewUpstreams(conf UpstreamConfig) (*Upstreams, error) {
+	proxies := conf.Proxies
+	switch {
+	case conf.Proxy != "" && len(proxies) > 0:
+		return nil, errors.New("upstream proxy and proxies are mutually exclusive")
+	case conf.Proxy != "":
+		// GOPROXY=<proxy>,direct, as it always meant
+		if _, err := exec.LookPath("go"); err != nil {
+			return nil, fmt.Errorf("upstream proxy falls back to direct, which needs the go command, list the upstreams under proxies instead: %w", err)
+		}
+		proxies = []UpstreamProxy{{URL: conf.Proxy}, {URL: "direct"}}
+	case len(proxies) == 0:
+		proxies = withDirect(defaultUpstreams)
+	}
+
+	db, err := newChecksumDB(conf.SumDB, conf.NoSumDB, http.DefaultTransport)
+	if err != nil {
+		return nil, err
+	}
+	us := &Upstreams{}
+	for _, p := range proxies {
+		u, err := newUpstream(p, conf, db)
+		if err != nil {
+			return nil, err
+		}
+		us.upstreams = append(us.upstreams, u)
+	}
+	return us, nil
+}
+
+// withDirect appends direct to proxies, as in "GOPROXY=<proxies>,direct", if the go command is available. The
+// runtime image has no go command: modules missing from the proxies are then not found, which is logged as a
+// warning at startup.
+func withDirect(proxies []UpstreamProxy) []UpstreamProxy {
+	if _, err := exec.LookPath("go"); err != nil {
+		slog.Warn("upstream direct is disabled without the go command, modules missing from the upstream proxy are not found; "+
+			"configure upstream.proxies explicitly", slog.String("proxy", proxies[0].URL), sloghelper.Error(err))
+		return proxies
+	}
+	return append(slices.Clip(proxies), UpstreamProxy{URL: "direct"})
+}
+
+func newUpstream(p UpstreamProxy, conf UpstreamConfig, db *checksumDB) (*upstream, error) {
+	if p.Fallback != "" && p.Fallback != "," && p.Fallback != "|" {
+		return nil, fmt.Errorf("upstream %s: fallback must be \",\" or \"|\", got %q", p.URL, p.Fallback)
+	}
+	u := &upstream{fallbackOnError: p.Fallback == "|"}
+
+	if p.URL == "direct" {
+		if p.Username != "" || p.Password != "" || p.Token != "" {
+			return nil, errors.New("upstream direct: credentials are not supported")
+		}
+		if _, err := exec.LookPath("go"); err != nil {
+			return nil, fmt.Errorf("upstream direct needs the go command: %w", err)
+		}
+		u.name = "direct"
+		u.timeout = p.Timeout
+		env := append(os.Environ(), "GOPROXY=direct", "GONOPROXY=", "GOPRIVATE=", "GONOSUMDB="+conf.NoSumDB)
+		if conf.SumDB != "" {
+			env = append(env, "GOSUMDB="+conf.SumDB)
+		}
+		u.fetcher = &goproxy.GoFetcher{Env: env}
+		return u, nil
+	}
+
+	pu, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", p.URL, err)
+	}
+	if (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return nil, fmt.Errorf("upstream %s: not an http(s) URL", pu.Redacted())
+	}
+	u.name = pu.Redacted()
+	var transport http.RoundTripper = http.DefaultTransport
+	if p.Username != "" || p.Password != "" || p.Token != "" {
+		transport = &authTransport{base: transport, username: p.Username, password: p.Password, token: p.Token}
+	}
+	// the proxy fetcher applies the timeout itself, its downloaded files must outlive it
+	u.fetcher = newProxyFetcher(pu, transport, p.Timeout, db)
+	u.probe = newUpstreamProbe(pu.String(), transport)
+	return u, nil
+}
+
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if at.token != "" {
+		req.Header.Set("Authorization", "Bearer "+at.token)
+	} else {
+		req.SetBasicAuth(at.username, at.password)
+	}
+	return at.base.RoundTrip(req)
+}
+
+// walk calls fn with the upstreams in order until one succeeds or fails without falling back.
+func (us *Upstreams) walk(ctx context.Context, fn func(context.Context, *upstream) error) (string, error) {
+	lastErr := fmt.Errorf("%w: no upstream proxy", fs.ErrNotExist)
+	for _, u := range us.upstreams {
+		uCtx, cancel := ctx, context.CancelFunc(func() {})
+		if u.timeout > 0 {
+			uCtx, cancel = context.WithTimeout(ctx, u.timeout)
+		}
+		err := fn(uCtx, u)
+		cancel()
+		if err == nil {
+			u.served.Add(1)
+			return u.name, nil
+		}
+		u.failed.Add(1)
+		lastErr = fmt.Errorf("upstream %s: %w", u.name, err)
+		if !u.fallbackOnError && !errors.Is(err, fs.ErrNotExist) {
+			return u.name, lastErr
+		}
+	}
+	return "", lastErr
+}
+
+func (us *Upstreams) Query(ctx context.Context, path, query string) (version string, t time.Time, err error) {
+	name, err := us.walk(ctx, func(ctx context.Context, u *upstream) error {
+		var errQuery error
+		version, t, errQuery = u.fetcher.Query(ctx, path, query)
+		return errQuery
+	})
+	us.record("query", name, path, err, slog.String("query", query))
+	return version, t, err
+}
+
+func (us *Upstreams) List(ctx context.Context, path string) (versions []string, err error) {
+	name, err := us.walk(ctx, func(ctx context.Context, u *upstream) error {
+		var errList error
+		versions, errList = u.fetcher.List(ctx, path)
+		return errList
+	})
+	us.record("list", name, path, err)
+	return versions, err
+}
+
+func (us *Upstreams) Download(ctx context.Context, path, version string) (info, mod, zip io.ReadSeekCloser, err error) {
+	name, err := us.walk(ctx, func(ctx context.Context, u *upstream) error {
+		var errDownload error
+		info, mod, zip, errDownload = u.fetcher.Download(ctx, path, version)
+		return errDownload
+	})
+	us.record("download", name, path, err, slog.String("version", version))
+	return info, mod, zip, err
+}
+
+func (us *Upstreams) record(op, name, path string, err error, attrs ...any) {
+	attrs = append(attrs, slog.String("op", op), slog.String("path", path), slog.String("upstream", name))
+	if err != nil {
+		slog.Warn("upstream request failed", append(attrs, sloghelper.Error(err))...)
+		return
+	}
+	slog.Info("served by upstream", attrs...)
+}
+
+// Stats returns the counters of every upstream, in order.
+func (us *Upstreams) Stats() []UpstreamStats {
+	ret := make([]UpstreamStats, 0, len(us.upstreams))
+	for _, u := range us.upstreams {
+		ret = append(ret, UpstreamStats{Name: u.name, Served: u.served.Load(), Failed: u.failed.Load()})
+	}
+	return ret
+}
@@ -0,0 +1,141 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeProxy serves versions of every module, or status if it is not 200.
+// A non-empty auth is the Authorization header it requires.
+func newFakeProxy(t *testing.T, status int, auth string, delay time.Duration, versions ...string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if auth != "" && r.Header.Get("Authorization") != auth {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/@v/list"):
+			_, _ = w.Write([]byte(strings.Join(versions, "\n") + "\n"))
+		case strings.HasSuffix(r.URL.Path, "/@latest"):
+			_, _ = w.Write([]byte(`{"Version":"` + versions[len(versions)-1] + `","Time":"2024-06-28T09:04:20Z"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUpstreams(t *testing.T) {
+	ctx := context.Background()
+	missing := newFakeProxy(t, http.StatusNotFound, "", 0)
+	forbidden := newFakeProxy(t, http.StatusForbidden, "", 0)
+	slow := newFakeProxy(t, http.StatusOK, "", 2*time.Second, "v0.0.1")
+	basic := newFakeProxy(t, http.StatusOK, "Basic dXNlcjpzZWNyZXQ=", 0, "v1.0.0", "v1.1.0")
+	bearer := newFakeProxy(t, http.StatusOK, "Bearer token", 0, "v2.0.0")
+
+	for _, c := range []struct {
+		name     string
+		proxies  []gitlabgoproxy.UpstreamProxy
+		expected []string
+		stats    []uint64 // served, failed of each upstream
+	}{
+		{"fall back on not found", []gitlabgoproxy.UpstreamProxy{
+			{URL: missing.URL}, {URL: basic.URL, Username: "user", Password: "secret"}},
+			[]string{"v1.0.0", "v1.1.0"}, []uint64{0, 1, 1, 0}},
+		{"stop on other errors", []gitlabgoproxy.UpstreamProxy{
+			{URL: forbidden.URL}, {URL: basic.URL, Username: "user", Password: "secret"}},
+			nil, []uint64{0, 1, 0, 0}},
+		{"fall back on any error", []gitlabgoproxy.UpstreamProxy{
+			{URL: forbidden.URL, Fallback: "|"}, {URL: bearer.URL, Token: "token"}},
+			[]string{"v2.0.0"}, []uint64{0, 1, 1, 0}},
+		{"timeout", []gitlabgoproxy.UpstreamProxy{
+			{URL: slow.URL, Fallback: "|", Timeout: 100 * time.Millisecond}, {URL: bearer.URL, Token: "token"}},
+			[]string{"v2.0.0"}, []uint64{0, 1, 1, 0}},
+		{"missing credentials", []gitlabgoproxy.UpstreamProxy{{URL: bearer.URL}}, nil, []uint64{0, 1}},
+		{"no direct", []gitlabgoproxy.UpstreamProxy{{URL: missing.URL}}, nil, []uint64{0, 1}},
+	} {
+		us, err := gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{Proxies: c.proxies})
+		assert.NoError(t, err, c.name)
+		versions, err := us.List(ctx, "example.com/foo/bar")
+		if c.expected == nil {
+			assert.Error(t, err, c.name)
+		} else {
+			assert.NoError(t, err, c.name)
+			assert.EqualValues(t, c.expected, versions, c.name)
+		}
+		stats := make([]uint64, 0, len(c.stats))
+		for _, s := range us.Stats() {
+			stats = append(stats, s.Served, s.Failed)
+		}
+		assert.EqualValues(t, c.stats, stats, c.name)
+	}
+
+	// the last upstream does not have the module
+	us, err := gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{Proxies: []gitlabgoproxy.UpstreamProxy{{URL: missing.URL}}})
+	assert.NoError(t, err)
+	_, _, err = us.Query(ctx, "example.com/foo/bar", "latest")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// served by the second upstream, credentials are redacted from its name
+	us, err = gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{Proxies: []gitlabgoproxy.UpstreamProxy{
+		{URL: missing.URL}, {URL: strings.Replace(basic.URL, "http://", "http://user:secret@", 1)}}})
+	assert.NoError(t, err)
+	version, _, err := us.Query(ctx, "example.com/foo/bar", "latest")
+	assert.NoError(t, err)
+	assert.EqualValues(t, "v1.1.0", version)
+	stats := us.Stats()
+	assert.EqualValues(t, strings.Replace(basic.URL, "http://", "http://user:xxxxx@", 1), stats[1].Name)
+	assert.EqualValues(t, 1, stats[1].Served)
+
+	// default and legacy configs fall back to direct like the go command, if it is available
+	us, err = gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []gitlabgoproxy.UpstreamStats{{Name: "https://proxy.golang.org"}, {Name: "direct"}}, us.Stats())
+	us, err = gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{Proxy: "https://goproxy.cn"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []gitlabgoproxy.UpstreamStats{{Name: "https://goproxy.cn"}, {Name: "direct"}}, us.Stats())
+
+	for _, conf := range []gitlabgoproxy.UpstreamConfig{
+		{Proxy: "https://goproxy.cn", Proxies: []gitlabgoproxy.UpstreamProxy{{URL: "direct"}}},
+		{Proxies: []gitlabgoproxy.UpstreamProxy{{URL: "https://goproxy.cn", Fallback: ";"}}},
+		{Proxies: []gitlabgoproxy.UpstreamProxy{{URL: "goproxy.cn"}}},
+		{Proxies: []gitlabgoproxy.UpstreamProxy{{URL: "direct", Token: "token"}}},
+	} {
+		_, err = gitlabgoproxy.NewUpstreams(conf)
+		assert.Error(t, err)
+	}
+
+	// without the go command, direct and the legacy config are refused at startup, the default config goes
+	// without direct
+	t.Setenv("PATH", t.TempDir())
+	for _, conf := range []gitlabgoproxy.UpstreamConfig{
+		{Proxies: []gitlabgoproxy.UpstreamProxy{{URL: "direct"}}},
+		{Proxy: "https://goproxy.cn"},
+	} {
+		_, err = gitlabgoproxy.NewUpstreams(conf)
+		assert.Error(t, err)
+	}
+	us, err = gitlabgoproxy.NewUpstreams(gitlabgoproxy.UpstreamConfig{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, []gitlabgoproxy.UpstreamStats{{Name: "https://proxy.golang.org"}}, us.Stats())
+}
@@ -0,0 +1,338 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+const pseudoTimeFormat = "20060102150405"
+
+// Resolve maps a revision (branch name, tag or commit hash) of a module to a Locator whose
+// Version is the canonical version of that revision: the tag itself when the commit carries a
+// matching semver tag, otherwise a pseudo-version based on the nearest reachable tag.
+//
+//	gitlab.com/wongidle/foobar main -> wongidle/foobar | "" | <sha> | v0.2.1-0.yyyymmddhhmmss-abcdefabcdef
+//	gitlab.com/wongidle/mutiples/pkg/str/v2 3f2a9c1 -> wongidle/mutiples | pkg/str | <sha> | v2.0.3-0.yyyymmddhhmmss-3f2a9c1...
+func (gf *GitlabFetcher) Resolve(ctx context.Context, path, rev string) (*Locator, error) {
+	repo, subs, major, err := gf.ExtractSubPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return gf.resolveRevision(ctx, repo, strings.Join(subs, "/"), major, rev)
+}
+
+// QueryVersion resolves a version query the way the go command does:
+//
+//	latest, upgrade, patch -> highest release, else highest prerelease, else pseudo-version of the default branch
+//	v1, v1.2               -> highest release with the prefix, else highest prerelease with the prefix
+//	<v2, <=v1.2.0          -> highest version below the target, releases first
+//	>v1.2.0, >=v1.2.0      -> lowest version above the target, releases first
+//
+// The proxy has no notion of the version currently required, so upgrade and patch behave like latest.
+func (gf *GitlabFetcher) QueryVersion(ctx context.Context, path, query string) (*Locator, error) {
+	repo, subs, major, err := gf.ExtractSubPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	subPath := strings.Join(subs, "/")
+	tags, err := gf.gitlab.ListTags(ctx, repo, tagPrefix(subPath)+"v")
+	if err != nil {
+		return nil, err
+	}
+	candidates := filterTags(tags, subPath, major)
+	if major == "" {
+		incompatible, err := gf.incompatibleTags(ctx, repo, subPath, path, tags, candidates, isLatestQuery(query))
+		if err != nil {
+			return nil, err
+		}
+		candidates = sortVersions(append(candidates, incompatible...))
+	}
+	matched, err := matchQuery(query, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if matched != nil {
+		ref := tagPrefix(subPath) + strings.TrimSuffix(matched.Version, "+incompatible")
+		return &Locator{Repository: repo, SubPath: subPath, Ref: ref, Version: matched.Version}, nil
+	}
+	if !isLatestQuery(query) {
+		return nil, fmt.Errorf("no matching versions for query %q", query)
+	}
+
+	branch, err := gf.gitlab.DefaultBranch(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("no tagged versions, falling back to the default branch", slog.String("project", repo),
+		slog.String("subpath", subPath), slog.String("branch", branch))
+	return gf.resolveRevision(ctx, repo, subPath, major, branch)
+}
+
+func (gf *GitlabFetcher) resolveRevision(ctx context.Context, repo, subPath, major, rev string) (*Locator, error) {
+	commit, err := gf.gitlab.GetCommit(ctx, repo, rev)
+	if err != nil {
+		slog.Warn("failed to resolve revision", slog.String("project", repo), slog.String("revision", rev), slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	loc := &Locator{Repository: repo, SubPath: subPath, Ref: commit.Commit}
+	if loc.SubPath != "" {
+		ok, err := gf.hasGoMod(ctx, repo, loc.SubPath, commit.Commit)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			slog.Warn("no go.mod found in subpath", slog.String("project", repo),
+				slog.String("subpath", loc.SubPath), slog.String("revision", rev))
+			return nil, errors.New("invalid module path")
+		}
+	}
+
+	tags, err := gf.gitlab.ListTags(ctx, repo, tagPrefix(loc.SubPath)+"v")
+	if err != nil {
+		return nil, err
+	}
+	tags = filterTags(tags, loc.SubPath, major)
+
+	// A tagged commit is served under its tag
+	for _, tag := range tags {
+		if tag.Commit == commit.Commit {
+			loc.Ref = tagPrefix(loc.SubPath) + tag.Version
+			loc.Version = tag.Version
+			return loc, nil
+		}
+	}
+
+	older := ""
+	for _, tag := range tags {
+		ok, err := gf.gitlab.IsAncestor(ctx, repo, tag.Commit, commit.Commit)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			older = tag.Version
+			break
+		}
+	}
+	loc.Version = module.PseudoVersion(major, older, commit.Time, commit.Commit[:12])
+	return loc, nil
+}
+
+// resolvePseudoVersion returns the commit a pseudo-version refers to, making sure the
+// timestamp encoded in the version matches the commit time.
+func (gf *GitlabFetcher) resolvePseudoVersion(ctx context.Context, repo, version string) (*Info, error) {
+	rev, err := module.PseudoVersionRev(version)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := gf.gitlab.GetCommit(ctx, repo, rev)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(commit.Commit, rev) {
+		return nil, fmt.Errorf("invalid pseudo-version %s: revision %s resolved to %s", version, rev, commit.Commit)
+	}
+	t, err := module.PseudoVersionTime(version)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Equal(commit.Time.UTC().Truncate(time.Second)) {
+		return nil, fmt.Errorf("invalid pseudo-version %s: does not match commit time %s",
+			version, commit.Time.UTC().Format(pseudoTimeFormat))
+	}
+	return commit, nil
+}
+
+// checkVersion verifies that the base tag of a pseudo-version is an ancestor of its commit, and that
+// +incompatible versions point at a tag without a go.mod declaring a major version suffix.
+// commit is nil for locators that point at a tag.
+func (gf *GitlabFetcher) checkVersion(ctx context.Context, loc *Locator, commit *Info, path string) (*Locator, error) {
+	if commit == nil {
+		if !strings.HasSuffix(loc.Version, "+incompatible") {
+			return loc, nil
+		}
+		ok, err := gf.isIncompatible(ctx, loc.Repository, loc.Ref, path)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !ok && loc.SubPath != "":
+			return nil, fmt.Errorf("invalid version %s: +incompatible suffix not allowed for a module in a subdirectory", loc.Version)
+		case !ok:
+			return nil, fmt.Errorf("invalid version %s: module contains a go.mod file, so module path must match major version", loc.Version)
+		}
+		return loc, nil
+	}
+
+	base, err := module.PseudoVersionBase(loc.Version)
+	if err != nil {
+		return nil, err
+	}
+	base = strings.TrimSuffix(base, "+incompatible")
+	if base == "" {
+		return loc, nil
+	}
+	tag, err := gf.gitlab.GetTag(ctx, loc.Repository, tagPrefix(loc.SubPath)+base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pseudo-version %s: base tag %s: %w", loc.Version, base, err)
+	}
+	ok, err := gf.gitlab.IsAncestor(ctx, loc.Repository, tag.Commit, commit.Commit)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid pseudo-version %s: tag %s is not an ancestor of %s", loc.Version, base, commit.Commit)
+	}
+	return loc, nil
+}
+
+// isCanonical reports whether v is a canonical version, +incompatible included.
+func isCanonical(v string) bool {
+	return semver.Canonical(v) == strings.TrimSuffix(v, "+incompatible")
+}
+
+// isVersionQuery reports whether query is a version query rather than a canonical version or a revision.
+func isVersionQuery(query string) bool {
+	return isLatestQuery(query) || strings.HasPrefix(query, "<") || strings.HasPrefix(query, ">") || semver.IsValid(query)
+}
+
+func isLatestQuery(query string) bool {
+	return query == "latest" || query == "upgrade" || query == "patch"
+}
+
+// matchQuery picks the version a query resolves to from versions sorted from highest to lowest.
+// It returns nil when nothing matches.
+func matchQuery(query string, versions []*Info) (*Info, error) {
+	var match func(v string) bool
+	lowest := false
+	switch {
+	case isLatestQuery(query):
+		match = func(string) bool { return true }
+	case strings.HasPrefix(query, "<="), strings.HasPrefix(query, ">="),
+		strings.HasPrefix(query, "<"), strings.HasPrefix(query, ">"):
+		op := query[:1]
+		if strings.HasPrefix(query[1:], "=") {
+			op = query[:2]
+		}
+		target := query[len(op):]
+		if !semver.IsValid(target) {
+			return nil, fmt.Errorf("invalid version query %q", query)
+		}
+		lowest = op[0] == '>'
+		match = func(v string) bool {
+			c := semver.Compare(v, target)
+			switch op {
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			default:
+				return c >= 0
+			}
+		}
+	case semver.IsValid(query):
+		match = func(v string) bool { return strings.HasPrefix(v, query+".") }
+	default:
+		return nil, fmt.Errorf("invalid version query %q", query)
+	}
+
+	var release, prerelease *Info
+	for i := range versions {
+		v := versions[i]
+		if lowest {
+			v = versions[len(versions)-1-i]
+		}
+		if !match(v.Version) {
+			continue
+		}
+		if semver.Prerelease(v.Version) == "" {
+			release = v
+			break
+		}
+		if prerelease == nil {
+			prerelease = v
+		}
+	}
+	if release != nil {
+		return release, nil
+	}
+	return prerelease, nil
+}
+
+// tagPrefix returns the tag prefix of the module in subPath: "" for the root module, "pkg/str/" for a submodule.
+func tagPrefix(subPath string) string {
+	if subPath == "" {
+		return ""
+	}
+	return subPath + "/"
+}
+
+// filterTags strips the submodule prefix from tag names and keeps only canonical semver tags
+// belonging to the major version, sorted from highest to lowest. An empty major matches v0 and v1.
+func filterTags(tags []*Info, subPath, major string) []*Info {
+	prefix := tagPrefix(subPath)
+	ret := make([]*Info, 0, len(tags))
+	for _, tag := range tags {
+		v, ok := strings.CutPrefix(tag.Version, prefix)
+		if !ok || !semver.IsValid(v) || semver.Canonical(v) != v || module.IsPseudoVersion(v) {
+			continue
+		}
+		switch m := semver.Major(v); {
+		case major == "" && m != "v0" && m != "v1":
+			continue
+		case major != "" && m != major:
+			continue
+		}
+		ret = append(ret, &Info{Version: v, Time: tag.Time, Commit: tag.Commit})
+	}
+	return sortVersions(ret)
+}
+
+// incompatibleTags returns the v2+ tags of a module without major version suffix that can be served as
+// +incompatible. Like the go command, latest queries skip them when the highest compatible version has a go.mod.
+func (gf *GitlabFetcher) incompatibleTags(ctx context.Context, repo, subPath, modPath string, tags, compatible []*Info, latest bool) ([]*Info, error) {
+	if latest && len(compatible) > 0 {
+		ok, err := gf.hasGoMod(ctx, repo, subPath, tagPrefix(subPath)+compatible[0].Version)
+		if err != nil || ok {
+			return nil, err
+		}
+	}
+
+	prefix := tagPrefix(subPath)
+	ret := make([]*Info, 0)
+	for _, tag := range tags {
+		v, ok := strings.CutPrefix(tag.Version, prefix)
+		if !ok || !semver.IsValid(v) || semver.Canonical(v) != v || module.IsPseudoVersion(v) {
+			continue
+		}
+		if m := semver.Major(v); m == "v0" || m == "v1" {
+			continue
+		}
+		ok, err := gf.isIncompatible(ctx, repo, tag.Version, modPath)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ret = append(ret, &Info{Version: v + "+incompatible", Time: tag.Time, Commit: tag.Commit})
+		}
+	}
+	return ret, nil
+}
+
+// sortVersions sorts versions from highest to lowest.
+func sortVersions(versions []*Info) []*Info {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return semver.Compare(versions[i].Version, versions[j].Version) > 0
+	})
+	return versions
+}
@@ -0,0 +1,278 @@
+package gitlabgoproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jimu/components/sloghelper"
+	"github.com/goproxy/goproxy"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+type (
+	WebhookConfig struct {
+		Secret   string `json:"secret" yaml:"secret" toml:"secret"`       // secret token of the GitLab webhooks, empty disables the endpoint
+		Prebuild bool   `json:"prebuild" yaml:"prebuild" toml:"prebuild"` // download and cache the module versions of pushed tags
+	}
+
+	// WebhookHandler receives GitLab project and system webhooks at WebhookPath and hands every other request
+	// to Next. Tag push and tag delete events drop the cached list and latest responses of the module the tag
+	// belongs to, a tag pkg/str/v2.0.2 of gitlab.com/group/project belongs to gitlab.com/group/project/pkg/str/v2.
+	// Project rename and transfer events drop them for every module of the old and the new project path.
+	//
+	// Module paths are derived from project paths through the prefix rewrite rules and the literal hosts of the
+	// masks, modules only reachable through pattern rules are not invalidated.
+	WebhookHandler struct {
+		Cache    goproxy.Cacher
+		Fetcher  *MixedFetcher
+		Secret   string
+		Prebuild bool
+		Next     http.Handler
+		wg       sync.WaitGroup
+	}
+
+	// webhookEvent holds the fields of tag push events, from project or system hooks, and of project rename
+	// and transfer system events.
+	webhookEvent struct {
+		ObjectKind string `json:"object_kind"`
+		EventName  string `json:"event_name"`
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Project    struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+			WebURL            string `json:"web_url"`
+		} `json:"project"`
+		PathWithNamespace    string `json:"path_with_namespace"`
+		OldPathWithNamespace string `json:"old_path_with_namespace"`
+	}
+
+	// webhookVersion is a module version a tag may stand for.
+	webhookVersion struct {
+		gf      *GitlabFetcher
+		path    string
+		version string
+	}
+)
+
+// WebhookPath is where GitLab delivers the webhooks.
+const WebhookPath = "/-/webhook"
+
+// prebuildTimeout bounds the download of a pushed tag.
+const prebuildTimeout = 10 * time.Minute
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WebhookPath {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	token := r.Header.Get("X-Gitlab-Token")
+	if h.Secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.Secret)) != 1 {
+		http.Error(w, "invalid webhook token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ca, ok := h.Cache.(CacheAdmin)
+	if !ok {
+		http.Error(w, "the cache cannot be invalidated", http.StatusNotImplemented)
+		return
+	}
+	var ev webhookEvent
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&ev); err != nil {
+		http.Error(w, "bad webhook payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var invalidated, prebuild []string
+	var err error
+	kind := ev.EventName
+	if kind == "" {
+		kind = ev.ObjectKind
+	}
+	switch kind {
+	case "tag_push":
+		invalidated, prebuild, err = h.tagPush(r.Context(), ca, &ev)
+	case "project_rename", "project_transfer":
+		invalidated, err = h.projectMove(r.Context(), ca, &ev)
+	default:
+		// GitLab disables hooks which keep failing, other events are acknowledged and ignored
+		slog.Debug("ignored webhook event", slog.String("event", kind))
+	}
+	if err != nil {
+		slog.Error("failed to handle webhook event", slog.String("event", kind), sloghelper.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string][]string{"invalidated": invalidated, "prebuild": prebuild})
+}
+
+// Wait blocks until the pending prebuilds are done.
+func (h *WebhookHandler) Wait() {
+	h.wg.Wait()
+}
+
+// tagPush invalidates the module a tag belongs to and starts its prebuild unless the tag was deleted.
+func (h *WebhookHandler) tagPush(ctx context.Context, ca CacheAdmin, ev *webhookEvent) (invalidated, prebuild []string, err error) {
+	tag, ok := strings.CutPrefix(ev.Ref, "refs/tags/")
+	project := ev.Project.PathWithNamespace
+	if !ok || project == "" {
+		return nil, nil, nil
+	}
+	deleted := ev.After != "" && strings.Trim(ev.After, "0") == ""
+	slog.Info("received tag webhook", slog.String("project", project), slog.String("tag", tag), slog.Bool("deleted", deleted))
+
+	dir, version := "", tag
+	if i := strings.LastIndex(tag, "/"); i >= 0 {
+		dir, version = tag[:i], tag[i+1:]
+	}
+	if !semver.IsValid(version) {
+		return nil, nil, nil
+	}
+
+	var candidates []webhookVersion
+	for _, gf := range h.masks(ev.Project.WebURL) {
+		gf.Invalidate(project)
+		for _, base := range h.modulePaths(gf, project) {
+			mp := base
+			if dir != "" {
+				mp += "/" + dir
+			}
+			switch major := semver.Major(version); {
+			case major == "v0" || major == "v1":
+				candidates = append(candidates, webhookVersion{gf, mp, version})
+			case dir != "":
+				// a module in a subdirectory cannot be +incompatible
+				candidates = append(candidates, webhookVersion{gf, mp + "/" + major, version})
+			default:
+				candidates = append(candidates, webhookVersion{gf, mp + "/" + major, version},
+					webhookVersion{gf, mp, version + "+incompatible"})
+			}
+		}
+	}
+
+	for _, c := range candidates {
+		escaped, err := module.EscapePath(c.path)
+		if err != nil {
+			continue
+		}
+		for _, name := range []string{escaped + "/@v/list", escaped + "/@latest"} {
+			if err = ca.Delete(ctx, name); err != nil {
+				return nil, nil, err
+			}
+			invalidated = append(invalidated, name)
+		}
+	}
+	if deleted || !h.Prebuild || len(candidates) == 0 {
+		return invalidated, nil, nil
+	}
+
+	for _, c := range candidates {
+		prebuild = append(prebuild, c.path+"@"+c.version)
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), prebuildTimeout)
+		defer cancel()
+		h.prebuild(ctx, candidates)
+	}()
+	return invalidated, prebuild, nil
+}
+
+// prebuild downloads and caches the first candidate that is a module version.
+func (h *WebhookHandler) prebuild(ctx context.Context, candidates []webhookVersion) {
+	for _, c := range candidates {
+		if module.Check(c.path, c.version) != nil {
+			continue
+		}
+		info, mod, zip, err := c.gf.Download(ctx, c.path, c.version)
+		if err != nil {
+			slog.Debug("tag is not a version of the module", slog.String("path", c.path), slog.String("version", c.version), sloghelper.Error(err))
+			continue
+		}
+		err = putVersion(ctx, h.Cache, c.path, c.version, info, mod, zip)
+		_ = info.Close()
+		_ = mod.Close()
+		_ = zip.Close()
+		if err != nil {
+			slog.Error("failed to cache prebuilt module version", slog.String("path", c.path), slog.String("version", c.version), sloghelper.Error(err))
+			return
+		}
+		slog.Info("prebuilt module version", slog.String("path", c.path), slog.String("version", c.version))
+		return
+	}
+	slog.Warn("no module version to prebuild", slog.String("path", candidates[0].path), slog.String("version", candidates[0].version))
+}
+
+// projectMove invalidates the modules of the old and the new path of a renamed or transferred project.
+func (h *WebhookHandler) projectMove(ctx context.Context, ca CacheAdmin, ev *webhookEvent) ([]string, error) {
+	slog.Info("received project webhook", slog.String("project", ev.PathWithNamespace), slog.String("old", ev.OldPathWithNamespace))
+	var invalidated []string
+	for _, project := range []string{ev.OldPathWithNamespace, ev.PathWithNamespace} {
+		if project == "" {
+			continue
+		}
+		for _, gf := range h.masks("") {
+			gf.Invalidate(project)
+			for _, base := range h.modulePaths(gf, project) {
+				escaped, err := module.EscapePath(base)
+				if err != nil {
+					continue
+				}
+				// the module of the project itself and its submodules and major versions
+				entries, err := ca.Entries(ctx, escaped+"/")
+				if err != nil {
+					return nil, err
+				}
+				for _, e := range entries {
+					if strings.HasSuffix(e.Name, "/@v/list") || strings.HasSuffix(e.Name, "/@latest") {
+						if err = ca.Delete(ctx, e.Name); err != nil {
+							return nil, err
+						}
+						invalidated = append(invalidated, e.Name)
+					}
+				}
+			}
+		}
+	}
+	return invalidated, nil
+}
+
+// masks returns the masks of the GitLab instance serving webURL, or every mask if webURL is unknown.
+func (h *WebhookHandler) masks(webURL string) []*GitlabFetcher {
+	u, err := url.Parse(webURL)
+	if webURL == "" || err != nil {
+		return h.Fetcher.masks()
+	}
+	var ret []*GitlabFetcher
+	for _, gf := range h.Fetcher.masks() {
+		if mu, err := url.Parse(gf.webURL()); err == nil && strings.EqualFold(mu.Host, u.Host) {
+			ret = append(ret, gf)
+		}
+	}
+	return ret
+}
+
+// modulePaths returns the module paths of project that are routed to gf.
+func (h *WebhookHandler) modulePaths(gf *GitlabFetcher, project string) []string {
+	var ret []string
+	for _, p := range gf.modulePaths(project) {
+		if h.Fetcher.Route(p) == gf && module.CheckPath(p) == nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,144 @@
+package gitlabgoproxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gitlabgoproxy "github.com/jacexh/gitlab-goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	ctx := context.Background()
+	fg := newFixtureGitLab(t)
+	var masks []*gitlabgoproxy.GitlabFetcher
+	for _, conf := range []gitlabgoproxy.GitlabFetcherConfig{
+		{Endpoint: fg.Endpoint(), Mask: "gitlab.com"},
+		{Endpoint: fg.Endpoint(), Mask: "go.corp.example", Rewrites: []gitlabgoproxy.RewriteRule{
+			{Prefix: "go.corp.example/payments", Namespace: "backend/payments"}}},
+	} {
+		f, err := gitlabgoproxy.NewGitlabFetcher(conf)
+		assert.NoError(t, err)
+		masks = append(masks, f.(*gitlabgoproxy.GitlabFetcher))
+	}
+	cache, err := gitlabgoproxy.NewCache(gitlabgoproxy.Config{})
+	assert.NoError(t, err)
+	for _, name := range []string{
+		"gitlab.com/wongidle/mutiples/pkg/str/v2/@v/list",
+		"gitlab.com/wongidle/mutiples/pkg/str/v2/@latest",
+		"gitlab.com/wongidle/mutiples/v2/@v/list",
+		"gitlab.com/wongidle/foobar/@v/list",
+		"gitlab.com/wongidle/foobar/@latest",
+		"gitlab.com/wongidle/foobar/@v/v0.1.0.info",
+		"gitlab.com/wongidle/foobar/pkg/@v/list",
+		"go.corp.example/payments/ledger/api/@v/list",
+	} {
+		assert.NoError(t, cache.Put(ctx, name, strings.NewReader(name)))
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := &gitlabgoproxy.WebhookHandler{
+		Cache:    cache,
+		Fetcher:  &gitlabgoproxy.MixedFetcher{Masks: masks},
+		Secret:   "secret",
+		Prebuild: true,
+		Next:     next,
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(token, event, payload string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+gitlabgoproxy.WebhookPath, strings.NewReader(payload))
+		assert.NoError(t, err)
+		req.Header.Set("X-Gitlab-Token", token)
+		req.Header.Set("X-Gitlab-Event", event)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	hook := func(event, payload string) (invalidated, prebuild []string) {
+		resp := post("secret", event, payload)
+		assert.EqualValues(t, http.StatusOK, resp.StatusCode, payload)
+		var ret struct{ Invalidated, Prebuild []string }
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&ret))
+		return ret.Invalidated, ret.Prebuild
+	}
+	cached := func(name string) bool {
+		_, err := readCache(t, cache, name)
+		if err != nil {
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+		}
+		return err == nil
+	}
+
+	// a submodule tag invalidates and prebuilds the major version of the submodule
+	invalidated, prebuild := hook("Tag Push Hook", `{"object_kind": "tag_push", "ref": "refs/tags/pkg/str/v2.0.2",
+		"after": "8e7bc5bc4d8e3b3b0b7bfee1bc2b7bd2b6b3a8b1",
+		"project": {"path_with_namespace": "wongidle/mutiples", "web_url": "`+fg.URL+`/wongidle/mutiples"}}`)
+	assert.Contains(t, invalidated, "gitlab.com/wongidle/mutiples/pkg/str/v2/@v/list")
+	assert.Contains(t, invalidated, "gitlab.com/wongidle/mutiples/pkg/str/v2/@latest")
+	if assert.NotEmpty(t, prebuild) {
+		assert.EqualValues(t, "gitlab.com/wongidle/mutiples/pkg/str/v2@v2.0.2", prebuild[0])
+	}
+	// a submodule cannot be +incompatible
+	assert.NotContains(t, prebuild, "gitlab.com/wongidle/mutiples/pkg/str@v2.0.2+incompatible")
+	h.Wait()
+	assert.False(t, cached("gitlab.com/wongidle/mutiples/pkg/str/v2/@v/list"))
+	assert.True(t, cached("gitlab.com/wongidle/mutiples/v2/@v/list"))
+	mod, err := readCache(t, cache, "gitlab.com/wongidle/mutiples/pkg/str/v2/@v/v2.0.2.mod")
+	assert.NoError(t, err)
+	assert.Contains(t, mod, "module gitlab.com/wongidle/mutiples/pkg/str/v2")
+	assert.True(t, cached("gitlab.com/wongidle/mutiples/pkg/str/v2/@v/v2.0.2.info"))
+	assert.True(t, cached("gitlab.com/wongidle/mutiples/pkg/str/v2/@v/v2.0.2.zip"))
+
+	// a deleted tag, through a system hook, is not prebuilt
+	invalidated, prebuild = hook("System Hook", `{"event_name": "tag_push", "ref": "refs/tags/v0.1.1",
+		"after": "0000000000000000000000000000000000000000", "project": {"path_with_namespace": "wongidle/foobar"}}`)
+	assert.Contains(t, invalidated, "gitlab.com/wongidle/foobar/@v/list")
+	assert.Contains(t, invalidated, "gitlab.com/wongidle/foobar/@latest")
+	assert.False(t, cached("gitlab.com/wongidle/foobar/@latest"))
+	assert.Empty(t, prebuild)
+	assert.True(t, cached("gitlab.com/wongidle/foobar/pkg/@v/list"))
+
+	// projects are reached through prefix rules too, tags from another GitLab instance or not versions are ignored
+	invalidated, _ = hook("System Hook", `{"event_name": "tag_push", "ref": "refs/tags/api/v1.0.0",
+		"after": "0000000000000000000000000000000000000000", "project": {"path_with_namespace": "backend/payments/ledger"}}`)
+	assert.Contains(t, invalidated, "go.corp.example/payments/ledger/api/@v/list")
+	assert.False(t, cached("go.corp.example/payments/ledger/api/@v/list"))
+	invalidated, _ = hook("Tag Push Hook", `{"object_kind": "tag_push", "ref": "refs/tags/v0.3.0",
+		"project": {"path_with_namespace": "wongidle/foobar", "web_url": "https://gitlab.example.com/wongidle/foobar"}}`)
+	assert.Empty(t, invalidated)
+	invalidated, _ = hook("Tag Push Hook", `{"object_kind": "tag_push", "ref": "refs/tags/release-1",
+		"project": {"path_with_namespace": "wongidle/foobar"}}`)
+	assert.Empty(t, invalidated)
+
+	// a renamed project drops the list and latest responses of all its modules
+	invalidated, _ = hook("System Hook", `{"event_name": "project_rename",
+		"path_with_namespace": "wongidle/foobaz", "old_path_with_namespace": "wongidle/foobar"}`)
+	assert.EqualValues(t, []string{"gitlab.com/wongidle/foobar/pkg/@v/list"}, invalidated)
+	assert.True(t, cached("gitlab.com/wongidle/foobar/@v/v0.1.0.info"))
+
+	// other events are acknowledged
+	invalidated, _ = hook("Push Hook", `{"object_kind": "push", "ref": "refs/heads/main"}`)
+	assert.Empty(t, invalidated)
+
+	for _, token := range []string{"", "wrong"} {
+		resp := post(token, "Tag Push Hook", `{}`)
+		assert.EqualValues(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	resp := post("secret", "Tag Push Hook", `{`)
+	assert.EqualValues(t, http.StatusBadRequest, resp.StatusCode)
+
+	// other paths are served by next
+	resp, err = http.Get(srv.URL + "/gitlab.com/wongidle/foobar/@v/list")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, http.StatusTeapot, resp.StatusCode)
+}